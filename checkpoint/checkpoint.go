@@ -24,6 +24,12 @@ package checkpoint
 //   If you restart and want to restore a checkpointed VM, call
 //      cp, err := checkpoint.NewCheckpointer(nil, false)
 //      machine, err := cp.RestoreMachine("your checkpoint name")
+//   RestoreMachine uses the code saved by NewCheckpointer or SaveCode, and
+//   fails if it isn't the code the checkpointed machine was running.
+//   To move a checkpointed VM to another database, call
+//      err := cp.ExportMachine("your checkpoint name", writer)
+//   and, on the other database,
+//      err := cp.ImportMachine("your checkpoint name", reader)
 //   Before exiting, it's polite to clean up by calling
 //      err := cp.Close()
 //   [error handling code omitted]
@@ -32,12 +38,16 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-avm/vm/stack"
 	"github.com/offchainlabs/arb-util/protocol"
 	"github.com/offchainlabs/arb-util/value"
 )
@@ -50,6 +60,14 @@ type Checkpointer struct {
 const (
 	defaultCheckpointPath = "/tmp/arb-validator-checkpoint"
 	vcpVersionNumsKey     = "VersionedCheckpointer:versionNums"
+
+	// stack, aux stack, register, static, pc and error handler
+	machineValueCount = 6
+	// value hashes, size limit, code hash and stack kind. Records saved
+	// before the stack kind was added are a byte shorter, and restore with
+	// flat stacks.
+	machineRecordSize       = legacyMachineRecordSize + 1
+	legacyMachineRecordSize = machineValueCount*32 + 8 + 32
 )
 
 type Error struct {
@@ -66,9 +84,21 @@ func NewCheckpointer(machine *vm.Machine, destroyOldCheckpoints bool) (*Checkpoi
 			return nil, err
 		}
 	}
+	return openCheckpointer(defaultCheckpointPath, machine)
+}
+
+// OpenCheckpointer opens the existing checkpoint database at path, for
+// inspecting checkpoints saved by another process
+func OpenCheckpointer(path string) (*Checkpointer, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return openCheckpointer(path, nil)
+}
 
-	opts := badger.DefaultOptions(defaultCheckpointPath)
-	opts.ValueDir = defaultCheckpointPath
+func openCheckpointer(path string, machine *vm.Machine) (*Checkpointer, error) {
+	opts := badger.DefaultOptions(path)
+	opts.ValueDir = path
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, err
@@ -113,13 +143,21 @@ func (cp *Checkpointer) Close() error {
 
 type VersionedCheckpointer struct {
 	cp         *Checkpointer
+	mutex      sync.Mutex
 	minVersion int64
 	maxVersion int64
+	// every version below discardLow has been fully discarded; versions in
+	// [discardLow, minVersion) are no longer visible but may still be on disk
+	discardLow  int64
+	discardDone chan struct{} // non-nil while a discard goroutine is running
+	discardErr  error
+	closing     bool
 }
 
 func NewVersionedCheckpointer(cp *Checkpointer) (*VersionedCheckpointer, error) {
 	minVersion := int64(0)
 	maxVersion := int64(-1)
+	discardLow := int64(0)
 	restoring := false
 
 	if err := cp.db.View(func(txn *badger.Txn) error {
@@ -139,6 +177,13 @@ func NewVersionedCheckpointer(cp *Checkpointer) (*VersionedCheckpointer, error)
 			if err := binary.Read(rd, binary.LittleEndian, &maxVersion); err != nil {
 				return err
 			}
+			if err := binary.Read(rd, binary.LittleEndian, &discardLow); err != nil {
+				if err != io.EOF {
+					return err
+				}
+				// state saved before discard progress was recorded
+				discardLow = minVersion
+			}
 			return nil
 		}); err != nil {
 			return err
@@ -149,19 +194,40 @@ func NewVersionedCheckpointer(cp *Checkpointer) (*VersionedCheckpointer, error)
 	}); err != nil {
 		return nil, err
 	}
-	ret := &VersionedCheckpointer{cp, minVersion, maxVersion}
+	ret := &VersionedCheckpointer{
+		cp:         cp,
+		minVersion: minVersion,
+		maxVersion: maxVersion,
+		discardLow: discardLow,
+	}
 	if !restoring {
 		if err := ret.saveState(); err != nil {
 			return nil, err
 		}
 	}
+
+	// resume any discard that was interrupted before the last shutdown
+	ret.mutex.Lock()
+	ret.startDiscardIfNeeded()
+	ret.mutex.Unlock()
 	return ret, nil
 }
 
+// Close stops any in-progress discard after the version it is working on,
+// and closes the underlying Checkpointer. Discarding resumes when the
+// VersionedCheckpointer is next opened.
 func (vcp *VersionedCheckpointer) Close() error {
+	vcp.mutex.Lock()
+	vcp.closing = true
+	done := vcp.discardDone
+	vcp.mutex.Unlock()
+	if done != nil {
+		<-done
+	}
 	return vcp.cp.Close()
 }
 
+// caller must hold vcp.mutex
 func (vcp *VersionedCheckpointer) saveStateInTxn(txn *badger.Txn) error {
 	var buf bytes.Buffer
 	if err := binary.Write(&buf, binary.LittleEndian, &vcp.minVersion); err != nil {
@@ -170,9 +236,13 @@ func (vcp *VersionedCheckpointer) saveStateInTxn(txn *badger.Txn) error {
 	if err := binary.Write(&buf, binary.LittleEndian, &vcp.maxVersion); err != nil {
 		return err
 	}
+	if err := binary.Write(&buf, binary.LittleEndian, &vcp.discardLow); err != nil {
+		return err
+	}
 	return txn.Set([]byte(vcpVersionNumsKey), buf.Bytes())
 }
 
+// caller must hold vcp.mutex
 func (vcp *VersionedCheckpointer) saveState() error {
 	return vcp.cp.db.Update(func(txn *badger.Txn) error {
 		return vcp.saveStateInTxn(txn)
@@ -180,14 +250,16 @@ func (vcp *VersionedCheckpointer) saveState() error {
 }
 
 func vcpStateDataKey(versionNum int64) []byte {
-	return []byte("VersionedCheckpointer:stateData:" + string(versionNum))
+	return []byte("VersionedCheckpointer:stateData:" + strconv.FormatInt(versionNum, 10))
 }
 
 func vcpMachineVersionKey(versionNum int64) string {
-	return "versioned:" + string(versionNum)
+	return "versioned:" + strconv.FormatInt(versionNum, 10)
 }
 
 func (vcp *VersionedCheckpointer) SaveVersion(machine *vm.Machine, stateData []byte) (versionNum int64, returnErr error) {
+	vcp.mutex.Lock()
+	defer vcp.mutex.Unlock()
 	returnErr = vcp.cp.db.Update(func(txn *badger.Txn) error {
 		versionNum = 1 + vcp.maxVersion
 		nameSuffix := vcpMachineVersionKey(versionNum)
@@ -212,11 +284,11 @@ func (vcp *VersionedCheckpointer) SaveVersion(machine *vm.Machine, stateData []b
 func (vcp *VersionedCheckpointer) RestoreVersion(versionNum int64) (machine *vm.Machine, stateData []byte, retError error) {
 	machine = nil
 	stateData = nil
+	if !vcp.IsKnownVersion(versionNum) {
+		retError = Error{"Can't restore; invalid version number"}
+		return
+	}
 	retError = vcp.cp.db.View(func(txn *badger.Txn) error {
-		if !vcp.IsKnownVersion(versionNum) {
-			return Error{"Can't restore; invalid version number"}
-		}
-
 		item, err := txn.Get(vcpStateDataKey(versionNum))
 		if err == nil {
 			if err := item.Value(func(val []byte) error {
@@ -241,70 +313,126 @@ func (vcp *VersionedCheckpointer) RestoreVersion(versionNum int64) (machine *vm.
 }
 
 func (vcp *VersionedCheckpointer) KnownVersions() (minVersionNum, maxVersionNum int64) {
+	vcp.mutex.Lock()
+	defer vcp.mutex.Unlock()
 	minVersionNum = vcp.minVersion
 	maxVersionNum = vcp.maxVersion
 	return
 }
 
 func (vcp *VersionedCheckpointer) IsKnownVersion(num int64) bool {
+	vcp.mutex.Lock()
+	defer vcp.mutex.Unlock()
 	return (num >= vcp.minVersion) && (num <= vcp.maxVersion)
 }
 
+// discardVersion removes version num and records that it is gone, in a single
+// transaction, so a crash can't leave the version half-discarded. Values only
+// reachable from the discarded version are then removed; a failure there only
+// leaves unreferenced values in the database.
+//
+// vcp.mutex is held until the transaction commits, as in SaveVersion, so that
+// the saved state can't overwrite a concurrent save's.
 func (vcp *VersionedCheckpointer) discardVersion(num int64) error {
-	var refs [][32]byte = nil
-	if err := vcp.cp.db.Update(func(txn *badger.Txn) error {
+	var more [][32]byte
+	vcp.mutex.Lock()
+	err := vcp.cp.db.Update(func(txn *badger.Txn) error {
 		if err := txn.Delete(vcpStateDataKey(num)); err != nil {
 			return err
 		}
-		mkey := []byte("machine:" + vcpMachineVersionKey(num))
-		item, err := txn.Get(mkey)
+		var err error
+		more, err = vcp.cp.deleteMachineInTxn(txn, []byte(vcpMachineVersionKey(num)))
 		if err != nil {
-			return nil
-		}
-		if err := item.Value(func(barr []byte) error {
-			rd := bytes.NewReader(barr)
-			refs = make([][32]byte, 5)
-			for i := 0; i < 5; i++ {
-				if _, err := rd.Read(refs[i][:]); err != nil {
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
-
-		if err := txn.Delete(mkey); err != nil {
 			return err
 		}
-		return nil
-	}); err != nil {
-		return err
+		vcp.discardLow = num + 1
+		return vcp.saveStateInTxn(txn)
+	})
+	if err != nil {
+		vcp.discardLow = num // revert discardLow, because the transaction didn't commit
 	}
-	for _, h := range refs {
-		if err := vcp.cp.synchronousRemoveRefToValue(h); err != nil {
-			return err
-		}
+	vcp.mutex.Unlock()
+	if err != nil {
+		return err
 	}
-	return nil
+	return vcp.cp.removeOrphans(more)
 }
 
+// DiscardVersions makes all versions below newMinVersionNum unavailable. The
+// new range is saved before returning; the old versions are then deleted in
+// the background. Use WaitForDiscards to wait for the deletion to finish. If
+// the process stops first, deletion resumes when the VersionedCheckpointer is
+// reopened.
 func (vcp *VersionedCheckpointer) DiscardVersions(newMinVersionNum int64) error {
+	vcp.mutex.Lock()
+	defer vcp.mutex.Unlock()
 	if newMinVersionNum > 1+vcp.maxVersion {
 		return Error{"Can't discard versions that don't yet exist"}
 	}
+	if newMinVersionNum <= vcp.minVersion {
+		return nil
+	}
 	oldMinVersion := vcp.minVersion
 	vcp.minVersion = newMinVersionNum
+	if err := vcp.saveState(); err != nil {
+		vcp.minVersion = oldMinVersion
+		return err
+	}
+	vcp.startDiscardIfNeeded()
+	return nil
+}
+
+// WaitForDiscards blocks until no discard is in progress, and returns the
+// error that stopped the most recent discard, if any. Versions that failed to
+// discard are retried by the next call to DiscardVersions or on restart.
+func (vcp *VersionedCheckpointer) WaitForDiscards() error {
+	vcp.mutex.Lock()
+	done := vcp.discardDone
+	vcp.mutex.Unlock()
+	if done != nil {
+		<-done
+	}
+	vcp.mutex.Lock()
+	defer vcp.mutex.Unlock()
+	return vcp.discardErr
+}
 
-	// asynchronously discard old versions
+// caller must hold vcp.mutex
+func (vcp *VersionedCheckpointer) startDiscardIfNeeded() {
+	if vcp.discardDone != nil || vcp.closing || vcp.discardLow >= vcp.minVersion {
+		return
+	}
+	done := make(chan struct{})
+	vcp.discardDone = done
+	vcp.discardErr = nil
 	go func() {
-		for i := oldMinVersion; i < newMinVersionNum; i++ {
-			_ = vcp.discardVersion(i) // ignore errors; error will leave a useless old version sitting around
+		defer close(done)
+		for {
+			vcp.mutex.Lock()
+			if vcp.closing || vcp.discardLow >= vcp.minVersion {
+				vcp.discardDone = nil
+				vcp.mutex.Unlock()
+				return
+			}
+			next := vcp.discardLow
+			vcp.mutex.Unlock()
+
+			if err := vcp.discardVersion(next); err != nil {
+				vcp.mutex.Lock()
+				vcp.discardErr = err
+				vcp.discardDone = nil
+				vcp.mutex.Unlock()
+				return
+			}
 		}
 	}()
-	return nil
 }
 
+// An EventChainCheckpointer is the log of a state channel. Each sequence
+// number records the machine and inbox the parties intend to sign and, once
+// they have, the signatures. The records of a sequence number are keyed by
+// its zero-padded decimal text, so iterating over them visits them in
+// sequence number order.
 type EventChainCheckpointer struct {
 	cp          *Checkpointer
 	fullKey     []byte
@@ -315,7 +443,12 @@ type EventChainCheckpointer struct {
 	discarded   bool
 }
 
-const _eventChainCheckpointerPrefix = "EventChain:"
+const (
+	_eventChainCheckpointerPrefix = "EventChain:"
+
+	eccIntentKind     = "intentToSign"
+	eccSignaturesKind = "recordSignatures"
+)
 
 func NewEventChainCheckpointer(
 	cp *Checkpointer,
@@ -339,100 +472,93 @@ func NewEventChainCheckpointer(
 		return nil, err
 	}
 
-	var seqNumBuf bytes.Buffer
-	seqNum := uint64(0)
-	if err := binary.Write(&seqNumBuf, binary.LittleEndian, &seqNum); err != nil {
-		return nil, err
+	ret := &EventChainCheckpointer{
+		cp,
+		fullKey,
+		machineHash,
+		[2]uint64{timeBounds[0], timeBounds[1]},
+		balances.Clone(),
+		uint64(0),
+		false,
 	}
-
 	if err := cp.db.Update(func(txn *badger.Txn) error {
-		machineKey := append(fullKey, []byte(":machine:")...)
-		seqNumKey := append(fullKey, []byte(":nextseqnum:")...)
-		if err := cp.saveMachineInTxn(txn, machineKey, machine); err != nil {
-			return err
-		}
-		if err := txn.Set(seqNumKey, seqNumBuf.Bytes()); err != nil {
+		if err := cp.saveMachineInTxn(txn, ret.startMachineKey(), machine); err != nil {
 			return err
 		}
-		if err := txn.Set(fullKey, buf.Bytes()); err != nil {
+		if err := ret.saveNextSeqNumInTxn(txn, 0); err != nil {
 			return err
 		}
-		return nil
+		return txn.Set(fullKey, buf.Bytes())
 	}); err != nil {
 		return nil, err
 	}
-	return &EventChainCheckpointer{
-		cp,
-		fullKey,
-		machineHash,
-		[2]uint64{timeBounds[0], timeBounds[1]},
-		balances.Clone(),
-		uint64(0),
-		false,
-	}, nil
+	return ret, nil
 }
 
-func (ecc *EventChainCheckpointer) Discard() error {
-	if !ecc.discarded {
-		ecc.discarded = true
-		var inboxHash [32]byte
-		needToRemoveInboxRef := false
-		if err := ecc.cp.db.Update(func(txn *badger.Txn) error {
-			item, err := txn.Get(ecc.fullKey)
-			if err != nil {
-				return err
-			}
-			if err := item.Value(func(val []byte) error {
-				if len(val) < 64 {
-					return errors.New("EventChainCheckpointer::Discard: checkpointed item is too small")
-				}
-				copy(inboxHash[:], val[32:64])
-				return nil
-			}); err != nil {
-				return err
-			}
-			needToRemoveInboxRef = true
-			return txn.Delete(ecc.fullKey)
-		}); err != nil {
-			return nil
-		}
-		if needToRemoveInboxRef {
-			ecc.cp.RemoveRefToValue(inboxHash) // error will be ignored
-		}
-
-		// asynchronously delete the info checkpointed for this event chain
-		go func() {
-			// ignore all errors in here--no way to recover, and worst possible outcome is that orphaned data is left in database
-			for i := uint64(0); i < ecc.nextSeqNo; i++ {
-				needRemove := false
-				var inboxHash [32]byte
-				_ = ecc.cp.db.Update(func(txn *badger.Txn) error {
-					keyIntent := ecc.eccKeyForSeqNum(i, "intentToSign")
-					keySigs := ecc.eccKeyForSeqNum(i, "recordSignatures")
-					item, err := txn.Get(keyIntent)
-					if err == nil {
-						_ = item.Value(func(itemBytes []byte) error {
-							copy(inboxHash[:], itemBytes[32:64])
-							return nil
-						})
-						needRemove = true
-
-					}
-					_ = txn.Delete(keyIntent)
-					_ = txn.Delete(keySigs)
-					return nil
-				})
-				if needRemove {
-					ecc.cp.RemoveRefToValue(inboxHash)
-				}
-			}
-		}()
-	}
-	return nil
+func (ecc *EventChainCheckpointer) startMachineKey() []byte {
+	return append(append([]byte{}, ecc.fullKey...), []byte(":machine:")...)
+}
+
+func (ecc *EventChainCheckpointer) nextSeqNumKey() []byte {
+	return append(append([]byte{}, ecc.fullKey...), []byte(":nextseqnum:")...)
+}
+
+func (ecc *EventChainCheckpointer) seqNumPrefix() []byte {
+	return append(append([]byte{}, ecc.fullKey...), []byte(":seq:")...)
 }
 
 func (ecc *EventChainCheckpointer) eccKeyForSeqNum(seqNum uint64, kind string) []byte {
-	return append(ecc.fullKey, []byte(string(seqNum)+kind)...)
+	return append(ecc.seqNumPrefix(), []byte(fmt.Sprintf("%020d:%s", seqNum, kind))...)
+}
+
+// parseSeqNumKey splits a key made by eccKeyForSeqNum into its sequence
+// number and kind
+func (ecc *EventChainCheckpointer) parseSeqNumKey(key []byte) (uint64, string, error) {
+	rest := string(key[len(ecc.seqNumPrefix()):])
+	if len(rest) < 21 || rest[20] != ':' {
+		return 0, "", Error{"EventChainCheckpointer: malformed sequence number key"}
+	}
+	seqNum, err := strconv.ParseUint(rest[:20], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return seqNum, rest[21:], nil
+}
+
+func (ecc *EventChainCheckpointer) saveNextSeqNumInTxn(txn *badger.Txn, nextSeqNum uint64) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &nextSeqNum); err != nil {
+		return err
+	}
+	return txn.Set(ecc.nextSeqNumKey(), buf.Bytes())
+}
+
+// Discard deletes everything recorded for the event chain
+func (ecc *EventChainCheckpointer) Discard() error {
+	if ecc.discarded {
+		return nil
+	}
+	// prune first, so a failure leaves a chain that can still be restored
+	if err := ecc.pruneBelow(ecc.nextSeqNo); err != nil {
+		return err
+	}
+	var orphans [][32]byte
+	if err := ecc.cp.db.Update(func(txn *badger.Txn) error {
+		var err error
+		orphans, err = ecc.cp.deleteMachineInTxn(txn, ecc.startMachineKey())
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(ecc.nextSeqNumKey()); err != nil {
+			return err
+		}
+		return txn.Delete(ecc.fullKey)
+	}); err != nil {
+		return err
+	}
+	// only now is the chain gone, so a failure above can be retried
+	ecc.discarded = true
+	return ecc.cp.removeOrphans(orphans)
 }
 
 func (ecc *EventChainCheckpointer) RecordIntentToSign(seqNum uint64, machine *vm.Machine, inbox value.Value) error {
@@ -453,25 +579,23 @@ func (ecc *EventChainCheckpointer) RecordIntentToSign(seqNum uint64, machine *vm
 		return err
 	}
 
-	ecc.nextSeqNo = seqNum + 1
-	var seqNumBuf bytes.Buffer
-	if err := binary.Write(&seqNumBuf, binary.LittleEndian, &seqNum); err != nil {
-		return err
-	}
-	seqNumKey := append(ecc.fullKey, []byte(":nextseqnum:")...)
-	key := ecc.eccKeyForSeqNum(seqNum, "intentToSign")
-	return ecc.cp.db.Update(func(txn *badger.Txn) error {
+	key := ecc.eccKeyForSeqNum(seqNum, eccIntentKind)
+	if err := ecc.cp.db.Update(func(txn *badger.Txn) error {
 		if err := ecc.cp.addRefToValueInTxn(txn, inbox); err != nil {
 			return err
 		}
 		if err := ecc.cp.saveMachineInTxn(txn, key, machine); err != nil {
 			return err
 		}
-		if err := txn.Set(seqNumKey, seqNumBuf.Bytes()); err != nil {
+		if err := ecc.saveNextSeqNumInTxn(txn, seqNum+1); err != nil {
 			return err
 		}
 		return txn.Set(key, buf.Bytes())
-	})
+	}); err != nil {
+		return err
+	}
+	ecc.nextSeqNo = seqNum + 1
+	return nil
 }
 
 func (ecc *EventChainCheckpointer) RecordSignatures(seqNum uint64, marshaledSigs []byte) error {
@@ -481,8 +605,13 @@ func (ecc *EventChainCheckpointer) RecordSignatures(seqNum uint64, marshaledSigs
 	if seqNum >= ecc.nextSeqNo {
 		return errors.New("EventChainCheckpointer::RecordSignatures: invalid sequence number")
 	}
-	key := ecc.eccKeyForSeqNum(seqNum, "recordSignatures")
+	key := ecc.eccKeyForSeqNum(seqNum, eccSignaturesKind)
 	return ecc.cp.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(ecc.eccKeyForSeqNum(seqNum, eccIntentKind)); err == badger.ErrKeyNotFound {
+			return errors.New("EventChainCheckpointer::RecordSignatures: no intent-to-sign recorded for sequence number")
+		} else if err != nil {
+			return err
+		}
 		return txn.Set(key, marshaledSigs)
 	})
 }
@@ -510,7 +639,7 @@ func RestoreEventChainCheckpointer(cp *Checkpointer, keySuffix []byte) (*EventCh
 	rd := bytes.NewReader(recordedBytes)
 
 	var machineHash [32]byte
-	if _, err := rd.Read(machineHash[:]); err != nil {
+	if _, err := io.ReadFull(rd, machineHash[:]); err != nil {
 		return nil, err
 	}
 
@@ -526,33 +655,184 @@ func RestoreEventChainCheckpointer(cp *Checkpointer, keySuffix []byte) (*EventCh
 		return nil, err
 	}
 
-	seqNumKey := append(fullKey, []byte(":nextseqnum:")...)
-	nextSeqNum := uint64(0)
+	ret := &EventChainCheckpointer{
+		cp,
+		fullKey,
+		machineHash,
+		timeBounds,
+		balanceTracker,
+		0,
+		false,
+	}
 	if err := cp.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(seqNumKey)
+		item, err := txn.Get(ret.nextSeqNumKey())
 		if err != nil {
 			return err
 		}
 		return item.Value(func(byteArr []byte) error {
 			rd := bytes.NewReader(byteArr)
-			return binary.Read(rd, binary.LittleEndian, &nextSeqNum)
+			return binary.Read(rd, binary.LittleEndian, &ret.nextSeqNo)
 		})
 	}); err != nil {
 		return nil, err
 	}
-	return &EventChainCheckpointer{
-		cp,
-		fullKey,
-		machineHash,
-		timeBounds,
-		balanceTracker,
-		nextSeqNum,
-		false,
-	}, nil
+	return ret, nil
 }
 
 func (ecc *EventChainCheckpointer) RestoreChainStartMachine() (*vm.Machine, error) {
-	return ecc.cp.RestoreMachine(ecc.fullKey)
+	return ecc.cp.RestoreMachine(ecc.startMachineKey())
+}
+
+// ForEachSeqNum calls fn, in increasing order, for each sequence number with
+// a recorded intent-to-sign that hasn't been pruned, saying whether its
+// signatures have been recorded too. It stops early if fn returns false.
+func (ecc *EventChainCheckpointer) ForEachSeqNum(fn func(seqNum uint64, signed bool) bool) error {
+	if ecc.discarded {
+		return errors.New("can't iterate over discarded EventChainCheckpointer")
+	}
+	return ecc.cp.db.View(func(txn *badger.Txn) error {
+		return ecc.forEachSeqNumInTxn(txn, false, fn)
+	})
+}
+
+func (ecc *EventChainCheckpointer) forEachSeqNumInTxn(txn *badger.Txn, reverse bool, fn func(seqNum uint64, signed bool) bool) error {
+	prefix := ecc.seqNumPrefix()
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = reverse
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	// the records of a sequence number are adjacent, so each one is reported
+	// when the iteration moves past them
+	var seqNum uint64
+	haveIntent, haveSigs, started := false, false, false
+	report := func() bool {
+		if started && haveIntent {
+			return fn(seqNum, haveSigs)
+		}
+		return true
+	}
+	seekKey := prefix
+	if reverse {
+		seekKey = append(append([]byte{}, prefix...), 0xff)
+	}
+	for it.Seek(seekKey); it.ValidForPrefix(prefix); it.Next() {
+		num, kind, err := ecc.parseSeqNumKey(it.Item().Key())
+		if err != nil {
+			return err
+		}
+		if !started || num != seqNum {
+			if !report() {
+				return nil
+			}
+			seqNum, haveIntent, haveSigs, started = num, false, false, true
+		}
+		switch kind {
+		case eccIntentKind:
+			haveIntent = true
+		case eccSignaturesKind:
+			haveSigs = true
+		}
+	}
+	report()
+	return nil
+}
+
+// LatestSignedSeqNum returns the highest sequence number whose signatures
+// have been recorded. After a crash, this is the state to resume from: any
+// later intents-to-sign may never have been signed by every party.
+func (ecc *EventChainCheckpointer) LatestSignedSeqNum() (seqNum uint64, found bool, err error) {
+	if ecc.discarded {
+		return 0, false, errors.New("can't search discarded EventChainCheckpointer")
+	}
+	err = ecc.cp.db.View(func(txn *badger.Txn) error {
+		return ecc.forEachSeqNumInTxn(txn, true, func(num uint64, signed bool) bool {
+			if signed {
+				seqNum, found = num, true
+			}
+			return !signed
+		})
+	})
+	return seqNum, found, err
+}
+
+// RestoreLatestSigned restores the machine, inbox and signatures recorded
+// for the sequence number returned by LatestSignedSeqNum
+func (ecc *EventChainCheckpointer) RestoreLatestSigned() (uint64, *vm.Machine, value.Value, []byte, error) {
+	seqNum, found, err := ecc.LatestSignedSeqNum()
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if !found {
+		return 0, nil, nil, nil, Error{"EventChainCheckpointer: no fully-signed state recorded"}
+	}
+	machine, inbox, marshaledSigs, err := ecc.RestoreFromSeqNum(seqNum)
+	return seqNum, machine, inbox, marshaledSigs, err
+}
+
+// PruneBelow deletes everything recorded for sequence numbers below seqNum.
+// Each sequence number is deleted atomically, so if the process stops part
+// way through, the remaining records are intact and PruneBelow can be called
+// again.
+func (ecc *EventChainCheckpointer) PruneBelow(seqNum uint64) error {
+	if ecc.discarded {
+		return errors.New("can't prune discarded EventChainCheckpointer")
+	}
+	return ecc.pruneBelow(seqNum)
+}
+
+func (ecc *EventChainCheckpointer) pruneBelow(seqNum uint64) error {
+	var toPrune []uint64
+	if err := ecc.cp.db.View(func(txn *badger.Txn) error {
+		return ecc.forEachSeqNumInTxn(txn, false, func(num uint64, signed bool) bool {
+			if num >= seqNum {
+				return false
+			}
+			toPrune = append(toPrune, num)
+			return true
+		})
+	}); err != nil {
+		return err
+	}
+	for _, num := range toPrune {
+		if err := ecc.deleteSeqNum(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ecc *EventChainCheckpointer) deleteSeqNum(seqNum uint64) error {
+	var orphans [][32]byte
+	if err := ecc.cp.db.Update(func(txn *badger.Txn) error {
+		intentKey := ecc.eccKeyForSeqNum(seqNum, eccIntentKind)
+		intent, err := getInTxn(txn, intentKey)
+		if err != nil {
+			return err
+		}
+		if len(intent) < 64 {
+			return errors.New("EventChainCheckpointer: intentToSign record is too small")
+		}
+		var inboxHash [32]byte
+		copy(inboxHash[:], intent[32:64])
+		orphans, err = ecc.cp.removeRefToValueInTxn(txn, inboxHash)
+		if err != nil {
+			return err
+		}
+		more, err := ecc.cp.deleteMachineInTxn(txn, intentKey)
+		if err != nil {
+			return err
+		}
+		orphans = append(orphans, more...)
+		if err := txn.Delete(intentKey); err != nil {
+			return err
+		}
+		return txn.Delete(ecc.eccKeyForSeqNum(seqNum, eccSignaturesKind))
+	}); err != nil {
+		return err
+	}
+	return ecc.cp.removeOrphans(orphans)
 }
 
 func (ecc *EventChainCheckpointer) RestoreFromSeqNum(seqNum uint64) (*vm.Machine /*inbox*/, value.Value /*marshaledSigs*/, []byte, error) {
@@ -563,7 +843,7 @@ func (ecc *EventChainCheckpointer) RestoreFromSeqNum(seqNum uint64) (*vm.Machine
 		return nil, nil, nil, errors.New("invalid sequence number in EventChainCheckpointer::RestoreFromSeqNum")
 	}
 
-	intentKey := ecc.eccKeyForSeqNum(seqNum, "intentToSign")
+	intentKey := ecc.eccKeyForSeqNum(seqNum, eccIntentKind)
 	var machineHash [32]byte
 	var inboxHash [32]byte
 	if err := ecc.cp.db.View(func(txn *badger.Txn) error {
@@ -572,7 +852,7 @@ func (ecc *EventChainCheckpointer) RestoreFromSeqNum(seqNum uint64) (*vm.Machine
 			return err
 		}
 		return item.Value(func(val []byte) error {
-			if len(val) < 32 {
+			if len(val) < 64 {
 				return errors.New("EventChainCheckpointer: intentToSign record is too small")
 			}
 			copy(machineHash[:], val[:32])
@@ -592,7 +872,7 @@ func (ecc *EventChainCheckpointer) RestoreFromSeqNum(seqNum uint64) (*vm.Machine
 	}
 
 	var marshaledSigs []byte
-	sigsKey := ecc.eccKeyForSeqNum(seqNum, "recordSignatures")
+	sigsKey := ecc.eccKeyForSeqNum(seqNum, eccSignaturesKind)
 	if err := ecc.cp.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(sigsKey)
 		if err == badger.ErrKeyNotFound {
@@ -625,28 +905,62 @@ func (cp *Checkpointer) EntryExists(key []byte) (bool, error) {
 	return true, nil
 }
 
+// SaveMachine checkpoints the state of machine under keySuffix, along with the
+// hash of its code. The code itself is only saved by SaveCode or
+// SaveMachineWithCode.
 func (cp *Checkpointer) SaveMachine(keySuffix []byte, machine *vm.Machine) error {
 	return cp.db.Update(func(txn *badger.Txn) error {
 		return cp.saveMachineInTxn(txn, keySuffix, machine)
 	})
 }
 
+// SaveMachineWithCode is like SaveMachine, but also saves the machine's code,
+// replacing any code saved before
+func (cp *Checkpointer) SaveMachineWithCode(keySuffix []byte, machine *vm.Machine) error {
+	var orphans [][32]byte
+	if err := cp.db.Update(func(txn *badger.Txn) error {
+		var err error
+		orphans, err = cp.saveCodeInTxn(txn, machine)
+		if err != nil {
+			return err
+		}
+		return cp.saveMachineInTxn(txn, keySuffix, machine)
+	}); err != nil {
+		return err
+	}
+	return cp.removeOrphans(orphans)
+}
+
 func (cp *Checkpointer) saveMachineInTxn(txn *badger.Txn, keySuffix []byte, machine *vm.Machine) error {
 	key := append([]byte("machine:"), keySuffix...)
-	var buf bytes.Buffer
-	var vals [6]value.Value
-	vals[0] = machine.Stack().FullyExpandedValue()
-	vals[1] = machine.AuxStack().FullyExpandedValue()
-	vals[2] = machine.Register().Get()
-	vals[3] = machine.Static().Get()
-	vals[4] = machine.GetPC()
-	vals[5] = machine.GetErrHandler()
-	for i := 0; i < len(vals); i++ {
-		if err := cp.addRefToValueInTxn(txn, vals[i]); err != nil {
+	batch := newRefBatch(cp, txn)
+	var hashes [machineValueCount][32]byte
+	var err error
+	if hashes[0], err = batch.addStackRef(machine.Stack()); err != nil {
+		return err
+	}
+	if hashes[1], err = batch.addStackRef(machine.AuxStack()); err != nil {
+		return err
+	}
+	vals := []value.Value{
+		machine.Register().Get(),
+		machine.Static().Get(),
+		machine.GetPC(),
+		machine.GetErrHandler(),
+	}
+	for i, val := range vals {
+		if err := batch.addRef(val); err != nil {
 			return err
 		}
-		h := vals[i].Hash()
-		if _, err := buf.Write(h[:]); err != nil {
+		hashes[2+i] = val.Hash()
+	}
+	if err := batch.flush(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for i := range hashes {
+		if _, err := buf.Write(hashes[i][:]); err != nil {
 			return err
 		}
 	}
@@ -654,9 +968,48 @@ func (cp *Checkpointer) saveMachineInTxn(txn *badger.Txn, keySuffix []byte, mach
 	if err := binary.Write(&buf, binary.LittleEndian, &sizeLimit); err != nil {
 		return err
 	}
+	codeHash := machine.CodeHash()
+	if _, err := buf.Write(codeHash[:]); err != nil {
+		return err
+	}
+	if err := buf.WriteByte(byte(machine.StackKind())); err != nil {
+		return err
+	}
 	return txn.Set(key, buf.Bytes())
 }
 
+// deleteMachineInTxn deletes the machine checkpointed under keySuffix, if
+// there is one. It returns the values that lost their last reference; the
+// caller must remove them once txn has committed.
+func (cp *Checkpointer) deleteMachineInTxn(txn *badger.Txn, keySuffix []byte) ([][32]byte, error) {
+	key := append([]byte("machine:"), keySuffix...)
+	rec, err := getInTxn(txn, key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	refs, err := readMachineRefs(bytes.NewReader(rec))
+	if err != nil {
+		return nil, err
+	}
+	if err := txn.Delete(key); err != nil {
+		return nil, err
+	}
+	var orphans [][32]byte
+	for _, h := range refs {
+		children, err := cp.removeRefToValueInTxn(txn, h)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, children...)
+	}
+	return orphans, nil
+}
+
+// RestoreMachine rebuilds the machine checkpointed under keySuffix, using the
+// code saved in the database. It fails if that code isn't the code the
+// machine was running when it was checkpointed.
 func (cp *Checkpointer) RestoreMachine(keySuffix []byte) (*vm.Machine, error) {
 	txn := cp.db.NewTransaction(false)
 	defer txn.Discard()
@@ -664,28 +1017,42 @@ func (cp *Checkpointer) RestoreMachine(keySuffix []byte) (*vm.Machine, error) {
 	return cp.restoreMachineInTxn(txn, keySuffix)
 }
 
+// RestoreMachineWithCode is like RestoreMachine, but runs the machine on
+// codeOps instead of the saved code. codeOps must hash to the checkpointed
+// code hash.
+func (cp *Checkpointer) RestoreMachineWithCode(keySuffix []byte, codeOps []value.Operation) (*vm.Machine, error) {
+	txn := cp.db.NewTransaction(false)
+	defer txn.Discard()
+
+	return cp.restoreMachineWithCodeInTxn(txn, keySuffix, codeOps)
+}
+
 func (cp *Checkpointer) restoreMachineInTxn(txn *badger.Txn, keySuffix []byte) (*vm.Machine, error) {
-	key := append([]byte("machine:"), keySuffix...)
+	codeOps, err := cp.restoreCodeInTxn(txn)
+	if err == badger.ErrKeyNotFound {
+		return nil, Error{"RestoreMachine: no code has been checkpointed"}
+	} else if err != nil {
+		return nil, err
+	}
+	return cp.restoreMachineWithCodeInTxn(txn, keySuffix, codeOps)
+}
 
-	item, err := txn.Get(key)
+func (cp *Checkpointer) restoreMachineWithCodeInTxn(txn *badger.Txn, keySuffix []byte, codeOps []value.Operation) (*vm.Machine, error) {
+	machineBytes, err := getInTxn(txn, append([]byte("machine:"), keySuffix...))
 	if err != nil {
 		return nil, err
 	}
-	var machineBytes []byte
-	if err := item.Value(func(bytesVal []byte) error {
-		machineBytes = append([]byte{}, bytesVal...)
-		return nil
-	}); err != nil {
-		return nil, err
+	if !validMachineRecordSize(len(machineBytes)) {
+		return nil, Error{"RestoreMachine: malformed machine record"}
 	}
 
 	rd := bytes.NewReader(machineBytes)
-	var vals [6]value.Value
-	var h [32]byte
-	for i := 0; i < len(vals); i++ {
-		if _, err := io.ReadFull(rd, h[:]); err != nil {
-			return nil, err
-		}
+	refs, err := readMachineRefs(rd)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]value.Value, len(refs))
+	for i, h := range refs {
 		vals[i], err = cp.restoreValueFromHashInTxn(txn, h)
 		if err != nil {
 			return nil, err
@@ -695,19 +1062,52 @@ func (cp *Checkpointer) restoreMachineInTxn(txn *badger.Txn, keySuffix []byte) (
 	if err := binary.Read(rd, binary.LittleEndian, &sizeLimit); err != nil {
 		return nil, err
 	}
+	var codeHash [32]byte
+	if _, err := io.ReadFull(rd, codeHash[:]); err != nil {
+		return nil, err
+	}
+	stackKind := stack.KindFlat
+	if len(machineBytes) == machineRecordSize {
+		kind, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if stackKind = stack.Kind(kind); stackKind > stack.KindLazyFlat {
+			return nil, Error{fmt.Sprintf("RestoreMachine: unknown stack kind %v", kind)}
+		}
+	}
+
+	errHandler, ok := vals[5].(value.CodePointValue)
+	if !ok {
+		return nil, errors.New("6th value must be a codepoint")
+	}
+	machine, err := vm.RestoreMachine(codeOps, vals[0], vals[1], vals[2], vals[3], vals[4], errHandler, sizeLimit, stackKind)
+	if err != nil {
+		return nil, err
+	}
+	if machine.CodeHash() != codeHash {
+		return nil, Error{fmt.Sprintf(
+			"RestoreMachine: machine was checkpointed running code %x, but was given code %x",
+			codeHash,
+			machine.CodeHash(),
+		)}
+	}
+	return machine, nil
+}
 
-	// codeOps, err := cp.restoreCodeInTxn(txn)
-	// if err != nil {
-	//	return nil, err
-	//}
-	//
-	// errHandler, ok := vals[5].(value.CodePointValue)
-	// if !ok {
-	//	return nil, errors.New("6th value must be a codepoint")
-	//}
+func validMachineRecordSize(n int) bool {
+	return n == machineRecordSize || n == legacyMachineRecordSize
+}
 
-	return nil, errors.New("ERROR: Unimplemented")
-	// return vm.RestoreMachine(codeOps, vals[0], vals[1], vals[2], vals[3], vals[4], errHandler, sizeLimit), nil
+// readMachineRefs reads the hashes of the values referenced by a saved machine
+func readMachineRefs(rd io.Reader) ([][32]byte, error) {
+	refs := make([][32]byte, machineValueCount)
+	for i := range refs {
+		if _, err := io.ReadFull(rd, refs[i][:]); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
 }
 
 func writeOp(wr io.Writer, op value.Operation) (value.Value, error) {
@@ -729,7 +1129,9 @@ func writeOp(wr io.Writer, op value.Operation) (value.Value, error) {
 	return val, nil
 }
 
-func (cp *Checkpointer) restoreOp(txn *badger.Txn, rd io.Reader) (value.Operation, error) {
+// readOp decodes an operation written by writeOp, using lookup to resolve an
+// immediate value
+func readOp(rd io.Reader, lookup valueLookup) (value.Operation, error) {
 	var buf [2]byte
 	if _, err := io.ReadFull(rd, buf[:]); err != nil {
 		return nil, err
@@ -739,7 +1141,7 @@ func (cp *Checkpointer) restoreOp(txn *badger.Txn, rd io.Reader) (value.Operatio
 		if _, err := io.ReadFull(rd, h[:]); err != nil {
 			return nil, err
 		}
-		immedVal, err := cp.restoreValueFromHashInTxn(txn, h)
+		immedVal, err := lookup(h)
 		if err != nil {
 			return nil, err
 		}
@@ -749,29 +1151,79 @@ func (cp *Checkpointer) restoreOp(txn *badger.Txn, rd io.Reader) (value.Operatio
 	}
 }
 
+// SaveCode saves the code of machine, replacing any code saved before.
+// Checkpointed machines that ran different code can then only be restored
+// with RestoreMachineWithCode.
 func (cp *Checkpointer) SaveCode(machine *vm.Machine) error {
+	var orphans [][32]byte
+	if err := cp.db.Update(func(txn *badger.Txn) error {
+		var err error
+		orphans, err = cp.saveCodeInTxn(txn, machine)
+		return err
+	}); err != nil {
+		return err
+	}
+	return cp.removeOrphans(orphans)
+}
+
+// saveCodeInTxn saves the code of machine unless it is already saved. It
+// returns the values that lost their last reference when the previously saved
+// code was replaced; the caller must remove them once txn has committed.
+func (cp *Checkpointer) saveCodeInTxn(txn *badger.Txn, machine *vm.Machine) ([][32]byte, error) {
 	var buf bytes.Buffer
 	ops := machine.GetAllOperations()
 	key := []byte("code")
 
 	numOps := uint64(len(ops))
 	if err := binary.Write(&buf, binary.LittleEndian, &numOps); err != nil {
-		return err
+		return nil, err
 	}
-
-	for i := uint64(0); i < numOps; i++ {
-		op := ops[i]
+	batch := newRefBatch(cp, txn)
+	for _, op := range ops {
 		val, err := writeOp(&buf, op)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if val != nil {
-			_ = cp.AddRefToValue(val) // accept that will be orphaned if txn below fails
+			if err := batch.addRef(val); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return cp.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, buf.Bytes())
-	})
+
+	oldCode, err := getInTxn(txn, key)
+	if err == nil && bytes.Equal(oldCode, buf.Bytes()) {
+		return nil, nil
+	} else if err != nil && err != badger.ErrKeyNotFound {
+		return nil, err
+	}
+	if err := batch.flush(); err != nil {
+		return nil, err
+	}
+	var orphans [][32]byte
+	oldRefs, err := codeRecordRefs(oldCode)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range oldRefs {
+		children, err := cp.removeRefToValueInTxn(txn, h)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, children...)
+	}
+	return orphans, txn.Set(key, buf.Bytes())
+}
+
+// removeOrphans removes the references held by values that were deleted in an
+// earlier transaction; a failure only leaves unreferenced values in the database
+func (cp *Checkpointer) removeOrphans(hashes [][32]byte) error {
+	for _, h := range hashes {
+		if err := cp.synchronousRemoveRefToValue(h); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (cp *Checkpointer) restoreCodeInTxn(txn *badger.Txn) ([]value.Operation, error) {
@@ -797,7 +1249,7 @@ func (cp *Checkpointer) restoreCodeInTxn(txn *badger.Txn) ([]value.Operation, er
 	}
 	ops := make([]value.Operation, numOps)
 	for i := uint64(0); i < numOps; i++ {
-		ops[i], err = cp.restoreOp(txn, rd)
+		ops[i], err = readOp(rd, cp.txnLookup(txn))
 		if err != nil {
 			return nil, err
 		}
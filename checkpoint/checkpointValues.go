@@ -22,6 +22,7 @@ import (
 	"io"
 
 	"github.com/dgraph-io/badger"
+	"github.com/offchainlabs/arb-avm/vm/stack"
 	"github.com/offchainlabs/arb-util/value"
 )
 
@@ -84,51 +85,154 @@ func (cp *Checkpointer) writeValue(wr io.Writer, val value.Value) ([]value.Value
 }
 
 func (cp *Checkpointer) addRefToValueInTxn(txn *badger.Txn, val value.Value) error {
-	h := val.Hash()
-	hkey := append([]byte{PrefixValue}, h[:]...)
-	item, err := txn.Get(hkey)
+	batch := newRefBatch(cp, txn)
+	if err := batch.addRef(val); err != nil {
+		return err
+	}
+	return batch.flush()
+}
+
+// refBatch collects the references added by one save, so that each stored
+// value is read and written at most once no matter how often it is referenced.
+// The children of a value are only visited if the value isn't already stored,
+// which makes the cost of a save proportional to what changed since the last one.
+type refBatch struct {
+	cp      *Checkpointer
+	txn     *badger.Txn
+	pending map[[32]byte]*pendingRef
+	order   [][32]byte
+}
+
+type pendingRef struct {
+	refs   uint64
+	record []byte // encoded value if it isn't stored yet, nil otherwise
+}
+
+func newRefBatch(cp *Checkpointer, txn *badger.Txn) *refBatch {
+	return &refBatch{cp, txn, make(map[[32]byte]*pendingRef), nil}
+}
+
+// addRefIfKnown adds a reference to the value with hash h, if that value is
+// already stored or already part of the batch, and reports whether it did
+func (b *refBatch) addRefIfKnown(h [32]byte) (bool, error) {
+	if p, ok := b.pending[h]; ok {
+		p.refs++
+		return true, nil
+	}
+	_, err := b.txn.Get(append([]byte{PrefixValue}, h[:]...))
 	switch err {
 	case nil:
-		// value found; increment its refcount
-		var refCount uint64
-		var valCopy []byte
-		if err := item.Value(func(barr []byte) error {
-			valCopy = append([]byte{}, barr...)
-			rd := bytes.NewReader(barr[:8])
-			return binary.Read(rd, binary.LittleEndian, &refCount)
-		}); err != nil {
+		b.pending[h] = &pendingRef{1, nil}
+		b.order = append(b.order, h)
+		return true, nil
+	case badger.ErrKeyNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// addNew adds a value that isn't stored yet, given its encoding; the caller
+// is responsible for adding references to its children
+func (b *refBatch) addNew(h [32]byte, record []byte) {
+	b.pending[h] = &pendingRef{1, record}
+	b.order = append(b.order, h)
+}
+
+func (b *refBatch) addRef(val value.Value) error {
+	h := val.Hash()
+	known, err := b.addRefIfKnown(h)
+	if err != nil || known {
+		return err
+	}
+	var buf bytes.Buffer
+	more, err := b.cp.writeValue(&buf, val)
+	if err != nil {
+		return err
+	}
+	b.addNew(h, buf.Bytes())
+	for _, v := range more {
+		if err := b.addRef(v); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		refCount++
-		var buf bytes.Buffer
-		if err := binary.Write(&buf, binary.LittleEndian, &refCount); err != nil {
-			return err
+// addStackRef adds a reference to the tuple chain representation of s, and
+// returns its hash. Stacks that can walk their chain are saved without
+// building it, stopping at the first link that is already stored.
+func (b *refBatch) addStackRef(s stack.Stack) ([32]byte, error) {
+	walker, ok := s.(stack.TupleChainWalker)
+	if !ok {
+		val := s.FullyExpandedValue()
+		return val.Hash(), b.addRef(val)
+	}
+	var walkErr error
+	reachedBottom := true
+	walker.WalkTupleChain(func(item value.Value, linkHash [32]byte, restHash [32]byte) bool {
+		known, err := b.addRefIfKnown(linkHash)
+		if err != nil || known {
+			walkErr = err
+			reachedBottom = false
+			return false
+		}
+		itemHash := item.Hash()
+		record := append([]byte{value.TypeCodeTuple, 2}, itemHash[:]...)
+		b.addNew(linkHash, append(record, restHash[:]...))
+		if err := b.addRef(item); err != nil {
+			walkErr = err
+			reachedBottom = false
+			return false
+		}
+		return true
+	})
+	if walkErr != nil {
+		return [32]byte{}, walkErr
+	}
+	if reachedBottom {
+		if err := b.addRef(value.NewEmptyTuple()); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	return s.StateValue().Hash(), nil
+}
+
+// flush writes the batch to its transaction
+func (b *refBatch) flush() error {
+	for _, h := range b.order {
+		p := b.pending[h]
+		hkey := append([]byte{PrefixValue}, h[:]...)
+		refCount := p.refs
+		record := p.record
+		if record == nil {
+			item, err := b.txn.Get(hkey)
+			if err != nil {
+				return err
+			}
+			if err := item.Value(func(barr []byte) error {
+				record = append([]byte{}, barr[8:]...)
+				var storedCount uint64
+				if err := binary.Read(bytes.NewReader(barr[:8]), binary.LittleEndian, &storedCount); err != nil {
+					return err
+				}
+				refCount += storedCount
+				return nil
+			}); err != nil {
+				return err
+			}
 		}
-		return txn.Set(hkey, append(buf.Bytes(), valCopy[8:]...))
-	case badger.ErrKeyNotFound:
-		// value not found; create it with refcount=1, and add refs to its children
 		var buf bytes.Buffer
-		refCount := uint64(1)
 		if err := binary.Write(&buf, binary.LittleEndian, &refCount); err != nil {
 			return err
 		}
-		more, err := cp.writeValue(&buf, val)
-		if err != nil {
-			return err
-		}
-		if err := txn.Set(hkey, buf.Bytes()); err != nil {
+		if err := b.txn.Set(hkey, append(buf.Bytes(), record...)); err != nil {
 			return err
 		}
-		for _, v := range more {
-			if err := cp.addRefToValueInTxn(txn, v); err != nil {
-				return err
-			}
-		}
-		return nil
-	default:
-		return err
 	}
+	b.pending = make(map[[32]byte]*pendingRef)
+	b.order = nil
+	return nil
 }
 
 func (cp *Checkpointer) AddRefToValue(val value.Value) error {
@@ -143,56 +247,70 @@ func (cp *Checkpointer) RemoveRefToValue(hash [32]byte) {
 	}()
 }
 
-func (cp *Checkpointer) synchronousRemoveRefToValue(hash [32]byte) error {
-	var more [][32]byte = nil
-	err := cp.db.Update(func(txn *badger.Txn) error {
-		key := append([]byte{PrefixValue}, hash[:]...)
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
-		}
+// removeRefToValueInTxn decrements the refcount of a stored value, deleting it
+// when the count reaches zero. It returns the hashes of the children of a
+// deleted value, whose refcounts must then be decremented as well.
+func (cp *Checkpointer) removeRefToValueInTxn(txn *badger.Txn, hash [32]byte) ([][32]byte, error) {
+	key := append([]byte{PrefixValue}, hash[:]...)
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
 
-		var refCount uint64
-		var valCopy []byte
-		if err := item.Value(func(val []byte) error {
-			valCopy = append([]byte{}, val...)
-			rd := bytes.NewReader(val[:8])
-			return binary.Read(rd, binary.LittleEndian, &refCount)
-		}); err != nil {
-			return err
-		}
+	var refCount uint64
+	var valCopy []byte
+	if err := item.Value(func(val []byte) error {
+		valCopy = append([]byte{}, val...)
+		rd := bytes.NewReader(val[:8])
+		return binary.Read(rd, binary.LittleEndian, &refCount)
+	}); err != nil {
+		return nil, err
+	}
 
-		refCount--
-		if refCount == 0 {
-			if err := txn.Delete(key); err != nil {
-				return err
-			}
-			if valCopy[8] == value.TypeCodeTuple {
-				size := int(valCopy[9])
-				rd := bytes.NewReader(valCopy[10:])
-				more = make([][32]byte, size)
-				for i := 0; i < size; i++ {
-					h := [32]byte{}
-					if _, err := io.ReadFull(rd, h[:]); err != nil {
-						return err
-					}
-					more[i] = h
+	refCount--
+	if refCount == 0 {
+		if err := txn.Delete(key); err != nil {
+			return nil, err
+		}
+		var more [][32]byte = nil
+		if valCopy[8] == value.TypeCodeTuple {
+			size := int(valCopy[9])
+			rd := bytes.NewReader(valCopy[10:])
+			more = make([][32]byte, size)
+			for i := 0; i < size; i++ {
+				h := [32]byte{}
+				if _, err := io.ReadFull(rd, h[:]); err != nil {
+					return nil, err
 				}
+				more[i] = h
 			}
-			return nil
-		} else {
-			var buf bytes.Buffer
-			if err := binary.Write(&buf, binary.LittleEndian, &refCount); err != nil {
-				return err
-			}
-			return txn.Set(key, append(buf.Bytes(), valCopy[8:]...))
 		}
-	})
-	if err != nil {
-		return err
+		return more, nil
+	} else {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, &refCount); err != nil {
+			return nil, err
+		}
+		return nil, txn.Set(key, append(buf.Bytes(), valCopy[8:]...))
 	}
-	for _, h := range more {
-		cp.RemoveRefToValue(h)
+}
+
+// synchronousRemoveRefToValue removes a reference to a value and, before
+// returning, to every value that becomes unreachable as a result
+func (cp *Checkpointer) synchronousRemoveRefToValue(hash [32]byte) error {
+	pending := [][32]byte{hash}
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		var more [][32]byte
+		if err := cp.db.Update(func(txn *badger.Txn) error {
+			var err error
+			more, err = cp.removeRefToValueInTxn(txn, h)
+			return err
+		}); err != nil {
+			return err
+		}
+		pending = append(pending, more...)
 	}
 	return nil
 }
@@ -223,6 +341,21 @@ func (cp *Checkpointer) restoreValueFromHashInTxn(txn *badger.Txn, hash [32]byte
 	if err := binary.Read(rd, binary.LittleEndian, &unusedRefCount); err != nil {
 		return nil, err
 	}
+	return readValue(rd, cp.txnLookup(txn))
+}
+
+// valueLookup resolves the hash of a value referenced by a stored value
+type valueLookup func([32]byte) (value.Value, error)
+
+func (cp *Checkpointer) txnLookup(txn *badger.Txn) valueLookup {
+	return func(h [32]byte) (value.Value, error) {
+		return cp.restoreValueFromHashInTxn(txn, h)
+	}
+}
+
+// readValue decodes a value written by writeValue, using lookup to resolve
+// the values it refers to by hash
+func readValue(rd io.Reader, lookup valueLookup) (value.Value, error) {
 	var typeCode byte
 	if err := binary.Read(rd, binary.LittleEndian, &typeCode); err != nil {
 		return nil, err
@@ -232,31 +365,32 @@ func (cp *Checkpointer) restoreValueFromHashInTxn(txn *badger.Txn, hash [32]byte
 		return value.NewIntValueFromReader(rd)
 	case value.TypeCodeCodePoint:
 		var insnNum int64
-		if err2 := binary.Read(rd, binary.LittleEndian, &insnNum); err2 != nil {
-			return nil, err2
+		if err := binary.Read(rd, binary.LittleEndian, &insnNum); err != nil {
+			return nil, err
 		}
-		op, err2 := cp.restoreOp(txn, rd)
-		if err2 != nil {
-			return nil, err2
+		op, err := readOp(rd, lookup)
+		if err != nil {
+			return nil, err
 		}
 		var nextHash [32]byte
-		if _, err2 := io.ReadFull(rd, nextHash[:]); err2 != nil {
-			return nil, err2
+		if _, err := io.ReadFull(rd, nextHash[:]); err != nil {
+			return nil, err
 		}
 		return value.CodePointValue{InsnNum: insnNum, Op: op, NextHash: nextHash}, nil
 	case value.TypeCodeTuple:
 		var sizeAsByte byte
-		if err2 := binary.Read(rd, binary.LittleEndian, &sizeAsByte); err2 != nil {
-			return nil, err2
+		if err := binary.Read(rd, binary.LittleEndian, &sizeAsByte); err != nil {
+			return nil, err
 		}
 		size := int(sizeAsByte)
 		contents := make([]value.Value, size)
 		for i := 0; i < size; i++ {
 			var subHash [32]byte
-			if _, err2 := io.ReadFull(rd, subHash[:]); err2 != nil {
+			if _, err := io.ReadFull(rd, subHash[:]); err != nil {
 				return nil, err
 			}
-			contents[i], err = cp.restoreValueFromHashInTxn(txn, subHash)
+			var err error
+			contents[i], err = lookup(subHash)
 			if err != nil {
 				return nil, err
 			}
@@ -16,302 +16,760 @@
 
 package checkpoint
 
-//
-// func TestOpen(t *testing.T) {
-//	cp, err := NewCheckpointer(nil, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	err = cp.Close()
-//	if err != nil {
-//		t.Error(err)
-//	}
-//}
-//
-// func TestValues(t *testing.T) {
-//	cp, err := NewCheckpointer(nil, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	val38 := value.NewInt64Value(38)
-//	err = cp.AddRefToValue(val38)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	hash38 := val38.Hash()
-//	res38, err2 := cp.RestoreValueFromHash(hash38)
-//
-//	if err2 != nil {
-//		t.Error(err2)
-//	}
-//	if !value.Eq(val38, res38) {
-//		t.Errorf("Save/restore int(38) failed")
-//	}
-//
-//	tup1, err := value.NewTupleFromSlice([]value.Value{val38, val38, value.NewEmptyTuple()})
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	tup2, err := value.NewTupleFromSlice([]value.Value{tup1, val38, val38, tup1, val38, tup1})
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	hash2 := tup2.Hash()
-//	err = cp.AddRefToValue(tup2)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	res2, err2 := cp.RestoreValueFromHash(hash2)
-//	if err2 != nil {
-//		t.Error(err2)
-//	}
-//	if !value.Eq(tup2, res2) {
-//		t.Errorf("Save/restore of tuple failed")
-//	}
-//
-//	if err := cp.Close(); err != nil {
-//		t.Error(err)
-//	}
-//}
-//
-// const dotAOfile = "fibonacci.ao"
-//
-// func TestMachines(t *testing.T) {
-//	machine, err := loader.LoadMachineFromFile(dotAOfile, false)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	_, _ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
-//
-//	cp, err := NewCheckpointer(machine, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
-//		t.Error(err)
-//	}
-//
-//	restMach, err := cp.RestoreMachine([]byte("test"))
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	if restMach.Hash() != machine.Hash() {
-//		t.Errorf("restored machine hash doesn't match original")
-//	}
-//
-//	_, _ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
-//	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
-//		t.Error(err)
-//	}
-//
-//	restMach, err = cp.RestoreMachine([]byte("test"))
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	if restMach.Hash() != machine.Hash() {
-//		t.Errorf("restored machine hash doesn't match original")
-//	}
-//
-//	if err := cp.Close(); err != nil {
-//		t.Error(err)
-//	}
-//}
-//
-// func TestMachinesAcrossRestart(t *testing.T) {
-//	machine, err := loader.LoadMachineFromFile(dotAOfile, false)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	cp, err := NewCheckpointer(machine, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
-//		t.Error(err)
-//	}
-//	if err := cp.Close(); err != nil {
-//		t.Error(err)
-//	}
-//
-//	cp, err = NewCheckpointer(nil, false) // restart, keeping old checkpoint file
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	restMach, err := cp.RestoreMachine([]byte("test"))
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	if restMach.Hash() != machine.Hash() {
-//		t.Errorf("restored machine hash doesn't match original")
-//	}
-//
-//	if err := cp.Close(); err != nil {
-//		t.Error(err)
-//	}
-//}
-//
-// func TestVersionedCp(t *testing.T) {
-//	machine, err := loader.LoadMachineFromFile(dotAOfile, false)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	cp, err := NewCheckpointer(machine, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	vcp, err := NewVersionedCheckpointer(cp)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	minV, maxV := vcp.KnownVersions()
-//	if minV != 0 {
-//		t.Errorf("unexpected minVersionNum")
-//	}
-//	if maxV != -1 {
-//		t.Errorf("unexpected maxVersionNum")
-//	}
-//
-//	_, _ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
-//	vnum, err := vcp.SaveVersion(machine, nil)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	if vnum != 0 {
-//		t.Errorf("unexpected version number return")
-//	}
-//	_, _ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
-//	vnum, err = vcp.SaveVersion(machine, []byte("some state"))
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	if vnum != 1 {
-//		t.Errorf("unexpected version number return")
-//	}
-//	minV, maxV = vcp.KnownVersions()
-//	if minV != 0 {
-//		t.Errorf("unexpected minVersionNum")
-//	}
-//	if maxV != 1 {
-//		t.Errorf("unexpected maxVersionNum")
-//	}
-//}
-//
-// func TestEventChainCp(t *testing.T) {
-//	machine, err := loader.LoadMachineFromFile(dotAOfile, false)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	inbox := value.NewEmptyTuple()
-//	cp, err := NewCheckpointer(machine, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	key := []byte("This is a string name key")
-//	timeBounds := [2]uint64{0, 17}
-//	balanceTracker := protocol.NewBalanceTracker()
-//	ecc, err := NewEventChainCheckpointer(cp, key, machine, timeBounds, balanceTracker)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	sigs := []byte{3, 1, 4, 1, 5, 9, 2, 6}
-//	for i := uint64(0); i < 6; i++ {
-//		_, _ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
-//		err = ecc.RecordIntentToSign(i, machine, inbox)
-//		if err != nil {
-//			t.Error(err)
-//		}
-//		err = ecc.RecordSignatures(i, sigs)
-//		if err != nil {
-//			t.Error(err)
-//		}
-//	}
-//
-//	err = ecc.Discard()
-//	if err != nil {
-//		t.Error(err)
-//	}
-//}
-//
-// func TestEventChainRestore(t *testing.T) {
-//	machine, err := loader.LoadMachineFromFile(dotAOfile, false)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	inbox := value.NewEmptyTuple()
-//	cp, err := NewCheckpointer(machine, true)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	keySuffix := []byte("This is a string name key")
-//	timeBounds := [2]uint64{0, 17}
-//	balanceTracker := protocol.NewBalanceTracker()
-//	ecc, err := NewEventChainCheckpointer(cp, keySuffix, machine, timeBounds, balanceTracker)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	sigs := []byte{3, 1, 4, 1, 5, 9, 2, 6}
-//	maxSeqNum := uint64(6)
-//	machineHashes := make([][32]byte, 0)
-//	inboxHashes := make([][32]byte, 0)
-//	for i := uint64(0); i < maxSeqNum; i++ {
-//		_, _ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
-//		machineHashes = append(machineHashes, machine.Hash())
-//		inboxHashes = append(inboxHashes, inbox.Hash())
-//		err = ecc.RecordIntentToSign(i, machine, inbox)
-//		if err != nil {
-//			t.Error(err)
-//		}
-//		err = ecc.RecordSignatures(i, sigs)
-//		if err != nil {
-//			t.Error(err)
-//		}
-//	}
-//
-//	if err := cp.Close(); err != nil {
-//		t.Error(err)
-//	}
-//
-//	cp, err = NewCheckpointer(nil, false) // restart, keeping old checkpoint file
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	ecc, err = RestoreEventChainCheckpointer(cp, keySuffix)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//
-//	seqNumToRestore := uint64(4)
-//	restoredMachine, restoredInbox, restoredSigs, err := ecc.RestoreFromSeqNum(seqNumToRestore)
-//	if err != nil {
-//		t.Error(err)
-//	}
-//	restMachHash := restoredMachine.Hash()
-//	if !bytes.Equal(restMachHash[:], machineHashes[seqNumToRestore][:]) {
-//		t.Errorf("EvChain restored machine hash mismatch")
-//	}
-//	restInboxHash := restoredInbox.Hash()
-//	if !bytes.Equal(restInboxHash[:], inboxHashes[seqNumToRestore][:]) {
-//		t.Errorf("EvChain restored inbox mismatch")
-//	}
-//	if !bytes.Equal(restoredSigs, sigs) {
-//		t.Errorf("EvChain restored signatures mismatch")
-//	}
-//
-//	err = ecc.Discard()
-//	if err != nil {
-//		t.Error(err)
-//	}
-//}
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// newCounterMachine returns a machine that loops forever, incrementing the
+// integer on top of its stack
+func newCounterMachine() *vm.Machine {
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: code.NOP, Val: value.NewInt64Value(0)},
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.AUXPUSH},
+		value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(1)},
+		value.BasicOperation{Op: code.AUXPOP},
+		value.BasicOperation{Op: code.JUMP},
+	}
+	return vm.NewMachine(insns, value.NewInt64Value(1), false, 1<<30)
+}
+
+func TestVersionedCp(t *testing.T) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcp, err := NewVersionedCheckpointer(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minV, maxV := vcp.KnownVersions()
+	if minV != 0 {
+		t.Errorf("unexpected minVersionNum")
+	}
+	if maxV != -1 {
+		t.Errorf("unexpected maxVersionNum")
+	}
+
+	_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	vnum, err := vcp.SaveVersion(machine, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if vnum != 0 {
+		t.Errorf("unexpected version number return")
+	}
+	_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	vnum, err = vcp.SaveVersion(machine, []byte("some state"))
+	if err != nil {
+		t.Error(err)
+	}
+	if vnum != 1 {
+		t.Errorf("unexpected version number return")
+	}
+	minV, maxV = vcp.KnownVersions()
+	if minV != 0 {
+		t.Errorf("unexpected minVersionNum")
+	}
+	if maxV != 1 {
+		t.Errorf("unexpected maxVersionNum")
+	}
+
+	if err := vcp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func saveVersions(t *testing.T, vcp *VersionedCheckpointer, machine *vm.Machine, count int) [][32]byte {
+	stackHashes := make([][32]byte, 0, count)
+	for i := 0; i < count; i++ {
+		_ = machine.ExecuteAssertion(7, protocol.NewTimeBounds(0, 100000))
+		stackHashes = append(stackHashes, machine.Stack().FullyExpandedValue().Hash())
+		if _, err := vcp.SaveVersion(machine, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stackHashes
+}
+
+func TestVersionedCpDiscard(t *testing.T) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcp, err := NewVersionedCheckpointer(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stackHashes := saveVersions(t, vcp, machine, 5)
+
+	if err := vcp.DiscardVersions(7); err == nil {
+		t.Errorf("discarding versions that don't exist should fail")
+	}
+	if err := vcp.DiscardVersions(3); err != nil {
+		t.Fatal(err)
+	}
+	minV, maxV := vcp.KnownVersions()
+	if minV != 3 || maxV != 4 {
+		t.Errorf("unexpected known versions %v-%v after discard", minV, maxV)
+	}
+	if vcp.IsKnownVersion(2) {
+		t.Errorf("discarded version still known")
+	}
+	if _, _, err := vcp.RestoreVersion(1); err == nil {
+		t.Errorf("restoring discarded version should fail")
+	}
+
+	if err := vcp.WaitForDiscards(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cp.RestoreValueFromHash(stackHashes[i]); err == nil {
+			t.Errorf("stack of discarded version %v still stored", i)
+		}
+	}
+	for i := 3; i < 5; i++ {
+		if _, err := cp.RestoreValueFromHash(stackHashes[i]); err != nil {
+			t.Errorf("stack of kept version %v missing: %v", i, err)
+		}
+	}
+
+	if err := vcp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVersionedCpDiscardAcrossRestart(t *testing.T) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcp, err := NewVersionedCheckpointer(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stackHashes := saveVersions(t, vcp, machine, 20)
+
+	// close immediately, most likely interrupting the discard
+	if err := vcp.DiscardVersions(15); err != nil {
+		t.Fatal(err)
+	}
+	if err := vcp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err = NewCheckpointer(nil, false) // restart, keeping old checkpoint file
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcp, err = NewVersionedCheckpointer(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minV, maxV := vcp.KnownVersions()
+	if minV != 15 || maxV != 19 {
+		t.Errorf("unexpected known versions %v-%v after restart", minV, maxV)
+	}
+	if err := vcp.WaitForDiscards(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 15; i++ {
+		if _, err := cp.RestoreValueFromHash(stackHashes[i]); err == nil {
+			t.Errorf("stack of discarded version %v still stored", i)
+		}
+	}
+
+	if err := vcp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestVersionedCpSaveDuringDiscard checks that versions saved while a discard
+// runs are still known after a restart
+func TestVersionedCpSaveDuringDiscard(t *testing.T) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcp, err := NewVersionedCheckpointer(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveVersions(t, vcp, machine, 20)
+	if err := vcp.DiscardVersions(15); err != nil {
+		t.Fatal(err)
+	}
+	saveVersions(t, vcp, machine, 10)
+	if err := vcp.WaitForDiscards(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vcp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err = NewCheckpointer(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcp, err = NewVersionedCheckpointer(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minV, maxV := vcp.KnownVersions(); minV != 15 || maxV != 29 {
+		t.Errorf("unexpected known versions %v-%v after restart", minV, maxV)
+	}
+	if err := vcp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func valueRefCount(t testing.TB, cp *Checkpointer, hash [32]byte) uint64 {
+	var count uint64
+	err := cp.db.View(func(txn *badger.Txn) error {
+		rec, err := getInTxn(txn, append([]byte{PrefixValue}, hash[:]...))
+		if err != nil {
+			return err
+		}
+		count = binary.LittleEndian.Uint64(rec[:8])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestIncrementalSave(t *testing.T) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		machine.Stack().Push(value.NewInt64Value(i))
+	}
+	if err := cp.SaveMachine([]byte("a"), machine); err != nil {
+		t.Fatal(err)
+	}
+	oldStack := machine.Stack().FullyExpandedValue()
+	if valueRefCount(t, cp, oldStack.Hash()) != 1 {
+		t.Errorf("unexpected refcount for saved stack")
+	}
+
+	machine.Stack().Push(value.NewInt64Value(1000))
+	if err := cp.SaveMachine([]byte("b"), machine); err != nil {
+		t.Fatal(err)
+	}
+	newStack := machine.Stack().FullyExpandedValue()
+	if valueRefCount(t, cp, oldStack.Hash()) != 2 {
+		t.Errorf("old stack should be shared by both saves")
+	}
+	if valueRefCount(t, cp, newStack.Hash()) != 1 {
+		t.Errorf("unexpected refcount for new stack")
+	}
+	for _, val := range []value.Value{oldStack, newStack} {
+		restored, err := cp.RestoreValueFromHash(val.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Hash() != val.Hash() {
+			t.Errorf("restored stack has wrong hash")
+		}
+	}
+
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkSaveMachine(b *testing.B) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := int64(0); i < 10000; i++ {
+		machine.Stack().Push(value.NewInt64Value(i))
+	}
+	if err := cp.SaveMachine([]byte("base"), machine); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = machine.ExecuteAssertion(7, protocol.NewTimeBounds(0, 100000))
+		if err := cp.SaveMachine([]byte("bench"), machine); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if err := cp.Close(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cp, err := NewCheckpointer(nil, true)
+	if err != nil {
+		t.Error(err)
+	}
+	err = cp.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	cp, err := NewCheckpointer(nil, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	val38 := value.NewInt64Value(38)
+	err = cp.AddRefToValue(val38)
+	if err != nil {
+		t.Error(err)
+	}
+	hash38 := val38.Hash()
+	res38, err2 := cp.RestoreValueFromHash(hash38)
+
+	if err2 != nil {
+		t.Error(err2)
+	}
+	if !value.Eq(val38, res38) {
+		t.Errorf("Save/restore int(38) failed")
+	}
+
+	tup1, err := value.NewTupleFromSlice([]value.Value{val38, val38, value.NewEmptyTuple()})
+	if err != nil {
+		t.Error(err)
+	}
+	tup2, err := value.NewTupleFromSlice([]value.Value{tup1, val38, val38, tup1, val38, tup1})
+	if err != nil {
+		t.Error(err)
+	}
+
+	hash2 := tup2.Hash()
+	err = cp.AddRefToValue(tup2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res2, err2 := cp.RestoreValueFromHash(hash2)
+	if err2 != nil {
+		t.Error(err2)
+	}
+	if !value.Eq(tup2, res2) {
+		t.Errorf("Save/restore of tuple failed")
+	}
+
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMachines(t *testing.T) {
+	machine := newCounterMachine()
+	_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
+		t.Error(err)
+	}
+
+	restMach, err := cp.RestoreMachine([]byte("test"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if restMach.Hash() != machine.Hash() {
+		t.Errorf("restored machine hash doesn't match original")
+	}
+
+	_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
+		t.Error(err)
+	}
+
+	restMach, err = cp.RestoreMachine([]byte("test"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if restMach.Hash() != machine.Hash() {
+		t.Errorf("restored machine hash doesn't match original")
+	}
+
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMachinesAcrossRestart(t *testing.T) {
+	machine := newCounterMachine()
+
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
+		t.Error(err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+
+	cp, err = NewCheckpointer(nil, false) // restart, keeping old checkpoint file
+	if err != nil {
+		t.Error(err)
+	}
+
+	restMach, err := cp.RestoreMachine([]byte("test"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if restMach.Hash() != machine.Hash() {
+		t.Errorf("restored machine hash doesn't match original")
+	}
+
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMachineStackKinds(t *testing.T) {
+	insns := newCounterMachine().GetAllOperations()
+	for _, kind := range []stack.Kind{stack.KindFlat, stack.KindTuple, stack.KindPersistent, stack.KindLazyFlat} {
+		machine := vm.NewMachineWithStackKind(insns, value.NewInt64Value(1), false, 1<<30, kind)
+		_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+		cp, err := NewCheckpointer(machine, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cp.SaveMachine([]byte("test"), machine); err != nil {
+			t.Fatal(err)
+		}
+		restMach, err := cp.RestoreMachine([]byte("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restMach.StackKind() != kind || restMach.Hash() != machine.Hash() {
+			t.Errorf("machine with stack kind %v restored with kind %v", kind, restMach.StackKind())
+		}
+		if _, ok := restMach.Stack().(*stack.Persistent); ok != (kind == stack.KindPersistent) {
+			t.Errorf("machine with stack kind %v restored with a %T stack", kind, restMach.Stack())
+		}
+
+		// a record saved before the stack kind was added restores as flat
+		key := []byte("machine:test")
+		if err := cp.db.Update(func(txn *badger.Txn) error {
+			rec, err := getInTxn(txn, key)
+			if err != nil {
+				return err
+			}
+			return txn.Set(key, rec[:legacyMachineRecordSize])
+		}); err != nil {
+			t.Fatal(err)
+		}
+		restMach, err = cp.RestoreMachine([]byte("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restMach.StackKind() != stack.KindFlat || restMach.Hash() != machine.Hash() {
+			t.Errorf("old record restored with stack kind %v", restMach.StackKind())
+		}
+		if err := cp.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRestoreMachineCodeMismatch(t *testing.T) {
+	machine := newCounterMachine()
+	_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
+		t.Fatal(err)
+	}
+
+	otherCode := append(machine.GetAllOperations(), value.BasicOperation{Op: code.HALT})
+	if _, err := cp.RestoreMachineWithCode([]byte("test"), otherCode); err == nil {
+		t.Errorf("restoring with different code should fail")
+	}
+	restMach, err := cp.RestoreMachineWithCode([]byte("test"), machine.GetAllOperations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restMach.Hash() != machine.Hash() {
+		t.Errorf("restored machine hash doesn't match original")
+	}
+
+	otherMachine := vm.NewMachine(otherCode, value.NewInt64Value(1), false, 1<<30)
+	if err := cp.SaveMachineWithCode([]byte("other"), otherMachine); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.RestoreMachine([]byte("test")); err == nil {
+		t.Errorf("restoring after the saved code changed should fail")
+	}
+	if _, err := cp.RestoreMachine([]byte("other")); err != nil {
+		t.Error(err)
+	}
+
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventChainCp(t *testing.T) {
+	machine := newCounterMachine()
+	inbox := value.NewEmptyTuple()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Error(err)
+	}
+	key := []byte("This is a string name key")
+	timeBounds := [2]uint64{0, 17}
+	balanceTracker := protocol.NewBalanceTracker()
+	ecc, err := NewEventChainCheckpointer(cp, key, machine, timeBounds, balanceTracker)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sigs := []byte{3, 1, 4, 1, 5, 9, 2, 6}
+	for i := uint64(0); i < 6; i++ {
+		_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+		err = ecc.RecordIntentToSign(i, machine, inbox)
+		if err != nil {
+			t.Error(err)
+		}
+		err = ecc.RecordSignatures(i, sigs)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = ecc.Discard()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventChainRestore(t *testing.T) {
+	machine := newCounterMachine()
+	inbox := value.NewEmptyTuple()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Error(err)
+	}
+	keySuffix := []byte("This is a string name key")
+	timeBounds := [2]uint64{0, 17}
+	balanceTracker := protocol.NewBalanceTracker()
+	ecc, err := NewEventChainCheckpointer(cp, keySuffix, machine, timeBounds, balanceTracker)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sigs := []byte{3, 1, 4, 1, 5, 9, 2, 6}
+	maxSeqNum := uint64(6)
+	machineHashes := make([][32]byte, 0)
+	inboxHashes := make([][32]byte, 0)
+	for i := uint64(0); i < maxSeqNum; i++ {
+		_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+		machineHashes = append(machineHashes, machine.Hash())
+		inboxHashes = append(inboxHashes, inbox.Hash())
+		err = ecc.RecordIntentToSign(i, machine, inbox)
+		if err != nil {
+			t.Error(err)
+		}
+		err = ecc.RecordSignatures(i, sigs)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+
+	cp, err = NewCheckpointer(nil, false) // restart, keeping old checkpoint file
+	if err != nil {
+		t.Error(err)
+	}
+	ecc, err = RestoreEventChainCheckpointer(cp, keySuffix)
+	if err != nil {
+		t.Error(err)
+	}
+
+	seqNumToRestore := uint64(4)
+	restoredMachine, restoredInbox, restoredSigs, err := ecc.RestoreFromSeqNum(seqNumToRestore)
+	if err != nil {
+		t.Error(err)
+	}
+	restMachHash := restoredMachine.Hash()
+	if !bytes.Equal(restMachHash[:], machineHashes[seqNumToRestore][:]) {
+		t.Errorf("EvChain restored machine hash mismatch")
+	}
+	restInboxHash := restoredInbox.Hash()
+	if !bytes.Equal(restInboxHash[:], inboxHashes[seqNumToRestore][:]) {
+		t.Errorf("EvChain restored inbox mismatch")
+	}
+	if !bytes.Equal(restoredSigs, sigs) {
+		t.Errorf("EvChain restored signatures mismatch")
+	}
+
+	err = ecc.Discard()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func newTestEventChain(t *testing.T, count uint64, signed uint64) (*Checkpointer, *EventChainCheckpointer, [][32]byte) {
+	machine := newCounterMachine()
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecc, err := NewEventChainCheckpointer(cp, []byte("chain"), machine, [2]uint64{0, 17}, protocol.NewBalanceTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	machineHashes := make([][32]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		_ = machine.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+		machineHashes = append(machineHashes, machine.Hash())
+		if err := ecc.RecordIntentToSign(i, machine, value.NewInt64Value(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		if i < signed {
+			if err := ecc.RecordSignatures(i, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return cp, ecc, machineHashes
+}
+
+func TestEventChainSeqNums(t *testing.T) {
+	cp, ecc, _ := newTestEventChain(t, 12, 10)
+
+	var seqNums []uint64
+	if err := ecc.ForEachSeqNum(func(seqNum uint64, signed bool) bool {
+		if signed != (seqNum < 10) {
+			t.Errorf("wrong signed status for sequence number %v", seqNum)
+		}
+		seqNums = append(seqNums, seqNum)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqNums) != 12 {
+		t.Fatalf("iterated over %v sequence numbers, expected 12", len(seqNums))
+	}
+	for i, seqNum := range seqNums {
+		if seqNum != uint64(i) {
+			t.Errorf("sequence numbers out of order")
+		}
+	}
+
+	if err := ecc.RecordSignatures(20, nil); err == nil {
+		t.Errorf("signing an unrecorded sequence number should fail")
+	}
+
+	inbox3 := value.NewInt64Value(3).Hash()
+	if err := ecc.PruneBelow(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ecc.RestoreFromSeqNum(3); err == nil {
+		t.Errorf("restoring pruned sequence number should fail")
+	}
+	if _, err := cp.RestoreValueFromHash(inbox3); err == nil {
+		t.Errorf("inbox of pruned sequence number still stored")
+	}
+	if _, _, _, err := ecc.RestoreFromSeqNum(5); err != nil {
+		t.Error(err)
+	}
+	seqNums = nil
+	if err := ecc.ForEachSeqNum(func(seqNum uint64, signed bool) bool {
+		seqNums = append(seqNums, seqNum)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqNums) != 7 || seqNums[0] != 5 {
+		t.Errorf("unexpected sequence numbers %v after pruning", seqNums)
+	}
+
+	if err := ecc.Discard(); err != nil {
+		t.Error(err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventChainRecovery(t *testing.T) {
+	cp, ecc, machineHashes := newTestEventChain(t, 8, 6)
+	if _, _, err := ecc.LatestSignedSeqNum(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := NewCheckpointer(nil, false) // restart, keeping old checkpoint file
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecc, err = RestoreEventChainCheckpointer(cp, []byte("chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ecc.RecordIntentToSign(7, newCounterMachine(), value.NewEmptyTuple()); err == nil {
+		t.Errorf("sequence number reused after restart")
+	}
+	seqNum, machine, inbox, sigs, err := ecc.RestoreLatestSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqNum != 5 {
+		t.Errorf("latest signed sequence number is %v, expected 5", seqNum)
+	}
+	if machine.Hash() != machineHashes[5] {
+		t.Errorf("restored machine hash mismatch")
+	}
+	if inbox.Hash() != value.NewInt64Value(5).Hash() {
+		t.Errorf("restored inbox mismatch")
+	}
+	if !bytes.Equal(sigs, []byte{5}) {
+		t.Errorf("restored signatures mismatch")
+	}
+
+	if err := ecc.Discard(); err != nil {
+		t.Error(err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package checkpoint
+
+// A snapshot is a self-contained copy of one checkpointed machine, which can
+// be imported into a different checkpoint database. It is laid out as
+//   snapshotMagic, snapshotVersion (uint32)
+//   number of values (uint64), then each value record, children first
+//   the code record
+//   the machine record
+// Every record is prefixed by its length (uint32). Value records use the same
+// encoding as the database, without the refcount, so each value appears once
+// no matter how many times it is referenced.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+const (
+	snapshotMagic   = "arb-avm-snapshot"
+	snapshotVersion = uint32(2)
+)
+
+// ExportMachine writes the machine checkpointed under keySuffix, together with
+// every value it references and the checkpointed code, to wr
+func (cp *Checkpointer) ExportMachine(keySuffix []byte, wr io.Writer) error {
+	txn := cp.db.NewTransaction(false)
+	defer txn.Discard()
+
+	machineRec, err := getInTxn(txn, append([]byte("machine:"), keySuffix...))
+	if err != nil {
+		return err
+	}
+	codeRec, err := getInTxn(txn, []byte("code"))
+	if err == badger.ErrKeyNotFound {
+		codeRec = nil
+	} else if err != nil {
+		return err
+	}
+
+	roots, err := readMachineRefs(bytes.NewReader(machineRec))
+	if err != nil {
+		return err
+	}
+	codeRefs, err := codeRecordRefs(codeRec)
+	if err != nil {
+		return err
+	}
+	roots = append(roots, codeRefs...)
+
+	var records [][]byte
+	visited := make(map[[32]byte]bool)
+	var visit func(h [32]byte) error
+	visit = func(h [32]byte) error {
+		if visited[h] {
+			return nil
+		}
+		visited[h] = true
+		rec, err := getValueRecordInTxn(txn, h)
+		if err != nil {
+			return err
+		}
+		_, children, err := decodeValueRecord(rec)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		records = append(records, rec)
+		return nil
+	}
+	for _, h := range roots {
+		if err := visit(h); err != nil {
+			return err
+		}
+	}
+
+	if _, err := wr.Write([]byte(snapshotMagic)); err != nil {
+		return err
+	}
+	version := snapshotVersion
+	if err := binary.Write(wr, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	numRecords := uint64(len(records))
+	if err := binary.Write(wr, binary.LittleEndian, &numRecords); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := writeSnapshotRecord(wr, rec); err != nil {
+			return err
+		}
+	}
+	if err := writeSnapshotRecord(wr, codeRec); err != nil {
+		return err
+	}
+	return writeSnapshotRecord(wr, machineRec)
+}
+
+// ImportMachine reads a snapshot written by ExportMachine and checkpoints the
+// machine in it under keySuffix. The snapshot's code is saved if the database
+// doesn't have any yet; otherwise it must match the code already saved.
+func (cp *Checkpointer) ImportMachine(keySuffix []byte, rd io.Reader) error {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(rd, magic); err != nil {
+		return err
+	}
+	if string(magic) != snapshotMagic {
+		return Error{"ImportMachine: not a machine snapshot"}
+	}
+	var version uint32
+	if err := binary.Read(rd, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return Error{fmt.Sprintf("ImportMachine: unsupported snapshot version %v", version)}
+	}
+
+	vals := make(map[[32]byte]value.Value)
+	lookup := func(h [32]byte) (value.Value, error) {
+		val, ok := vals[h]
+		if !ok {
+			return nil, Error{fmt.Sprintf("ImportMachine: snapshot refers to missing value %x", h)}
+		}
+		return val, nil
+	}
+
+	var numRecords uint64
+	if err := binary.Read(rd, binary.LittleEndian, &numRecords); err != nil {
+		return err
+	}
+	for i := uint64(0); i < numRecords; i++ {
+		rec, err := readSnapshotRecord(rd)
+		if err != nil {
+			return err
+		}
+		val, err := readValue(bytes.NewReader(rec), lookup)
+		if err != nil {
+			return err
+		}
+		vals[val.Hash()] = val
+	}
+
+	codeRec, err := readSnapshotRecord(rd)
+	if err != nil {
+		return err
+	}
+	codeVals, err := readCodeRecordValues(codeRec, lookup)
+	if err != nil {
+		return err
+	}
+	machineRec, err := readSnapshotRecord(rd)
+	if err != nil {
+		return err
+	}
+	if !validMachineRecordSize(len(machineRec)) {
+		return Error{"ImportMachine: malformed machine record"}
+	}
+	roots, err := readMachineRefs(bytes.NewReader(machineRec))
+	if err != nil {
+		return err
+	}
+	rootVals := make([]value.Value, len(roots))
+	for i, h := range roots {
+		rootVals[i], err = lookup(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cp.db.Update(func(txn *badger.Txn) error {
+		if len(codeRec) > 0 {
+			existingCode, err := getInTxn(txn, []byte("code"))
+			switch err {
+			case nil:
+				if !bytes.Equal(existingCode, codeRec) {
+					return Error{"ImportMachine: snapshot code doesn't match checkpointed code"}
+				}
+			case badger.ErrKeyNotFound:
+				for _, val := range codeVals {
+					if err := cp.addRefToValueInTxn(txn, val); err != nil {
+						return err
+					}
+				}
+				if err := txn.Set([]byte("code"), codeRec); err != nil {
+					return err
+				}
+			default:
+				return err
+			}
+		}
+		for _, val := range rootVals {
+			if err := cp.addRefToValueInTxn(txn, val); err != nil {
+				return err
+			}
+		}
+		return txn.Set(append([]byte("machine:"), keySuffix...), machineRec)
+	})
+}
+
+func getInTxn(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var ret []byte
+	if err := item.Value(func(val []byte) error {
+		ret = append([]byte{}, val...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// getValueRecordInTxn returns the stored encoding of a value, without its refcount
+func getValueRecordInTxn(txn *badger.Txn, hash [32]byte) ([]byte, error) {
+	rec, err := getInTxn(txn, append([]byte{PrefixValue}, hash[:]...))
+	if err != nil {
+		return nil, err
+	}
+	if len(rec) < 9 {
+		return nil, Error{"checkpointed value record is too small"}
+	}
+	return rec[8:], nil
+}
+
+// decodeValueRecord decodes a value record with its children replaced by
+// hash-only values, and returns the hashes of those children
+func decodeValueRecord(rec []byte) (value.Value, [][32]byte, error) {
+	var children [][32]byte
+	val, err := readValue(bytes.NewReader(rec), func(h [32]byte) (value.Value, error) {
+		children = append(children, h)
+		return value.NewHashOnlyValue(h, 1), nil
+	})
+	return val, children, err
+}
+
+// codeRecordRefs returns the hashes of the immediate values in a code record
+func codeRecordRefs(codeRec []byte) ([][32]byte, error) {
+	var refs [][32]byte
+	_, err := readCodeRecordValues(codeRec, func(h [32]byte) (value.Value, error) {
+		refs = append(refs, h)
+		return value.NewHashOnlyValue(h, 1), nil
+	})
+	return refs, err
+}
+
+// readCodeRecordValues decodes a code record written by SaveCode, and returns
+// its immediate values
+func readCodeRecordValues(codeRec []byte, lookup valueLookup) ([]value.Value, error) {
+	if len(codeRec) == 0 {
+		return nil, nil
+	}
+	rd := bytes.NewReader(codeRec)
+	var numOps uint64
+	if err := binary.Read(rd, binary.LittleEndian, &numOps); err != nil {
+		return nil, err
+	}
+	var vals []value.Value
+	for i := uint64(0); i < numOps; i++ {
+		op, err := readOp(rd, lookup)
+		if err != nil {
+			return nil, err
+		}
+		if iop, ok := op.(value.ImmediateOperation); ok {
+			vals = append(vals, iop.Val)
+		}
+	}
+	return vals, nil
+}
+
+func writeSnapshotRecord(wr io.Writer, rec []byte) error {
+	length := uint32(len(rec))
+	if err := binary.Write(wr, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	_, err := wr.Write(rec)
+	return err
+}
+
+// readSnapshotRecord reads a record written by writeSnapshotRecord. The
+// length comes from the snapshot, so the record is read through a limited
+// reader rather than allocated up front, and memory is only used for bytes
+// the snapshot actually has.
+func readSnapshotRecord(rd io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(rd, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	var rec bytes.Buffer
+	n, err := rec.ReadFrom(io.LimitReader(rd, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if n != int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return rec.Bytes(), nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package checkpoint
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestExportImportMachine(t *testing.T) {
+	machine := newCounterMachine()
+	_ = machine.ExecuteAssertion(23, protocol.NewTimeBounds(0, 100000))
+	stackHash := machine.Stack().FullyExpandedValue().Hash()
+
+	cp, err := NewCheckpointer(machine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.SaveMachine([]byte("test"), machine); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := cp.ExportMachine([]byte("test"), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err = NewCheckpointer(nil, true) // start from an empty database
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.ImportMachine([]byte("imported"), bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.RestoreValueFromHash(stackHash); err != nil {
+		t.Errorf("imported stack not stored: %v", err)
+	}
+	var reexported bytes.Buffer
+	if err := cp.ExportMachine([]byte("imported"), &reexported); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(snapshot.Bytes(), reexported.Bytes()) {
+		t.Errorf("re-exported snapshot differs from original")
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := vm.NewMachine(
+		[]value.Operation{value.BasicOperation{Op: code.HALT}},
+		value.NewInt64Value(1),
+		false,
+		1<<30,
+	)
+	cp, err = NewCheckpointer(other, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.ImportMachine([]byte("imported"), bytes.NewReader(snapshot.Bytes())); err == nil {
+		t.Errorf("importing a snapshot with different code should fail")
+	}
+	if err := cp.ImportMachine([]byte("truncated"), bytes.NewReader(snapshot.Bytes()[:snapshot.Len()/2])); err == nil {
+		t.Errorf("importing a truncated snapshot should fail")
+	}
+	if err := cp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadSnapshotRecordLength(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSnapshotRecord(&buf, []byte("record")); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := readSnapshotRecord(bytes.NewReader(buf.Bytes()))
+	if err != nil || string(rec) != "record" {
+		t.Errorf("read back %q, %v", rec, err)
+	}
+
+	// a huge length with nothing after it fails without allocating it
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}
+	if _, err := readSnapshotRecord(bytes.NewReader(huge)); err != io.ErrUnexpectedEOF {
+		t.Errorf("record with a huge length gave %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// diff-machines compares two checkpointed machines and reports where their
+// states differ. It exits with status 1 if they differ.
+//
+//	diff-machines [-db path] [-db2 path] [-json] key1 key2
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/offchainlabs/arb-avm/checkpoint"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+type jsonDiff struct {
+	Component vm.Component  `json:"component"`
+	Depth     int64         `json:"depth"`
+	Path      []int64       `json:"path,omitempty"`
+	Left      *vm.ValueDump `json:"left,omitempty"`
+	Right     *vm.ValueDump `json:"right,omitempty"`
+	Msg       string        `json:"msg,omitempty"`
+}
+
+func dumpOrNil(val value.Value) *vm.ValueDump {
+	if val == nil {
+		return nil
+	}
+	d := vm.DumpValue(val)
+	return &d
+}
+
+func restore(cp *checkpoint.Checkpointer, key string) (*vm.Machine, error) {
+	m, err := cp.RestoreMachine([]byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("restoring machine %q: %v", key, err)
+	}
+	return m, nil
+}
+
+func diffCheckpoints(dbPath, dbPath2, key1, key2 string) ([]vm.MachineDiff, error) {
+	cp1, err := checkpoint.OpenCheckpointer(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cp1.Close()
+	cp2 := cp1
+	if dbPath2 != "" && dbPath2 != dbPath {
+		cp2, err = checkpoint.OpenCheckpointer(dbPath2)
+		if err != nil {
+			return nil, err
+		}
+		defer cp2.Close()
+	}
+
+	m1, err := restore(cp1, key1)
+	if err != nil {
+		return nil, err
+	}
+	m2, err := restore(cp2, key2)
+	if err != nil {
+		return nil, err
+	}
+	return vm.Diff(m1, m2), nil
+}
+
+func main() {
+	dbPath := flag.String("db", "/tmp/arb-validator-checkpoint", "checkpoint database")
+	dbPath2 := flag.String("db2", "", "checkpoint database for the second machine, if different")
+	asJSON := flag.Bool("json", false, "print the differences as JSON")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: diff-machines [-db path] [-db2 path] [-json] key1 key2")
+		os.Exit(2)
+	}
+
+	diffs, err := diffCheckpoints(*dbPath, *dbPath2, flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		out := make([]jsonDiff, 0, len(diffs))
+		for _, d := range diffs {
+			out = append(out, jsonDiff{d.Component, d.Depth, d.Path, dumpOrNil(d.Left), dumpOrNil(d.Right), d.Msg})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
@@ -105,7 +105,23 @@ const (
 	DEBUG
 )
 
-const MaxOpcode = 0x7f
+// 0x80 range - byte buffers, as implemented by package vm/buffer.
+const (
+	BUFNEW value.Opcode = 0x80 + iota
+	BUFLEN
+	BUFGET
+	BUFSET
+	BUFSET8
+	BUFSLICE
+)
+
+// 0x90 range - native versions of Ethereum's hash and signature functions.
+const (
+	KECCAK value.Opcode = 0x90 + iota
+	ECRECOVER
+)
+
+const MaxOpcode = 0x9f
 
 var InstructionNames = map[value.Opcode]string{
 	ADD:    "add",
@@ -170,8 +186,23 @@ var InstructionNames = map[value.Opcode]string{
 	ERROR:   "error",
 	HALT:    "halt",
 	DEBUG:   "debug",
+
+	BUFNEW:   "bufnew",
+	BUFLEN:   "buflen",
+	BUFGET:   "bufget",
+	BUFSET:   "bufset",
+	BUFSET8:  "bufset8",
+	BUFSLICE: "bufslice",
+
+	KECCAK:    "keccak",
+	ECRECOVER: "ecrecover",
 }
 
+// InstructionStackPops lists the values each instruction pops, top first, and
+// how much of each one a proof includes: 0 for its hash, 1 for the value and
+// 2 for a tuple along with its items, and 3 for the whole value, which the
+// buffer instructions need. An instruction that fails or blocks can pop fewer
+// values, or include more of a value it failed on.
 var InstructionStackPops = map[value.Opcode][]byte{
 	ADD:    {1, 1},
 	MUL:    {1, 1},
@@ -236,6 +267,16 @@ var InstructionStackPops = map[value.Opcode][]byte{
 	ERROR:   {},
 	HALT:    {},
 	DEBUG:   {},
+
+	BUFNEW:   {1},
+	BUFLEN:   {2},
+	BUFGET:   {1, 3},
+	BUFSET:   {1, 3, 1},
+	BUFSET8:  {1, 3, 1},
+	BUFSLICE: {1, 3, 1},
+
+	KECCAK:    {3},
+	ECRECOVER: {1, 3},
 }
 
 var InstructionAuxStackPops = map[value.Opcode][]byte{
@@ -302,4 +343,26 @@ var InstructionAuxStackPops = map[value.Opcode][]byte{
 	ERROR:   {},
 	HALT:    {},
 	DEBUG:   {},
+
+	BUFNEW:   {},
+	BUFLEN:   {},
+	BUFGET:   {},
+	BUFSET:   {},
+	BUFSET8:  {},
+	BUFSLICE: {},
+
+	KECCAK:    {},
+	ECRECOVER: {},
 }
+
+// InstructionStepCosts lists the instructions that count as more than one
+// step of an assertion, for the work they do. Every other instruction is one
+// step. KECCAK also counts KeccakWordStepCost for each word it hashes.
+var InstructionStepCosts = map[value.Opcode]int{
+	KECCAK:    30,
+	ECRECOVER: 3000,
+}
+
+// KeccakWordStepCost is the number of steps KECCAK counts as for each 32-byte
+// word of the buffer it hashes, on top of its InstructionStepCosts entry
+const KeccakWordStepCost = 6
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proof
+
+import (
+	"fmt"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-util/protocol"
+)
+
+// Oracle gives a counterparty's claimed machine hash after the given number
+// of steps. Steps are counted in step costs, as assertions count them, and
+// the oracle is only asked about counts that fall between instructions.
+type Oracle func(steps uint64) ([32]byte, error)
+
+// Trace records a run of a machine, keeping its hash every interval steps, so
+// that a dispute over the run can be narrowed down to a single instruction.
+// The machine passed in isn't changed; the run is on a clone.
+type Trace struct {
+	start      *vm.Machine
+	timeBounds protocol.TimeBounds
+	// step counts of the checkpoints, which are at the first instruction
+	// boundary in each interval plus the last step, and the hashes at them
+	steps  []uint64
+	hashes [][32]byte
+}
+
+// step runs one instruction, along with any breakpoints before it, if it
+// counts as no more than limit steps. It returns the number of steps it
+// counted as, and false if the machine couldn't run it or blocked without
+// moving.
+func step(m *vm.Machine, timeBounds protocol.TimeBounds, limit uint64) (uint64, bool) {
+	cost := m.NextStepCost()
+	if uint64(cost) > limit {
+		return 0, false
+	}
+	for !m.IsHalted() && !m.IsErrored() && !m.HaveSizeException() {
+		before := m.Hash()
+		a := m.ExecuteAssertion(int32(cost), timeBounds)
+		if a.NumSteps > 0 {
+			return uint64(a.NumSteps), true
+		}
+		// a breakpoint moves on without counting as a step
+		if m.Hash() == before {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// NewTrace runs a clone of m for up to maxSteps steps, stopping early if it
+// halts, errors or blocks, or before an instruction that would take it past
+// maxSteps
+func NewTrace(m *vm.Machine, maxSteps uint64, interval uint64, timeBounds protocol.TimeBounds) (*Trace, error) {
+	if interval == 0 {
+		return nil, Error{"NewTrace: interval must be positive"}
+	}
+	t := &Trace{
+		start:      m.Clone().(*vm.Machine),
+		timeBounds: timeBounds,
+		steps:      []uint64{0},
+		hashes:     [][32]byte{m.Hash()},
+	}
+	c := m.Clone().(*vm.Machine)
+	var steps uint64
+	last := m.Hash()
+	for {
+		n, ok := step(c, timeBounds, maxSteps-steps)
+		if !ok {
+			break
+		}
+		if (steps+n)/interval > steps/interval {
+			t.steps = append(t.steps, steps+n)
+			t.hashes = append(t.hashes, c.Hash())
+		}
+		steps += n
+		last = c.Hash()
+	}
+	// the last hash is from before any breakpoints a failed step ran
+	if t.steps[len(t.steps)-1] != steps {
+		t.steps = append(t.steps, steps)
+		t.hashes = append(t.hashes, last)
+	}
+	return t, nil
+}
+
+// Steps returns the number of steps in the trace
+func (t *Trace) Steps() uint64 {
+	return t.steps[len(t.steps)-1]
+}
+
+// Machine returns a machine in the state after the given number of steps
+func (t *Trace) Machine(steps uint64) (*vm.Machine, error) {
+	if steps > t.Steps() {
+		return nil, Error{fmt.Sprintf("Trace: step %v is past the end of the trace at %v", steps, t.Steps())}
+	}
+	m := t.start.Clone().(*vm.Machine)
+	for count := uint64(0); count < steps; {
+		n, ok := step(m, t.timeBounds, steps-count)
+		if !ok {
+			return nil, Error{fmt.Sprintf("Trace: step %v falls inside the instruction at step %v", steps, count)}
+		}
+		count += n
+	}
+	return m, nil
+}
+
+// HashAt returns the machine hash after the given number of steps. It can be
+// used as the Oracle of an honest counterparty.
+func (t *Trace) HashAt(steps uint64) ([32]byte, error) {
+	for i, s := range t.steps {
+		if s == steps {
+			return t.hashes[i], nil
+		}
+	}
+	m, err := t.Machine(steps)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return m.Hash(), nil
+}
+
+// Bisect finds the first step count at which claims differs from the trace.
+// The claims must agree with the trace at the start and differ from it at the
+// end.
+func (t *Trace) Bisect(claims Oracle) (uint64, error) {
+	_, steps, err := t.bisect(claims)
+	return steps, err
+}
+
+// bisect narrows the dispute down to two checkpoints, then replays the
+// instructions between them. It returns the step counts before and after the
+// instruction that claims disagree with.
+func (t *Trace) bisect(claims Oracle) (uint64, uint64, error) {
+	agree := func(steps uint64, hash [32]byte) (bool, error) {
+		claim, err := claims(steps)
+		if err != nil {
+			return false, err
+		}
+		return claim == hash, nil
+	}
+
+	last := len(t.steps) - 1
+	if ok, err := agree(0, t.hashes[0]); err != nil {
+		return 0, 0, err
+	} else if !ok {
+		return 0, 0, Error{"Bisect: claims differ from the trace before the first step"}
+	}
+	if ok, err := agree(t.steps[last], t.hashes[last]); err != nil {
+		return 0, 0, err
+	} else if ok {
+		return 0, 0, Error{"Bisect: claims agree with the whole trace"}
+	}
+
+	// the claims agree at checkpoint lo and differ at checkpoint hi
+	lo, hi := 0, last
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := agree(t.steps[mid], t.hashes[mid])
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	m, err := t.Machine(t.steps[lo])
+	if err != nil {
+		return 0, 0, err
+	}
+	counts := []uint64{t.steps[lo]}
+	segment := [][32]byte{m.Hash()}
+	for s := t.steps[lo]; s < t.steps[hi]; {
+		n, ok := step(m, t.timeBounds, t.steps[hi]-s)
+		if !ok {
+			return 0, 0, Error{fmt.Sprintf("Bisect: trace stopped at step %v, before %v", s, t.steps[hi])}
+		}
+		s += n
+		counts = append(counts, s)
+		segment = append(segment, m.Hash())
+	}
+
+	// the same search, over the instructions between the checkpoints
+	segLo, segHi := 0, len(segment)-1
+	for segHi-segLo > 1 {
+		mid := (segLo + segHi) / 2
+		ok, err := agree(counts[mid], segment[mid])
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			segLo = mid
+		} else {
+			segHi = mid
+		}
+	}
+	return counts[segHi-1], counts[segHi], nil
+}
+
+// ProveDivergence bisects against claims, and proves the instruction that
+// takes the machine from the last state the claims agree with to the first
+// one they don't. Breakpoints before the instruction don't count as steps,
+// so they're run first, and the proof starts after them.
+func (t *Trace) ProveDivergence(claims Oracle) (*OneStepProof, error) {
+	before, _, err := t.bisect(claims)
+	if err != nil {
+		return nil, err
+	}
+	m, err := t.Machine(before)
+	if err != nil {
+		return nil, err
+	}
+	for m.GetOperation().GetOp() == code.BREAKPOINT {
+		m.ExecuteAssertion(int32(m.NextStepCost()), t.timeBounds)
+	}
+	return Generate(m, t.timeBounds)
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proof
+
+import (
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// loopMachine returns a machine that counts to 50, taking 7 steps per count,
+// then halts
+func loopMachine() *vm.Machine {
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.RSET},
+		value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(1)},
+		value.BasicOperation{Op: code.DUP0},
+		value.ImmediateOperation{Op: code.GT, Val: value.NewInt64Value(50)},
+		value.BasicOperation{Op: code.RPUSH},
+		value.BasicOperation{Op: code.CJUMP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	m := vm.NewMachine(insns, value.NewInt64Value(1), false, 100)
+	m.Stack().Push(value.NewInt64Value(0))
+	return m
+}
+
+// faultyClaims returns the claims of a counterparty that runs m, but
+// corrupts its machine once it has run faultAt steps
+func faultyClaims(m *vm.Machine, faultAt uint64) Oracle {
+	return func(steps uint64) ([32]byte, error) {
+		c := m.Clone().(*vm.Machine)
+		for count := uint64(0); count < steps; {
+			n, ok := step(c, testTimeBounds, steps-count)
+			if !ok {
+				break
+			}
+			if count < faultAt && count+n >= faultAt {
+				c.AuxStack().Push(value.NewInt64Value(1234))
+			}
+			count += n
+		}
+		return c.Hash(), nil
+	}
+}
+
+func TestBisectFaultyCounterparty(t *testing.T) {
+	m := loopMachine()
+	// the trace stops before the machine halts, since a halted machine's
+	// hash doesn't show the fault
+	for _, interval := range []uint64{1, 7, 64, 1000} {
+		trace, err := NewTrace(m, 300, interval, testTimeBounds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trace.Steps() != 300 {
+			t.Fatalf("trace has %v steps", trace.Steps())
+		}
+		for _, faultAt := range []uint64{1, 2, 50, 63, 64, 65, 200, 300} {
+			claims := faultyClaims(m, faultAt)
+			steps, err := trace.Bisect(claims)
+			if err != nil {
+				t.Fatalf("interval %v, fault at %v: %v", interval, faultAt, err)
+			}
+			if steps != faultAt {
+				t.Errorf("interval %v: fault at %v found at %v", interval, faultAt, steps)
+			}
+
+			p, err := trace.ProveDivergence(claims)
+			if err != nil {
+				t.Fatalf("interval %v, fault at %v: %v", interval, faultAt, err)
+			}
+			if err := Verify(p); err != nil {
+				t.Errorf("interval %v, fault at %v: %v", interval, faultAt, err)
+			}
+			before, _ := claims(faultAt - 1)
+			after, _ := claims(faultAt)
+			if p.BeforeHash != before || p.AfterHash == after {
+				t.Errorf("interval %v, fault at %v: proof doesn't refute the claim", interval, faultAt)
+			}
+		}
+	}
+}
+
+func TestBisectAgreement(t *testing.T) {
+	m := loopMachine()
+	full, err := NewTrace(m, 1000, 16, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Steps() != 351 {
+		t.Fatalf("trace has %v steps", full.Steps())
+	}
+	if end, _ := full.Machine(full.Steps()); !end.IsHalted() {
+		t.Fatal("trace doesn't end with the machine halted")
+	}
+	if _, err := full.Bisect(faultyClaims(m, 200)); err == nil {
+		t.Error("bisected against claims that agree on the halted machine")
+	}
+
+	trace, err := NewTrace(m, 100, 16, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Steps() != 100 {
+		t.Fatalf("trace has %v steps", trace.Steps())
+	}
+	if _, err := trace.Bisect(trace.HashAt); err == nil {
+		t.Error("bisected against an honest counterparty")
+	}
+	if _, err := trace.Bisect(faultyClaims(m, 101)); err == nil {
+		t.Error("bisected against claims that differ only after the trace")
+	}
+
+	other := loopMachine()
+	other.Stack().Push(value.NewInt64Value(0))
+	if _, err := trace.Bisect(faultyClaims(other, 1)); err == nil {
+		t.Error("bisected against claims that differ at the start")
+	}
+}
+
+// hashLoopMachine returns a machine that counts to 5, running a keccak and an
+// ecrecover per count, then halts
+func hashLoopMachine() *vm.Machine {
+	data, _ := buffer.New(100)
+	sig, _ := buffer.New(buffer.SignatureSize)
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.RSET},
+		value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(1)},
+		value.ImmediateOperation{Op: code.NOP, Val: data.Value()},
+		value.BasicOperation{Op: code.KECCAK},
+		value.BasicOperation{Op: code.POP},
+		value.ImmediateOperation{Op: code.NOP, Val: sig.Value()},
+		value.ImmediateOperation{Op: code.ECRECOVER, Val: value.NewInt64Value(1)},
+		value.BasicOperation{Op: code.POP},
+		value.BasicOperation{Op: code.DUP0},
+		value.ImmediateOperation{Op: code.GT, Val: value.NewInt64Value(5)},
+		value.BasicOperation{Op: code.RPUSH},
+		value.BasicOperation{Op: code.CJUMP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	m := vm.NewMachine(insns, value.NewInt64Value(1), false, 100)
+	m.Stack().Push(value.NewInt64Value(0))
+	return m
+}
+
+func TestBisectStepCosts(t *testing.T) {
+	m := hashLoopMachine()
+	// the keccak hashes a buffer of 100 bytes, in 4 words
+	keccak := uint64(code.InstructionStepCosts[code.KECCAK] + 4*code.KeccakWordStepCost)
+	ecrecover := uint64(code.InstructionStepCosts[code.ECRECOVER])
+	perCount := 11 + keccak + ecrecover
+
+	full, err := NewTrace(m, 1000000, 1000, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Steps() != 5*perCount+1 {
+		t.Fatalf("trace has %v steps", full.Steps())
+	}
+	if a := m.Clone().(*vm.Machine).ExecuteAssertion(int32(full.Steps()), testTimeBounds); uint64(a.NumSteps) != full.Steps() {
+		t.Errorf("assertion took %v steps, but the trace has %v", a.NumSteps, full.Steps())
+	}
+
+	// the trace stops before an ecrecover that would take it past maxSteps
+	short, err := NewTrace(m, 100, 16, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short.Steps() != 6+keccak {
+		t.Errorf("short trace has %v steps", short.Steps())
+	}
+	if _, err := full.Machine(7 + keccak); err == nil {
+		t.Error("got a machine part way through an ecrecover")
+	}
+
+	trace, err := NewTrace(m, 2*perCount+10, 100, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// faults just after a keccak, an ecrecover, and instructions around them
+	faults := []uint64{
+		1,
+		4 + keccak,
+		5 + keccak,
+		6 + keccak + ecrecover,
+		7 + keccak + ecrecover,
+		perCount + 4 + keccak,
+		perCount + 6 + keccak + ecrecover,
+		trace.Steps(),
+	}
+	before := map[uint64]uint64{
+		4 + keccak:                        4,
+		perCount + 4 + keccak:             perCount + 4,
+		6 + keccak + ecrecover:            6 + keccak,
+		perCount + 6 + keccak + ecrecover: perCount + 6 + keccak,
+	}
+	for _, faultAt := range faults {
+		claims := faultyClaims(m, faultAt)
+		steps, err := trace.Bisect(claims)
+		if err != nil {
+			t.Fatalf("fault at %v: %v", faultAt, err)
+		}
+		if steps != faultAt {
+			t.Errorf("fault at %v found at %v", faultAt, steps)
+		}
+
+		p, err := trace.ProveDivergence(claims)
+		if err != nil {
+			t.Fatalf("fault at %v: %v", faultAt, err)
+		}
+		if err := Verify(p); err != nil {
+			t.Errorf("fault at %v: %v", faultAt, err)
+		}
+		prev, ok := before[faultAt]
+		if !ok {
+			prev = faultAt - 1
+		}
+		agreed, _ := claims(prev)
+		after, _ := claims(faultAt)
+		if p.BeforeHash != agreed || p.AfterHash == after {
+			t.Errorf("fault at %v: proof doesn't refute the claim", faultAt)
+		}
+	}
+}
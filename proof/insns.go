@@ -0,0 +1,705 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proof
+
+// The verifier's instruction semantics. These follow the on-chain verifier
+// rather than the vm package, and only see the values included in the proof.
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+var (
+	tt256   = math.BigPow(2, 256)
+	tt256m1 = new(big.Int).Sub(tt256, big.NewInt(1))
+)
+
+// insnImpls are the verifier's semantics for the standard instructions. The
+// ones an instruction set adds are run by registeredImpl.
+var insnImpls map[value.Opcode]func(*stepState) error
+
+func init() {
+	insnImpls = map[value.Opcode]func(*stepState) error{
+		code.ADD: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return math.U256(new(big.Int).Add(x, y)), nil
+		}),
+		code.MUL: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return math.U256(new(big.Int).Mul(x, y)), nil
+		}),
+		code.SUB: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return math.U256(new(big.Int).Sub(x, y)), nil
+		}),
+		code.DIV: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			if y.Sign() == 0 {
+				return nil, errDivideByZero
+			}
+			return new(big.Int).Div(x, y), nil
+		}),
+		code.SDIV: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			if y.Sign() == 0 {
+				return nil, errDivideByZero
+			}
+			// Div, as the machine does
+			return math.U256(new(big.Int).Div(math.S256(x), math.S256(y))), nil
+		}),
+		code.MOD: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			if y.Sign() == 0 {
+				return nil, errDivideByZero
+			}
+			return new(big.Int).Mod(x, y), nil
+		}),
+		code.SMOD: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			if y.Sign() == 0 {
+				return nil, errDivideByZero
+			}
+			// Go's Rem takes the sign of the dividend, like the EVM
+			return math.U256(new(big.Int).Rem(math.S256(x), math.S256(y))), nil
+		}),
+		code.ADDMOD: trinaryIntOp(func(x, y, z *big.Int) (*big.Int, error) {
+			if z.Sign() == 0 {
+				return nil, errDivideByZero
+			}
+			return new(big.Int).Mod(new(big.Int).Add(x, y), z), nil
+		}),
+		code.MULMOD: trinaryIntOp(func(x, y, z *big.Int) (*big.Int, error) {
+			if z.Sign() == 0 {
+				return nil, errDivideByZero
+			}
+			return new(big.Int).Mod(new(big.Int).Mul(x, y), z), nil
+		}),
+		code.EXP: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return new(big.Int).Exp(x, y, tt256), nil
+		}),
+
+		code.LT: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return boolInt(x.Cmp(y) < 0), nil
+		}),
+		code.GT: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return boolInt(x.Cmp(y) > 0), nil
+		}),
+		code.SLT: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return boolInt(math.S256(x).Cmp(math.S256(y)) < 0), nil
+		}),
+		code.SGT: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return boolInt(math.S256(x).Cmp(math.S256(y)) > 0), nil
+		}),
+		code.EQ: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			y, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			s.pushInt(boolInt(x.Hash() == y.Hash()))
+			s.incrPC()
+			return nil
+		},
+		code.ISZERO: unaryIntOp(func(x *big.Int) (*big.Int, error) {
+			return boolInt(x.Sign() == 0), nil
+		}),
+		code.AND: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return new(big.Int).And(x, y), nil
+		}),
+		code.OR: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return new(big.Int).Or(x, y), nil
+		}),
+		code.XOR: binaryIntOp(func(x, y *big.Int) (*big.Int, error) {
+			return new(big.Int).Xor(x, y), nil
+		}),
+		code.NOT: unaryIntOp(func(x *big.Int) (*big.Int, error) {
+			return new(big.Int).Xor(x, tt256m1), nil
+		}),
+		code.BYTE: binaryIntOp(func(x, n *big.Int) (*big.Int, error) {
+			if n.Cmp(big.NewInt(32)) >= 0 {
+				return new(big.Int), nil
+			}
+			return big.NewInt(int64(math.PaddedBigBytes(x, 32)[n.Int64()])), nil
+		}),
+		code.SIGNEXTEND: binaryIntOp(func(x, n *big.Int) (*big.Int, error) {
+			if n.Cmp(big.NewInt(31)) > 0 {
+				return x, nil
+			}
+			bit := uint(n.Uint64()*8 + 7)
+			mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bit), big.NewInt(1))
+			if x.Bit(int(bit)) == 1 {
+				return new(big.Int).Or(x, new(big.Int).Xor(tt256m1, mask)), nil
+			}
+			return new(big.Int).And(x, mask), nil
+		}),
+
+		code.SHA3: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			h := x.Hash()
+			s.pushInt(new(big.Int).SetBytes(h[:]))
+			s.incrPC()
+			return nil
+		},
+		code.TYPE: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			if x.TypeCode() == value.TypeCodeHashOnly {
+				return errMissingValue
+			}
+			s.pushInt(big.NewInt(int64(x.TypeCode())))
+			s.incrPC()
+			return nil
+		},
+
+		code.POP: func(s *stepState) error {
+			if _, err := s.stack.pop(); err != nil {
+				return err
+			}
+			s.incrPC()
+			return nil
+		},
+		code.SPUSH: func(s *stepState) error {
+			s.stack.push(s.static)
+			s.incrPC()
+			return nil
+		},
+		code.RPUSH: func(s *stepState) error {
+			s.stack.push(s.register)
+			s.incrPC()
+			return nil
+		},
+		code.RSET: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			s.register = x
+			s.incrPC()
+			return nil
+		},
+		code.JUMP: func(s *stepState) error {
+			target, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			return s.jump(target)
+		},
+		code.CJUMP: func(s *stepState) error {
+			target, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			cond, err := s.popInt()
+			if err != nil {
+				return err
+			}
+			if cond.Sign() != 0 {
+				return s.jump(target)
+			}
+			s.incrPC()
+			return nil
+		},
+		code.STACKEMPTY: func(s *stepState) error {
+			s.pushInt(boolInt(s.stack.isEmpty()))
+			s.incrPC()
+			return nil
+		},
+		code.PCPUSH: func(s *stepState) error {
+			s.stack.push(s.codePoint)
+			s.incrPC()
+			return nil
+		},
+		code.AUXPUSH: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			s.auxstack.push(x)
+			s.incrPC()
+			return nil
+		},
+		code.AUXPOP: func(s *stepState) error {
+			if s.auxstack.isEmpty() {
+				s.stack.push(value.NewEmptyTuple())
+			} else {
+				x, err := s.auxstack.pop()
+				if err != nil {
+					return err
+				}
+				s.stack.push(x)
+			}
+			s.incrPC()
+			return nil
+		},
+		code.AUXSTACKEMPTY: func(s *stepState) error {
+			s.pushInt(boolInt(s.auxstack.isEmpty()))
+			s.incrPC()
+			return nil
+		},
+		code.NOP: nop,
+		code.ERRPUSH: func(s *stepState) error {
+			s.stack.push(s.errHandler)
+			s.incrPC()
+			return nil
+		},
+		code.ERRSET: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			if _, ok := x.(value.CodePointValue); !ok {
+				return typeMismatch(x)
+			}
+			s.errHandler = x
+			s.incrPC()
+			return nil
+		},
+
+		code.DUP0:  permute(1, 0, 0),
+		code.DUP1:  permute(2, 1, 0, 1),
+		code.DUP2:  permute(3, 2, 1, 0, 2),
+		code.SWAP1: permute(2, 0, 1),
+		code.SWAP2: permute(3, 0, 1, 2),
+
+		code.TGET: func(s *stepState) error {
+			index, err := s.popInt()
+			if err != nil {
+				return err
+			}
+			tup, err := s.popTuple()
+			if err != nil {
+				return err
+			}
+			if !index.IsInt64() || index.Int64() >= tup.Len() {
+				return errTupleIndex
+			}
+			val, _ := tup.GetByInt64(index.Int64())
+			s.stack.push(val)
+			s.incrPC()
+			return nil
+		},
+		code.TSET: func(s *stepState) error {
+			index, err := s.popInt()
+			if err != nil {
+				return err
+			}
+			tup, err := s.popTuple()
+			if err != nil {
+				return err
+			}
+			val, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			if !index.IsInt64() || index.Int64() >= tup.Len() {
+				return errTupleIndex
+			}
+			newTup, _ := tup.SetByInt64(index.Int64(), val)
+			s.stack.push(newTup)
+			s.incrPC()
+			return nil
+		},
+		code.TLEN: func(s *stepState) error {
+			tup, err := s.popTuple()
+			if err != nil {
+				return err
+			}
+			s.pushInt(big.NewInt(tup.Len()))
+			s.incrPC()
+			return nil
+		},
+
+		code.BREAKPOINT: nop,
+		code.LOG: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			s.logs = append(s.logs, x.Hash())
+			s.incrPC()
+			return nil
+		},
+
+		code.SEND: func(s *stepState) error {
+			msg, err := s.popMessage()
+			if err != nil {
+				return err
+			}
+			// a send blocks when the balance is too low, which is tracked by
+			// the assertion, so take it from the claim
+			if s.ctx.Blocked {
+				s.stack.push(msg)
+				s.blocked = true
+				return nil
+			}
+			s.messages = append(s.messages, msg.Hash())
+			s.incrPC()
+			return nil
+		},
+		code.NBSEND: func(s *stepState) error {
+			msg, err := s.popMessage()
+			if err != nil {
+				return err
+			}
+			// whether the send succeeded depends on the balance, which is
+			// tracked by the assertion, so take it from the claim
+			if len(s.ctx.Messages) > 0 {
+				s.messages = append(s.messages, msg.Hash())
+				s.pushInt(big.NewInt(1))
+			} else {
+				s.pushInt(big.NewInt(0))
+			}
+			s.incrPC()
+			return nil
+		},
+		code.GETTIME: func(s *stepState) error {
+			s.stack.push(s.ctx.TimeBounds.AsValue())
+			s.incrPC()
+			return nil
+		},
+		code.INBOX: func(s *stepState) error {
+			x, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			s.stack.push(value.NewHashOnlyValue(s.ctx.InboxHash, 1))
+			if x.Hash() == s.ctx.InboxHash {
+				// the inbox has nothing new
+				s.blocked = true
+				return nil
+			}
+			s.didInboxInsn = true
+			s.incrPC()
+			return nil
+		},
+		code.ERROR: func(s *stepState) error {
+			return failure{"error instruction"}
+		},
+		code.HALT: func(s *stepState) error {
+			s.status = vm.MACHINE_HALT
+			return nil
+		},
+		code.DEBUG: nop,
+
+		// buffers follow package buffer, which defines them
+		code.BUFNEW: func(s *stepState) error {
+			size, err := s.popInt()
+			if err != nil {
+				return err
+			}
+			if !size.IsInt64() {
+				return failure{fmt.Sprintf("buffer size %v", size)}
+			}
+			b, err := buffer.New(size.Int64())
+			if err != nil {
+				return bufferError(err)
+			}
+			s.stack.push(b.Value())
+			s.incrPC()
+			return nil
+		},
+		code.BUFLEN: func(s *stepState) error {
+			tup, err := s.popTuple()
+			if err != nil {
+				return err
+			}
+			size, err := buffer.DecodeSize(tup)
+			if err != nil {
+				return bufferError(err)
+			}
+			s.pushInt(big.NewInt(size))
+			s.incrPC()
+			return nil
+		},
+		code.BUFGET: func(s *stepState) error {
+			offset, err := s.popInt()
+			if err != nil {
+				return err
+			}
+			b, err := s.popBuffer()
+			if err != nil {
+				return err
+			}
+			word, err := b.Read(offset)
+			if err != nil {
+				return bufferError(err)
+			}
+			s.pushInt(word)
+			s.incrPC()
+			return nil
+		},
+		code.BUFSET:   bufferWrite(buffer.Buffer.Write),
+		code.BUFSET8:  bufferWrite(buffer.Buffer.Write8),
+		code.BUFSLICE: bufferWrite(buffer.Buffer.Slice),
+
+		code.KECCAK: func(s *stepState) error {
+			b, err := s.popBuffer()
+			if err != nil {
+				return err
+			}
+			hash, err := b.Keccak()
+			if err != nil {
+				return bufferError(err)
+			}
+			s.pushInt(hash)
+			s.incrPC()
+			return nil
+		},
+		code.ECRECOVER: func(s *stepState) error {
+			hash, err := s.popInt()
+			if err != nil {
+				return err
+			}
+			sig, err := s.popBuffer()
+			if err != nil {
+				return err
+			}
+			addr, err := buffer.Ecrecover(hash, sig)
+			if err != nil {
+				return bufferError(err)
+			}
+			s.pushInt(addr)
+			s.incrPC()
+			return nil
+		},
+	}
+}
+
+// failure is an error raised by the instruction itself, which sends the
+// machine to its error handler rather than making the proof invalid
+type failure struct {
+	str string
+}
+
+func (e failure) Error() string {
+	return e.str
+}
+
+var (
+	errMissingValue = Error{"Verify: proof doesn't include a value the instruction needs"}
+	errDivideByZero = failure{"instruction divides by zero"}
+	errTupleIndex   = failure{"tuple index out of range"}
+)
+
+func typeMismatch(val value.Value) error {
+	if val.TypeCode() == value.TypeCodeHashOnly {
+		return errMissingValue
+	}
+	return failure{fmt.Sprintf("instruction got a value of the wrong type: %v", val)}
+}
+
+func boolInt(b bool) *big.Int {
+	if b {
+		return big.NewInt(1)
+	}
+	return big.NewInt(0)
+}
+
+func nop(s *stepState) error {
+	s.incrPC()
+	return nil
+}
+
+func (s *stepState) pushInt(x *big.Int) {
+	s.stack.push(value.NewIntValue(x))
+}
+
+func (s *stepState) popInt() (*big.Int, error) {
+	val, err := s.stack.pop()
+	if err != nil {
+		return nil, err
+	}
+	iv, ok := val.(value.IntValue)
+	if !ok {
+		return nil, typeMismatch(val)
+	}
+	return iv.BigInt(), nil
+}
+
+func (s *stepState) popTuple() (value.TupleValue, error) {
+	val, err := s.stack.pop()
+	if err != nil {
+		return value.TupleValue{}, err
+	}
+	tup, ok := val.(value.TupleValue)
+	if !ok {
+		return value.TupleValue{}, typeMismatch(val)
+	}
+	return tup, nil
+}
+
+func (s *stepState) popBuffer() (buffer.Buffer, error) {
+	val, err := s.stack.pop()
+	if err != nil {
+		return buffer.Buffer{}, err
+	}
+	b, err := buffer.Decode(val)
+	if err != nil {
+		return buffer.Buffer{}, bufferError(err)
+	}
+	return b, nil
+}
+
+// bufferError converts an error from package buffer
+func bufferError(err error) error {
+	switch e := err.(type) {
+	case buffer.MissingValueError:
+		return errMissingValue
+	case buffer.TypeError:
+		return typeMismatch(e.Value)
+	case buffer.RangeError:
+		return failure{e.Error()}
+	}
+	return err
+}
+
+// bufferWrite returns the semantics of an instruction that pops an offset, a
+// buffer and an int, and pushes the buffer that write returns
+func bufferWrite(write func(b buffer.Buffer, offset *big.Int, x *big.Int) (buffer.Buffer, error)) func(*stepState) error {
+	return func(s *stepState) error {
+		offset, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		b, err := s.popBuffer()
+		if err != nil {
+			return err
+		}
+		x, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		ret, err := write(b, offset, x)
+		if err != nil {
+			return bufferError(err)
+		}
+		s.stack.push(ret.Value())
+		s.incrPC()
+		return nil
+	}
+}
+
+// popMessage pops the (data, destination, amount, token type) tuple given
+// to a send. A proof of a send that succeeds includes the tuple's items only
+// as hashes; one that fails on their types includes them, so the types of
+// the ints can be checked.
+func (s *stepState) popMessage() (value.TupleValue, error) {
+	tup, err := s.popTuple()
+	if err != nil {
+		return value.TupleValue{}, err
+	}
+	if tup.Len() != 4 {
+		return value.TupleValue{}, typeMismatch(tup)
+	}
+	for i := int64(1); i < 4; i++ {
+		item, _ := tup.GetByInt64(i)
+		switch item.(type) {
+		case value.HashOnlyValue, value.IntValue:
+		default:
+			return value.TupleValue{}, typeMismatch(item)
+		}
+	}
+	return tup, nil
+}
+
+func unaryIntOp(op func(*big.Int) (*big.Int, error)) func(*stepState) error {
+	return func(s *stepState) error {
+		x, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		ret, err := op(x)
+		if err != nil {
+			return err
+		}
+		s.pushInt(ret)
+		s.incrPC()
+		return nil
+	}
+}
+
+func binaryIntOp(op func(*big.Int, *big.Int) (*big.Int, error)) func(*stepState) error {
+	return func(s *stepState) error {
+		x, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		y, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		ret, err := op(x, y)
+		if err != nil {
+			return err
+		}
+		s.pushInt(ret)
+		s.incrPC()
+		return nil
+	}
+}
+
+func trinaryIntOp(op func(*big.Int, *big.Int, *big.Int) (*big.Int, error)) func(*stepState) error {
+	return func(s *stepState) error {
+		x, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		y, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		z, err := s.popInt()
+		if err != nil {
+			return err
+		}
+		ret, err := op(x, y, z)
+		if err != nil {
+			return err
+		}
+		s.pushInt(ret)
+		s.incrPC()
+		return nil
+	}
+}
+
+// permute pops n values, then pushes the popped values with the given
+// indices, counting the top as 0, in order
+func permute(n int, pushes ...int) func(*stepState) error {
+	return func(s *stepState) error {
+		popped := make([]value.Value, n)
+		for i := range popped {
+			val, err := s.stack.pop()
+			if err != nil {
+				return err
+			}
+			popped[i] = val
+		}
+		for _, i := range pushes {
+			s.stack.push(popped[i])
+		}
+		s.incrPC()
+		return nil
+	}
+}
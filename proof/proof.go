@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proof generates one-step proofs of machine execution, and checks
+// them with a Go implementation of the on-chain one-step verifier
+package proof
+
+import (
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-util/machine"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+type Error struct {
+	str string
+}
+
+func (e Error) Error() string {
+	return e.str
+}
+
+// Context holds what the verifier takes from the assertion being challenged
+// rather than from the proof: the inputs the machine could read during the
+// step, and the outputs it produced
+type Context struct {
+	TimeBounds protocol.TimeBounds
+	InboxHash  [32]byte
+	// Blocked is whether the instruction blocked, leaving the machine to
+	// retry it
+	Blocked bool
+
+	DidInboxInsn bool
+	// hashes of the (data, destination, amount, token type) tuples sent
+	Messages [][32]byte
+	// hashes of the logged values
+	Logs [][32]byte
+}
+
+// OneStepProof claims that executing one instruction in Context takes the
+// machine with hash BeforeHash to AfterHash. Data is the machine's
+// MarshalForProof encoding.
+type OneStepProof struct {
+	BeforeHash [32]byte
+	AfterHash  [32]byte
+	Context    Context
+	Data       []byte
+}
+
+// stepRecorder is the machine context for the step being proved
+type stepRecorder struct {
+	timeBounds protocol.TimeBounds
+	messages   [][32]byte
+	logs       [][32]byte
+}
+
+func (r *stepRecorder) LoggedValue(data value.Value) error {
+	r.logs = append(r.logs, data.Hash())
+	return nil
+}
+
+func (r *stepRecorder) Send(data value.Value, tokenType value.IntValue, currency value.IntValue, dest value.IntValue) error {
+	msg, err := value.NewTupleFromSlice([]value.Value{data, dest, currency, tokenType})
+	if err != nil {
+		return err
+	}
+	r.messages = append(r.messages, msg.Hash())
+	return nil
+}
+
+func (r *stepRecorder) OutMessageCount() int {
+	return len(r.messages)
+}
+
+func (r *stepRecorder) GetTimeBounds() value.Value {
+	return r.timeBounds.AsValue()
+}
+
+func (r *stepRecorder) NotifyStep() {}
+
+var _ machine.MachineContext = &stepRecorder{}
+
+// Generate proves the execution of m's current instruction, including one
+// that fails or blocks. m is left unchanged; the instruction is run on a
+// clone, with m's instruction set, so a proof of a machine that doesn't run
+// the standard set must be checked with VerifyWithInstructionSet. The
+// verifier doesn't know the machine's program, so it can't check jumps the
+// way a machine in strict mode does, and Generate refuses one.
+func Generate(m *vm.Machine, timeBounds protocol.TimeBounds) (*OneStepProof, error) {
+	if m.IsHalted() || m.IsErrored() || m.HaveSizeException() {
+		return nil, Error{"Generate: machine isn't running"}
+	}
+	if m.StrictJumps() {
+		return nil, Error{"Generate: can't prove a step of a machine with strict jumps"}
+	}
+	data, err := m.MarshalForProof()
+	if err != nil {
+		return nil, err
+	}
+
+	op := m.GetOperation()
+	after := m.Clone().(*vm.Machine)
+	after.SetWarningHandler(vm.NewSilentWarningHandler())
+	rec := &stepRecorder{timeBounds: timeBounds}
+	after.SetContext(rec)
+	// an instruction that fails is proved like any other: the proof shows
+	// the machine going to its error handler
+	_, err = vm.RunInstruction(after, op)
+	_, blocked := err.(vm.VMBlockedError)
+	// a breakpoint reports itself as blocked, but moves on to the next
+	// instruction
+	blocked = blocked && op.GetOp() != code.BREAKPOINT
+
+	return &OneStepProof{
+		BeforeHash: m.Hash(),
+		AfterHash:  after.Hash(),
+		Context: Context{
+			TimeBounds:   timeBounds,
+			InboxHash:    m.InboxHash().Hash(),
+			Blocked:      blocked,
+			DidInboxInsn: op.GetOp() == code.INBOX && err == nil,
+			Messages:     rec.messages,
+			Logs:         rec.logs,
+		},
+		Data: data,
+	}, nil
+}
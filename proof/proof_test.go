@@ -0,0 +1,611 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proof
+
+import (
+	"math/big"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+const trialsPerOpcode = 50
+
+var testTimeBounds = protocol.NewTimeBounds(10, 20)
+
+func randomInt(r *rand.Rand) value.IntValue {
+	switch r.Intn(4) {
+	case 0:
+		return value.NewInt64Value(r.Int63n(40))
+	case 1:
+		// negative, as a two's complement 256 bit number
+		return value.NewIntValue(math.U256(big.NewInt(-r.Int63n(1000) - 1)))
+	case 2:
+		return value.NewInt64Value(r.Int63())
+	default:
+		b := make([]byte, 32)
+		r.Read(b)
+		return value.NewIntValue(new(big.Int).SetBytes(b))
+	}
+}
+
+func randomTuple(r *rand.Rand, depth int, minLen int) value.TupleValue {
+	vals := make([]value.Value, minLen+r.Intn(4-minLen))
+	for i := range vals {
+		vals[i] = randomValue(r, depth+1)
+	}
+	tup, _ := value.NewTupleFromSlice(vals)
+	return tup
+}
+
+func randomValue(r *rand.Rand, depth int) value.Value {
+	n := r.Intn(5)
+	if depth > 2 {
+		n = 0
+	}
+	switch n {
+	case 0, 1:
+		return randomInt(r)
+	case 2:
+		return value.CodePointValue{InsnNum: r.Int63n(10), Op: value.BasicOperation{Op: code.NOP}, NextHash: randomInt(r).ToBytes()}
+	default:
+		return randomTuple(r, depth, 0)
+	}
+}
+
+// codePoints returns the code points of a program
+func codePoints(insns []value.Operation) []value.CodePointValue {
+	ret := make([]value.CodePointValue, len(insns))
+	next := vm.HashOfLastInstruction
+	for i := len(insns) - 1; i >= 0; i-- {
+		ret[i] = value.CodePointValue{InsnNum: int64(i), Op: insns[i], NextHash: next}
+		next = ret[i].Hash()
+	}
+	return ret
+}
+
+// randomBuffer returns a buffer of at least minSize bytes
+func randomBuffer(r *rand.Rand, minSize int) buffer.Buffer {
+	data := make([]byte, minSize+r.Intn(300))
+	r.Read(data)
+	b, _ := buffer.FromBytes(data)
+	return b
+}
+
+// operands returns valid operands for op, top first. Code point operands are
+// taken from targets.
+func operands(r *rand.Rand, op value.Opcode, targets []value.CodePointValue) []value.Value {
+	nonzero := func() value.Value {
+		x := randomInt(r)
+		if x.BigInt().Sign() == 0 {
+			return value.NewInt64Value(3)
+		}
+		return x
+	}
+	switch op {
+	case code.DIV, code.SDIV, code.MOD, code.SMOD:
+		return []value.Value{randomInt(r), nonzero()}
+	case code.ADDMOD, code.MULMOD:
+		return []value.Value{randomInt(r), randomInt(r), nonzero()}
+	case code.BYTE, code.SIGNEXTEND:
+		return []value.Value{randomInt(r), value.NewInt64Value(r.Int63n(40))}
+	case code.JUMP:
+		return []value.Value{targets[r.Intn(len(targets))]}
+	case code.CJUMP:
+		return []value.Value{targets[r.Intn(len(targets))], value.NewInt64Value(r.Int63n(2))}
+	case code.ERRSET:
+		return []value.Value{targets[r.Intn(len(targets))]}
+	case code.TGET:
+		tup := randomTuple(r, 0, 1)
+		return []value.Value{value.NewInt64Value(r.Int63n(tup.Len())), tup}
+	case code.TSET:
+		tup := randomTuple(r, 0, 1)
+		return []value.Value{value.NewInt64Value(r.Int63n(tup.Len())), tup, randomValue(r, 0)}
+	case code.TLEN:
+		return []value.Value{randomTuple(r, 0, 0)}
+	case code.BUFNEW:
+		return []value.Value{value.NewInt64Value(r.Int63n(300))}
+	case code.BUFLEN:
+		return []value.Value{randomBuffer(r, 0).Value()}
+	case code.BUFGET:
+		b := randomBuffer(r, 0)
+		return []value.Value{value.NewInt64Value(r.Int63n(b.Len() + 40)), b.Value()}
+	case code.BUFSET:
+		b := randomBuffer(r, 32)
+		return []value.Value{value.NewInt64Value(r.Int63n(b.Len() - 31)), b.Value(), randomInt(r)}
+	case code.BUFSET8:
+		b := randomBuffer(r, 1)
+		return []value.Value{value.NewInt64Value(r.Int63n(b.Len())), b.Value(), randomInt(r)}
+	case code.BUFSLICE:
+		b := randomBuffer(r, 0)
+		offset := r.Int63n(b.Len() + 1)
+		return []value.Value{value.NewInt64Value(offset), b.Value(), value.NewInt64Value(r.Int63n(b.Len() - offset + 1))}
+	case code.KECCAK:
+		return []value.Value{randomBuffer(r, 0).Value()}
+	case code.ECRECOVER:
+		// random r and s, which a key usually could have made
+		sig := make([]byte, buffer.SignatureSize)
+		r.Read(sig)
+		sig[64] = byte(27 + r.Intn(2))
+		b, _ := buffer.FromBytes(sig)
+		return []value.Value{randomInt(r), b.Value()}
+	case code.SEND, code.NBSEND:
+		// the machine has 100 of token 0; NBSEND sometimes overspends
+		limit := int64(100)
+		if op == code.NBSEND {
+			limit = 200
+		}
+		tup, _ := value.NewTupleFromSlice([]value.Value{
+			randomValue(r, 1),
+			randomInt(r),
+			value.NewInt64Value(r.Int63n(limit)),
+			value.NewInt64Value(0),
+		})
+		return []value.Value{tup}
+	}
+	var ret []value.Value
+	for _, full := range code.InstructionStackPops[op] {
+		if full == 1 {
+			ret = append(ret, randomInt(r))
+		} else {
+			ret = append(ret, randomValue(r, 0))
+		}
+	}
+	return ret
+}
+
+// randomStep returns a machine about to execute op with valid operands
+func randomStep(r *rand.Rand, op value.Opcode) *vm.Machine {
+	before, after := r.Intn(2), r.Intn(3)
+	if op == code.JUMP || op == code.CJUMP || op == code.ERRSET {
+		after++
+	}
+	var insns []value.Operation
+	for i := 0; i < before+1+after; i++ {
+		insns = append(insns, value.BasicOperation{Op: code.NOP})
+	}
+	insns[before] = value.BasicOperation{Op: op}
+	// the code points after op don't depend on whether it has an immediate
+	// value, so they're valid jump targets
+	ops := operands(r, op, codePoints(insns)[before+1:])
+	if len(ops) > 0 && r.Intn(2) == 0 {
+		insns[before] = value.ImmediateOperation{Op: op, Val: ops[0]}
+		ops = ops[1:]
+	}
+
+	m := vm.NewMachine(insns, randomValue(r, 0), false, 1<<30)
+	if err := m.SetPC(codePoints(insns)[before]); err != nil {
+		panic(err)
+	}
+	m.Register().Set(randomValue(r, 0))
+	m.SendOnchainMessage(protocol.NewMessage(value.NewEmptyTuple(), [21]byte{}, big.NewInt(100), [32]byte{}))
+	m.DeliverOnchainMessage()
+	for i := r.Intn(3); i > 0; i-- {
+		m.AuxStack().Push(randomValue(r, 0))
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		m.Stack().Push(randomValue(r, 0))
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		m.Stack().Push(ops[i])
+	}
+	return m
+}
+
+func TestProofsPerOpcode(t *testing.T) {
+	var opcodes []value.Opcode
+	for op := range code.InstructionNames {
+		if op != code.ERROR {
+			opcodes = append(opcodes, op)
+		}
+	}
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i] < opcodes[j] })
+
+	r := rand.New(rand.NewSource(1))
+	for _, op := range opcodes {
+		name := code.InstructionNames[op]
+		for i := 0; i < trialsPerOpcode; i++ {
+			m := randomStep(r, op)
+			before := m.Hash()
+			p, err := Generate(m, testTimeBounds)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			if m.Hash() != before {
+				t.Fatalf("%v: Generate changed the machine", name)
+			}
+			if err := Verify(p); err != nil {
+				t.Fatalf("%v: %v\n%v", name, err, m.GetOperation())
+			}
+		}
+	}
+}
+
+// TestProofLayout checks that a proof of an instruction that succeeds holds
+// its values as code.InstructionStackPops gives, and that one that fails on a
+// value holds enough of it to show why
+func TestProofLayout(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	isHash := func(val value.Value) bool {
+		_, ok := val.(value.HashOnlyValue)
+		return ok
+	}
+	for _, op := range []value.Opcode{code.JUMP, code.CJUMP, code.SEND, code.NBSEND} {
+		name := code.InstructionNames[op]
+		for i := 0; i < trialsPerOpcode; i++ {
+			m := randomStep(r, op)
+			if _, ok := m.GetOperation().(value.ImmediateOperation); ok {
+				continue
+			}
+			p, err := Generate(m, testTimeBounds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := decodeStep(p.Data, &p.Context, vm.NewInstructionSet())
+			if err != nil {
+				t.Fatal(err)
+			}
+			vals := s.stack.items
+			top := vals[len(vals)-1]
+			switch op {
+			case code.JUMP, code.CJUMP:
+				if !isHash(top) {
+					t.Errorf("%v: proof includes the target %v", name, top)
+				}
+			case code.SEND, code.NBSEND:
+				tup, ok := top.(value.TupleValue)
+				if !ok {
+					t.Fatalf("%v: proof doesn't include the message tuple", name)
+				}
+				for _, item := range tup.Contents() {
+					if !isHash(item) {
+						t.Errorf("%v: proof includes the message item %v", name, item)
+					}
+				}
+			}
+		}
+	}
+
+	badSend, _ := value.NewTupleFromSlice([]value.Value{value.NewInt64Value(0), value.NewInt64Value(1), value.NewEmptyTuple(), value.NewInt64Value(0)})
+	failures := []struct {
+		name  string
+		op    value.Opcode
+		stack []value.Value // top first
+	}{
+		{"jump to an int", code.JUMP, []value.Value{value.NewInt64Value(3)}},
+		{"cjump to an int", code.CJUMP, []value.Value{value.NewInt64Value(3), value.NewInt64Value(1)}},
+		{"send with a tuple amount", code.SEND, []value.Value{badSend}},
+	}
+	for _, tc := range failures {
+		m := vm.NewMachine([]value.Operation{value.BasicOperation{Op: tc.op}}, value.NewInt64Value(0), false, 1<<30)
+		for i := len(tc.stack) - 1; i >= 0; i-- {
+			m.Stack().Push(tc.stack[i])
+		}
+		p, err := Generate(m, testTimeBounds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := decodeStep(p.Data, &p.Context, vm.NewInstructionSet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		top := s.stack.items[len(s.stack.items)-1]
+		if top.Hash() != tc.stack[0].Hash() || isHash(top) {
+			t.Errorf("%v: proof doesn't include the value it failed on", tc.name)
+		}
+		if tup, ok := top.(value.TupleValue); ok {
+			if amount, _ := tup.GetByInt64(2); isHash(amount) {
+				t.Errorf("%v: proof doesn't include the item it failed on", tc.name)
+			}
+		}
+		if err := Verify(p); err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+		}
+	}
+}
+
+func TestProofsRejectFalseClaims(t *testing.T) {
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(2)},
+		value.BasicOperation{Op: code.LOG},
+		value.BasicOperation{Op: code.HALT},
+	}
+	m := vm.NewMachine(insns, value.NewInt64Value(1), false, 100)
+	m.Stack().Push(value.NewInt64Value(3))
+	p, err := Generate(m, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(p); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongAfter := *p
+	wrongAfter.AfterHash[0] ^= 1
+	if Verify(&wrongAfter) == nil {
+		t.Error("verified a wrong after hash")
+	}
+	wrongData := *p
+	wrongData.Data = append([]byte{}, p.Data...)
+	wrongData.Data[len(wrongData.Data)-1] ^= 1
+	if Verify(&wrongData) == nil {
+		t.Error("verified a proof with a changed stack value")
+	}
+	shortData := *p
+	shortData.Data = p.Data[:len(p.Data)-1]
+	if Verify(&shortData) == nil {
+		t.Error("verified a truncated proof")
+	}
+
+	_ = m.ExecuteAssertion(1, testTimeBounds)
+	p, err = Generate(m, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Context.Logs) != 1 {
+		t.Fatalf("log step recorded %v logs", len(p.Context.Logs))
+	}
+	if err := Verify(p); err != nil {
+		t.Fatal(err)
+	}
+	wrongLogs := *p
+	wrongLogs.Context.Logs = nil
+	if Verify(&wrongLogs) == nil {
+		t.Error("verified a step with a missing log")
+	}
+}
+
+func TestErrorPathProofs(t *testing.T) {
+	tup := value.NewTuple2(value.NewInt64Value(1), value.NewInt64Value(2))
+	int64s := func(xs ...int64) []value.Value {
+		vals := make([]value.Value, len(xs))
+		for i, x := range xs {
+			vals[i] = value.NewInt64Value(x)
+		}
+		return vals
+	}
+	newBuffer := func(size int64) value.Value {
+		b, _ := buffer.New(size)
+		return b.Value()
+	}
+	badAmount, _ := value.NewTupleFromSlice([]value.Value{tup, value.NewInt64Value(1), tup, value.NewInt64Value(0)})
+	testCases := []struct {
+		name  string
+		op    value.Operation
+		stack []value.Value // pushed in order
+	}{
+		{"underflow", value.BasicOperation{Op: code.ADD}, int64s(1)},
+		{"underflow with immediate", value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(1)}, nil},
+		{"type mismatch", value.BasicOperation{Op: code.ADD}, []value.Value{value.NewInt64Value(9), value.NewInt64Value(1), tup}},
+		{"second type mismatch", value.BasicOperation{Op: code.MULMOD}, []value.Value{value.NewInt64Value(9), tup, value.NewInt64Value(1)}},
+		{"div by zero", value.BasicOperation{Op: code.DIV}, int64s(9, 0, 1)},
+		{"sdiv by zero", value.BasicOperation{Op: code.SDIV}, int64s(0, 1)},
+		{"mod by zero", value.BasicOperation{Op: code.MOD}, int64s(0, 1)},
+		{"smod by zero", value.ImmediateOperation{Op: code.SMOD, Val: value.NewInt64Value(1)}, int64s(0)},
+		{"addmod by zero", value.BasicOperation{Op: code.ADDMOD}, int64s(0, 1, 2)},
+		{"mulmod by zero", value.BasicOperation{Op: code.MULMOD}, int64s(0, 1, 2)},
+		{"tget index", value.BasicOperation{Op: code.TGET}, []value.Value{tup, value.NewInt64Value(5)}},
+		{"tset index", value.BasicOperation{Op: code.TSET}, []value.Value{value.NewInt64Value(3), tup, value.NewInt64Value(2)}},
+		{"tlen of an int", value.BasicOperation{Op: code.TLEN}, int64s(3)},
+		{"errset to an int", value.BasicOperation{Op: code.ERRSET}, int64s(3)},
+		{"jump to an int", value.BasicOperation{Op: code.JUMP}, int64s(3)},
+		{"cjump to an int", value.BasicOperation{Op: code.CJUMP}, int64s(1, 3)},
+		{"cjump on a tuple", value.BasicOperation{Op: code.CJUMP}, []value.Value{tup, value.NewInt64Value(3)}},
+		{"send of a pair", value.BasicOperation{Op: code.SEND}, []value.Value{tup}},
+		{"send with a tuple amount", value.BasicOperation{Op: code.SEND}, []value.Value{badAmount}},
+		{"nbsend of an int", value.BasicOperation{Op: code.NBSEND}, int64s(3)},
+		{"bufnew too big", value.BasicOperation{Op: code.BUFNEW}, int64s(buffer.MaxSize + 1)},
+		{"buflen of a pair of tuples", value.BasicOperation{Op: code.BUFLEN}, []value.Value{value.NewTuple2(tup, tup)}},
+		{"bufget of an int", value.BasicOperation{Op: code.BUFGET}, int64s(5, 0)},
+		{"bufget of a malformed buffer", value.BasicOperation{Op: code.BUFGET}, []value.Value{value.NewTuple2(value.NewInt64Value(40), tup), value.NewInt64Value(0)}},
+		{"bufset past the end", value.BasicOperation{Op: code.BUFSET}, []value.Value{value.NewInt64Value(1), newBuffer(40), value.NewInt64Value(9)}},
+		{"bufset8 past the end", value.BasicOperation{Op: code.BUFSET8}, []value.Value{value.NewInt64Value(1), newBuffer(40), value.NewInt64Value(40)}},
+		{"bufslice past the end", value.BasicOperation{Op: code.BUFSLICE}, []value.Value{value.NewInt64Value(20), newBuffer(40), value.NewInt64Value(30)}},
+		{"keccak of a pair of tuples", value.BasicOperation{Op: code.KECCAK}, []value.Value{value.NewTuple2(tup, tup)}},
+		{"ecrecover with a short signature", value.BasicOperation{Op: code.ECRECOVER}, []value.Value{value.NewInt64Value(1), newBuffer(64)}},
+		{"invalid opcode", value.BasicOperation{Op: value.Opcode(0xff)}, int64s(3)},
+		{"invalid opcode with immediate", value.ImmediateOperation{Op: value.Opcode(0xff), Val: tup}, nil},
+		{"error instruction", value.BasicOperation{Op: code.ERROR}, int64s(3)},
+	}
+	for _, tc := range testCases {
+		for _, withHandler := range []bool{false, true} {
+			insns := []value.Operation{
+				value.BasicOperation{Op: code.ERRSET},
+				tc.op,
+				value.BasicOperation{Op: code.HALT},
+			}
+			m := vm.NewMachine(insns, value.NewInt64Value(1), false, 100)
+			m.SetWarningHandler(vm.NewSilentWarningHandler())
+			for _, val := range tc.stack {
+				m.Stack().Push(val)
+			}
+			if withHandler {
+				m.Stack().Push(codePoints(insns)[2])
+				_ = m.ExecuteAssertion(1, testTimeBounds)
+			} else {
+				m.IncrPC()
+			}
+
+			p, err := Generate(m, testTimeBounds)
+			if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			if err := Verify(p); err != nil {
+				t.Errorf("%v (handler %v): %v", tc.name, withHandler, err)
+				continue
+			}
+			_ = m.ExecuteAssertion(int32(m.NextStepCost()), testTimeBounds)
+			if p.AfterHash != m.Hash() {
+				t.Errorf("%v (handler %v): proof doesn't end in the machine's state", tc.name, withHandler)
+			}
+			if m.IsErrored() == withHandler {
+				t.Errorf("%v (handler %v): machine didn't fail", tc.name, withHandler)
+			}
+		}
+	}
+}
+
+// tripleSet returns a set with an experimental instruction that triples an
+// integer, and its opcode
+func tripleSet(t *testing.T) (*vm.InstructionSet, value.Opcode) {
+	set := vm.NewInstructionSet()
+	op := value.Opcode(0)
+	for _, ok := set.Lookup(op); ok; _, ok = set.Lookup(op) {
+		op++
+	}
+	triple := func(m *vm.Machine) (vm.StackMods, error) {
+		mods := vm.NewStackMods(1, 1)
+		x, mods, err := vm.PopStackInt(m, mods)
+		if err != nil {
+			return mods, err
+		}
+		mods = vm.PushStackInt(m, mods, value.NewIntValue(new(big.Int).Mul(x.BigInt(), big.NewInt(3))))
+		m.IncrPC()
+		return mods, nil
+	}
+	err := set.Register(vm.InstructionDef{Code: op, Name: "triple", StackPops: []byte{1}, StackPushes: 1, Impl: triple})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set, op
+}
+
+func TestRegisteredInstructionProofs(t *testing.T) {
+	set, tripleOpcode := tripleSet(t)
+	tup := value.NewTuple2(value.NewInt64Value(1), value.NewInt64Value(2))
+	testCases := []struct {
+		name  string
+		op    value.Operation
+		stack []value.Value // pushed in order
+	}{
+		{"triple", value.BasicOperation{Op: tripleOpcode}, []value.Value{tup, value.NewInt64Value(7)}},
+		{"triple with immediate", value.ImmediateOperation{Op: tripleOpcode, Val: value.NewInt64Value(7)}, []value.Value{tup}},
+		{"triple of a tuple", value.BasicOperation{Op: tripleOpcode}, []value.Value{value.NewInt64Value(7), tup}},
+		{"underflow", value.BasicOperation{Op: tripleOpcode}, nil},
+	}
+	for _, tc := range testCases {
+		for _, last := range []bool{false, true} {
+			insns := []value.Operation{tc.op}
+			if !last {
+				insns = append(insns, value.BasicOperation{Op: code.HALT})
+			}
+			m := vm.NewMachine(insns, value.NewInt64Value(1), false, 100, vm.WithInstructionSet(set))
+			m.SetWarningHandler(vm.NewSilentWarningHandler())
+			for _, val := range tc.stack {
+				m.Stack().Push(val)
+			}
+			p, err := Generate(m, testTimeBounds)
+			if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			if err := VerifyWithInstructionSet(p, set); err != nil {
+				t.Errorf("%v (last %v): %v", tc.name, last, err)
+			}
+			if err := Verify(p); err == nil && tc.name == "triple" {
+				t.Errorf("%v: proof verified without the experimental instruction", tc.name)
+			}
+			_ = m.ExecuteAssertion(1, testTimeBounds)
+			if p.AfterHash != m.Hash() {
+				t.Errorf("%v (last %v): proof doesn't end in the machine's state", tc.name, last)
+			}
+		}
+	}
+}
+
+func TestStrictJumpProofs(t *testing.T) {
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.JUMP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	genuine := codePoints(insns)[1]
+	forged := value.CodePointValue{InsnNum: 1, Op: value.BasicOperation{Op: code.NOP}, NextHash: genuine.NextHash}
+	newMachine := func(strict bool, target value.Value) *vm.Machine {
+		m := vm.NewMachine(insns, value.NewInt64Value(1), false, 100)
+		m.SetWarningHandler(vm.NewSilentWarningHandler())
+		m.SetStrictJumps(strict)
+		m.Stack().Push(target)
+		return m
+	}
+
+	if _, err := Generate(newMachine(true, forged), testTimeBounds); err == nil {
+		t.Error("proved a bad jump of a machine with strict jumps")
+	}
+	if _, err := Generate(newMachine(true, genuine), testTimeBounds); err == nil {
+		t.Error("proved a jump of a machine with strict jumps")
+	}
+	p, err := Generate(newMachine(false, genuine), testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(p); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlockedProofs(t *testing.T) {
+	inbox := vm.NewMachine([]value.Operation{value.BasicOperation{Op: code.INBOX}}, value.NewInt64Value(1), false, 100)
+	inbox.Stack().Push(inbox.InboxHash())
+
+	msg, _ := value.NewTupleFromSlice([]value.Value{
+		value.NewEmptyTuple(),
+		value.NewInt64Value(1),
+		value.NewInt64Value(1000),
+		value.NewInt64Value(0),
+	})
+	send := vm.NewMachine([]value.Operation{value.BasicOperation{Op: code.SEND}}, value.NewInt64Value(1), false, 100)
+	send.SetWarningHandler(vm.NewSilentWarningHandler())
+	send.Stack().Push(msg)
+
+	for _, m := range []*vm.Machine{inbox, send} {
+		name := code.InstructionNames[m.GetOperation().GetOp()]
+		p, err := Generate(m, testTimeBounds)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if !p.Context.Blocked || p.Context.DidInboxInsn || len(p.Context.Messages) != 0 {
+			t.Errorf("%v: proof doesn't show the instruction blocking", name)
+		}
+		if p.AfterHash != p.BeforeHash {
+			t.Errorf("%v: blocked instruction changed the machine", name)
+		}
+		if err := Verify(p); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		notBlocked := *p
+		notBlocked.Context.Blocked = false
+		if Verify(&notBlocked) == nil {
+			t.Errorf("%v: verified a blocked step claimed as not blocked", name)
+		}
+	}
+
+	nop := vm.NewMachine([]value.Operation{value.BasicOperation{Op: code.NOP}}, value.NewInt64Value(1), false, 100)
+	p, err := Generate(nop, testTimeBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Context.Blocked = true
+	if Verify(p) == nil {
+		t.Error("verified a NOP claimed as blocked")
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proof
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// Verify checks a one-step proof the way the on-chain verifier does: it
+// rebuilds the before hash from the proof data, executes the instruction on
+// the values in the proof, and checks the resulting hash and outputs against
+// the claimed ones. It doesn't use the vm package's instruction
+// implementations, so a proof that verifies also shows that the vm agrees
+// with the verifier's semantics.
+func Verify(p *OneStepProof) error {
+	return VerifyWithInstructionSet(p, nil)
+}
+
+// VerifyWithInstructionSet is Verify for a machine running set, where nil is
+// the standard set. The verifier has no semantics of its own for the
+// instructions registered in set, so it runs their implementations on the
+// values in the proof. Those must move on to the next instruction, halt, or
+// fail.
+func VerifyWithInstructionSet(p *OneStepProof, set *vm.InstructionSet) error {
+	if set == nil {
+		set = vm.NewInstructionSet()
+	}
+	s, err := decodeStep(p.Data, &p.Context, set)
+	if err != nil {
+		return err
+	}
+	if beforeHash := s.hash(); beforeHash != p.BeforeHash {
+		return Error{fmt.Sprintf("Verify: proof gives before hash %x, claimed %x", beforeHash, p.BeforeHash)}
+	}
+
+	op := s.codePoint.Op.GetOp()
+	def, ok := set.Lookup(op)
+	var impl func(*stepState) error
+	if !ok {
+		// an invalid opcode fails without popping anything, including its
+		// immediate value
+		impl = func(*stepState) error {
+			return failure{fmt.Sprintf("invalid opcode 0x%02x", op)}
+		}
+	} else {
+		if impl, ok = insnImpls[op]; !ok {
+			impl = registeredImpl(def)
+		}
+		if imm, ok := s.codePoint.Op.(value.ImmediateOperation); ok {
+			s.stack.push(imm.Val)
+		}
+	}
+	if err := impl(s); err != nil {
+		if _, ok := err.(failure); !ok {
+			return err
+		}
+		if err := s.fail(len(def.StackPops)); err != nil {
+			return err
+		}
+	}
+
+	if afterHash := s.hash(); afterHash != p.AfterHash {
+		return Error{fmt.Sprintf("Verify: proof gives after hash %x, claimed %x", afterHash, p.AfterHash)}
+	}
+	if s.blocked != p.Context.Blocked {
+		return Error{"Verify: whether the instruction blocked doesn't match the claim"}
+	}
+	if s.didInboxInsn != p.Context.DidInboxInsn {
+		return Error{"Verify: inbox use doesn't match the claim"}
+	}
+	if !hashListsEqual(s.messages, p.Context.Messages) {
+		return Error{"Verify: sent messages don't match the claim"}
+	}
+	if !hashListsEqual(s.logs, p.Context.Logs) {
+		return Error{"Verify: logs don't match the claim"}
+	}
+	return nil
+}
+
+func hashListsEqual(a, b [][32]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeStep reads the machine state out of data written by
+// Machine.MarshalForProof
+func decodeStep(data []byte, ctx *Context, set *vm.InstructionSet) (*stepState, error) {
+	rd := bytes.NewReader(data)
+	var hashes [6][32]byte
+	for i := range hashes {
+		if _, err := io.ReadFull(rd, hashes[i][:]); err != nil {
+			return nil, Error{"Verify: proof is too short"}
+		}
+	}
+	op, err := value.NewOperationFromReader(rd)
+	if err != nil {
+		return nil, Error{fmt.Sprintf("Verify: bad operation in proof: %v", err)}
+	}
+
+	// an instruction that fails or blocks can pop fewer values than its
+	// table entry gives, so the proof includes as many values as it popped
+	def, _ := set.Lookup(op.GetOp())
+	numStackVals := len(def.StackPops)
+	if _, ok := op.(value.ImmediateOperation); ok && numStackVals > 0 {
+		numStackVals--
+	}
+	stackVals := make([]value.Value, 0, numStackVals)
+	for rd.Len() > 0 && len(stackVals) < numStackVals {
+		val, err := value.UnmarshalValue(rd)
+		if err != nil {
+			return nil, Error{fmt.Sprintf("Verify: bad stack value in proof: %v", err)}
+		}
+		stackVals = append(stackVals, val)
+	}
+	// the aux stack values are optional, since popping an empty aux stack
+	// doesn't need one
+	var auxStackVals []value.Value
+	for rd.Len() > 0 && len(auxStackVals) < len(def.AuxStackPops) {
+		val, err := value.UnmarshalValue(rd)
+		if err != nil {
+			return nil, Error{fmt.Sprintf("Verify: bad aux stack value in proof: %v", err)}
+		}
+		auxStackVals = append(auxStackVals, val)
+	}
+	if rd.Len() > 0 {
+		return nil, Error{"Verify: proof has trailing data"}
+	}
+
+	s := &stepState{
+		ctx:        ctx,
+		codePoint:  value.CodePointValue{InsnNum: 0, Op: op, NextHash: hashes[0]},
+		stack:      newProofStack(hashes[1], stackVals),
+		auxstack:   newProofStack(hashes[2], auxStackVals),
+		register:   value.NewHashOnlyValue(hashes[3], 1),
+		static:     value.NewHashOnlyValue(hashes[4], 1),
+		errHandler: value.NewHashOnlyValue(hashes[5], 1),
+		status:     vm.MACHINE_EXTENSIVE,
+	}
+	s.pcHash = s.codePoint.Hash()
+	return s, nil
+}
+
+var emptyTupleHash = value.NewEmptyTuple().Hash()
+
+// proofStack is the top of a stack, as given in a proof, above the hash of
+// the rest of the stack
+type proofStack struct {
+	base   [32]byte
+	items  []value.Value // top last
+	popped int
+}
+
+// newProofStack returns a stack with vals, given top first, above base
+func newProofStack(base [32]byte, vals []value.Value) proofStack {
+	s := proofStack{base, make([]value.Value, 0, len(vals)), 0}
+	for i := len(vals) - 1; i >= 0; i-- {
+		s.push(vals[i])
+	}
+	return s
+}
+
+func (s *proofStack) isEmpty() bool {
+	return len(s.items) == 0 && s.base == emptyTupleHash
+}
+
+func (s *proofStack) push(val value.Value) {
+	s.items = append(s.items, val)
+}
+
+func (s *proofStack) pop() (value.Value, error) {
+	if len(s.items) == 0 {
+		if s.base == emptyTupleHash {
+			return nil, failure{"instruction pops an empty stack"}
+		}
+		return nil, Error{"Verify: proof is missing a stack value"}
+	}
+	val := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	s.popped++
+	return val, nil
+}
+
+// chain returns the stack as a tuple chain ending in the hash of the rest of
+// the stack
+func (s *proofStack) chain() value.Value {
+	var ret value.Value = value.NewHashOnlyValue(s.base, 1)
+	for _, item := range s.items {
+		ret = value.NewTuple2(item, ret)
+	}
+	return ret
+}
+
+// missing reports whether the proof lacks values that an instruction popping
+// pops values would need
+func (s *proofStack) missing(pops int) bool {
+	return len(s.items) < pops && s.base != emptyTupleHash
+}
+
+func (s *proofStack) hash() [32]byte {
+	h := s.base
+	for _, item := range s.items {
+		h = value.NewTuple2(item, value.NewHashOnlyValue(h, 1)).Hash()
+	}
+	return h
+}
+
+// stepState is the part of the machine state that the verifier knows
+type stepState struct {
+	ctx        *Context
+	codePoint  value.CodePointValue
+	stack      proofStack
+	auxstack   proofStack
+	register   value.Value
+	static     value.Value
+	errHandler value.Value
+	pcHash     [32]byte
+	status     vm.MachineStatus
+	blocked    bool
+
+	didInboxInsn bool
+	messages     [][32]byte
+	logs         [][32]byte
+}
+
+func (s *stepState) hash() [32]byte {
+	switch s.status {
+	case vm.MACHINE_HALT:
+		return value.NewInt64Value(0).ToBytes()
+	case vm.MACHINE_ERRORSTOP:
+		return value.NewInt64Value(1).ToBytes()
+	}
+	var ret [32]byte
+	stackHash := s.stack.hash()
+	auxStackHash := s.auxstack.hash()
+	copy(ret[:], solsha3.SoliditySHA3(
+		solsha3.Bytes32(s.pcHash),
+		solsha3.Bytes32(stackHash),
+		solsha3.Bytes32(auxStackHash),
+		solsha3.Bytes32(s.register.Hash()),
+		solsha3.Bytes32(s.static.Hash()),
+		solsha3.Bytes32(s.errHandler.Hash()),
+	))
+	return ret
+}
+
+// incrPC moves to the next instruction, which stops the machine if this was
+// the last one
+func (s *stepState) incrPC() {
+	if s.codePoint.NextHash == vm.HashOfLastInstruction {
+		s.status = vm.MACHINE_ERRORSTOP
+		return
+	}
+	s.pcHash = s.codePoint.NextHash
+}
+
+// jump moves to target. A proof of a jump that succeeds includes only the
+// target's hash; one that fails includes the target, to show it isn't a code
+// point.
+func (s *stepState) jump(target value.Value) error {
+	switch target.(type) {
+	case value.HashOnlyValue, value.CodePointValue:
+	default:
+		return typeMismatch(target)
+	}
+	s.pcHash = target.Hash()
+	return nil
+}
+
+// registeredImpl verifies an instruction registered with an instruction set,
+// by running its implementation on a machine holding the values in the proof
+func registeredImpl(def vm.InstructionDef) func(*stepState) error {
+	return func(s *stepState) error {
+		if s.stack.missing(len(def.StackPops)) || s.auxstack.missing(len(def.AuxStackPops)) {
+			return errMissingValue
+		}
+		program := vm.NewCodeSegment([]value.Operation{s.codePoint.Op, value.BasicOperation{Op: code.HALT}})
+		m, err := vm.RestoreMachineFromCode(program, s.stack.chain(), s.auxstack.chain(), s.register, s.static, program.CodePoint(0), value.ErrorCodePoint, math.MaxInt64, stack.KindTuple)
+		if err != nil {
+			return err
+		}
+		m.SetWarningHandler(vm.NewSilentWarningHandler())
+		rec := &stepRecorder{timeBounds: s.ctx.TimeBounds}
+		m.SetContext(rec)
+		if _, err := def.Impl(m); err != nil {
+			if _, blocked := err.(vm.VMBlockedError); !blocked {
+				return failure{err.Error()}
+			}
+			s.blocked = true
+		}
+
+		s.stack = newProofStack(m.Stack().StateValue().Hash(), nil)
+		s.auxstack = newProofStack(m.AuxStack().StateValue().Hash(), nil)
+		s.register = m.Register().Get()
+		s.messages = append(s.messages, rec.messages...)
+		s.logs = append(s.logs, rec.logs...)
+		pc, _ := m.GetPC().(value.CodePointValue)
+		switch {
+		case m.IsHalted():
+			s.status = vm.MACHINE_HALT
+		case m.IsErrored():
+			s.status = vm.MACHINE_ERRORSTOP
+		case s.blocked:
+		case pc.InsnNum == 1:
+			s.incrPC()
+		default:
+			return Error{fmt.Sprintf("Verify: %v doesn't move on to the next instruction", def.Name)}
+		}
+		return nil
+	}
+}
+
+// fail finishes an instruction that failed after popping some of its values.
+// Like the machine, it pops the rest of the values the instruction would
+// have, stopping at the bottom of the stack, and goes to the error handler.
+func (s *stepState) fail(pops int) error {
+	for s.stack.popped < pops && !s.stack.isEmpty() {
+		if _, err := s.stack.pop(); err != nil {
+			return err
+		}
+	}
+	if s.errHandler.Hash() == value.ErrorCodePoint.Hash() {
+		s.status = vm.MACHINE_ERRORSTOP
+	} else {
+		s.pcHash = s.errHandler.Hash()
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package buffer implements the byte buffers of the buffer instructions, and
+// the keccak hashes and signature recovery over them of KECCAK and ECRECOVER.
+//
+// A buffer is an ordinary value: the pair (size, tree). tree holds the bytes
+// in 32 byte words, each an int whose big-endian bytes are the word. A buffer
+// whose words fit in one has a single int as its tree. Otherwise the tree is
+// a complete tree of 8-tuples of depth d, the least for which 8^d words hold
+// the buffer, with the words in order along its leaves. The words after the
+// buffer's bytes, and the bytes after its size in its last word, are zero.
+//
+// So a buffer hashes like any other value, and a sequence of bytes has only
+// one representation, so two buffers hash the same if and only if they hold
+// the same bytes.
+package buffer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// MaxSize is the largest size a buffer can have. A proof of a buffer
+// instruction includes the whole buffer.
+const MaxSize = 1 << 16
+
+const wordSize = 32
+
+// zeroTrees[d] is the tree of depth d holding only zeros
+var zeroTrees []value.Value
+
+func init() {
+	zeroTrees = []value.Value{value.NewInt64Value(0)}
+	for depth(MaxSize) >= len(zeroTrees) {
+		items := make([]value.Value, 8)
+		for i := range items {
+			items[i] = zeroTrees[len(zeroTrees)-1]
+		}
+		tup, _ := value.NewTupleFromSlice(items)
+		zeroTrees = append(zeroTrees, tup)
+	}
+}
+
+// TypeError means a value isn't a buffer
+type TypeError struct {
+	Value value.Value
+}
+
+func (e TypeError) Error() string {
+	return fmt.Sprintf("not a buffer: %v", e.Value)
+}
+
+// MissingValueError means part of a buffer that was needed was only a hash
+type MissingValueError struct{}
+
+func (e MissingValueError) Error() string {
+	return "buffer is missing a value"
+}
+
+// RangeError means an access went past the end of a buffer, or would have
+// made one too big
+type RangeError struct {
+	Msg string
+}
+
+func (e RangeError) Error() string {
+	return "buffer out of range: " + e.Msg
+}
+
+// badPart returns the error for a part of a buffer that doesn't have the
+// right form
+func badPart(part value.Value, buf value.Value) error {
+	if part.TypeCode() == value.TypeCodeHashOnly {
+		return MissingValueError{}
+	}
+	return TypeError{buf}
+}
+
+// depth returns the depth of the tree of a buffer of the given size
+func depth(size int64) int {
+	words := (size + wordSize - 1) / wordSize
+	d := 0
+	for capacity(d) < words {
+		d++
+	}
+	return d
+}
+
+// capacity returns the number of words a tree of depth d holds
+func capacity(d int) int64 {
+	return 1 << uint(3*d)
+}
+
+// Buffer is a decoded buffer value
+type Buffer struct {
+	size  int64
+	depth int
+	tree  value.Value
+	// the buffer as a value
+	val value.Value
+}
+
+// New returns an empty buffer of the given size
+func New(size int64) (Buffer, error) {
+	if size < 0 || size > MaxSize {
+		return Buffer{}, RangeError{fmt.Sprintf("size %v", size)}
+	}
+	d := depth(size)
+	return newBuffer(size, d, zeroTrees[d]), nil
+}
+
+func newBuffer(size int64, d int, tree value.Value) Buffer {
+	return Buffer{size, d, tree, value.NewTuple2(value.NewInt64Value(size), tree)}
+}
+
+// FromBytes returns a buffer holding data
+func FromBytes(data []byte) (Buffer, error) {
+	size := int64(len(data))
+	if size > MaxSize {
+		return Buffer{}, RangeError{fmt.Sprintf("size %v", size)}
+	}
+	d := depth(size)
+	nodes := make([]value.Value, 0, (size+wordSize-1)/wordSize)
+	for i := int64(0); i < size; i += wordSize {
+		var w [wordSize]byte
+		copy(w[:], data[i:])
+		nodes = append(nodes, wordValue(w))
+	}
+	for level := 0; level < d; level++ {
+		parents := make([]value.Value, (len(nodes)+7)/8)
+		for p := range parents {
+			items := make([]value.Value, 8)
+			for c := range items {
+				if i := p*8 + c; i < len(nodes) {
+					items[c] = nodes[i]
+				} else {
+					items[c] = zeroTrees[level]
+				}
+			}
+			parents[p], _ = value.NewTupleFromSlice(items)
+		}
+		nodes = parents
+	}
+	if len(nodes) == 0 {
+		return newBuffer(size, d, zeroTrees[d]), nil
+	}
+	return newBuffer(size, d, nodes[0]), nil
+}
+
+// DecodeSize reads the size of a buffer out of val, without looking at its
+// tree
+func DecodeSize(val value.Value) (int64, error) {
+	tup, ok := val.(value.TupleValue)
+	if !ok || tup.Len() != 2 {
+		return 0, badPart(val, val)
+	}
+	sizeVal, _ := tup.GetByInt64(0)
+	size, ok := sizeVal.(value.IntValue)
+	if !ok {
+		return 0, badPart(sizeVal, val)
+	}
+	if size.BigInt().Sign() < 0 || !size.BigInt().IsInt64() || size.BigInt().Int64() > MaxSize {
+		return 0, TypeError{val}
+	}
+	return size.BigInt().Int64(), nil
+}
+
+// Decode reads a buffer out of val. The buffer must be in its one
+// representation, so that its hash is unique to its bytes.
+func Decode(val value.Value) (Buffer, error) {
+	n, err := DecodeSize(val)
+	if err != nil {
+		return Buffer{}, err
+	}
+	tree, _ := val.(value.TupleValue).GetByInt64(1)
+	b := Buffer{n, depth(n), tree, val}
+	if err := b.checkTree(tree, b.depth, 0); err != nil {
+		return Buffer{}, err
+	}
+	return b, nil
+}
+
+// checkTree checks that node, a tree of depth level whose first word is word
+// first of the buffer, has the form the buffer's bytes give it
+func (b Buffer) checkTree(node value.Value, level int, first int64) error {
+	words := (b.size + wordSize - 1) / wordSize
+	if first >= words {
+		// past the buffer's bytes, so all zeros
+		if node.Hash() != zeroTrees[level].Hash() {
+			return badPart(node, b.val)
+		}
+		return nil
+	}
+	if level == 0 {
+		leaf, ok := node.(value.IntValue)
+		if !ok || leaf.BigInt().Sign() < 0 || leaf.BigInt().BitLen() > 8*wordSize {
+			return badPart(node, b.val)
+		}
+		// the bytes after the size in the last word are zero
+		w := wordBytes(leaf.BigInt())
+		for i := b.size - first*wordSize; i < wordSize; i++ {
+			if w[i] != 0 {
+				return TypeError{b.val}
+			}
+		}
+		return nil
+	}
+	for c := int64(0); c < 8; c++ {
+		item, err := b.child(node, c)
+		if err != nil {
+			return err
+		}
+		if err := b.checkTree(item, level-1, first+c*capacity(level-1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Value returns the buffer as a value
+func (b Buffer) Value() value.Value {
+	return b.val
+}
+
+// Len returns the size of the buffer in bytes
+func (b Buffer) Len() int64 {
+	return b.size
+}
+
+func wordValue(w [wordSize]byte) value.Value {
+	return value.NewIntValue(new(big.Int).SetBytes(w[:]))
+}
+
+func wordBytes(x *big.Int) [wordSize]byte {
+	var w [wordSize]byte
+	b := x.Bytes()
+	if len(b) > wordSize {
+		b = b[len(b)-wordSize:]
+	}
+	copy(w[wordSize-len(b):], b)
+	return w
+}
+
+// child returns item i of a node of the tree
+func (b Buffer) child(node value.Value, i int64) (value.Value, error) {
+	tup, ok := node.(value.TupleValue)
+	if !ok || tup.Len() != 8 {
+		return nil, badPart(node, b.val)
+	}
+	item, _ := tup.GetByInt64(i)
+	return item, nil
+}
+
+// word returns word i of the tree, which is zero past its capacity
+func (b Buffer) word(i int64) ([wordSize]byte, error) {
+	if i >= capacity(b.depth) {
+		return [wordSize]byte{}, nil
+	}
+	node := b.tree
+	for level := b.depth; level > 0; level-- {
+		var err error
+		node, err = b.child(node, (i/capacity(level-1))%8)
+		if err != nil {
+			return [wordSize]byte{}, err
+		}
+	}
+	leaf, ok := node.(value.IntValue)
+	if !ok {
+		return [wordSize]byte{}, badPart(node, b.val)
+	}
+	return wordBytes(leaf.BigInt()), nil
+}
+
+// setWord returns node, a tree of depth level, with its word i set to w
+func (b Buffer) setWord(node value.Value, level int, i int64, w [wordSize]byte) (value.Value, error) {
+	if level == 0 {
+		if _, ok := node.(value.IntValue); !ok {
+			return nil, badPart(node, b.val)
+		}
+		return wordValue(w), nil
+	}
+	tup, ok := node.(value.TupleValue)
+	if !ok || tup.Len() != 8 {
+		return nil, badPart(node, b.val)
+	}
+	c := (i / capacity(level-1)) % 8
+	item, _ := tup.GetByInt64(c)
+	newItem, err := b.setWord(item, level-1, i, w)
+	if err != nil {
+		return nil, err
+	}
+	return tup.SetByInt64(c, newItem)
+}
+
+// readBytes returns the n bytes at offset, which must be in the buffer
+func (b Buffer) readBytes(offset int64, n int64) ([]byte, error) {
+	if n == 0 {
+		return []byte{}, nil
+	}
+	ret := make([]byte, 0, n+2*wordSize)
+	for i := offset / wordSize; i*wordSize < offset+n; i++ {
+		w, err := b.word(i)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, w[:]...)
+	}
+	start := offset % wordSize
+	return ret[start : start+n], nil
+}
+
+// writeBytes returns the buffer with data written at offset, which must be
+// in the buffer along with the rest of data
+func (b Buffer) writeBytes(offset int64, data []byte) (Buffer, error) {
+	first := offset / wordSize
+	last := (offset + int64(len(data)) - 1) / wordSize
+	words, err := b.readBytes(first*wordSize, (last-first+1)*wordSize)
+	if err != nil {
+		return Buffer{}, err
+	}
+	copy(words[offset%wordSize:], data)
+	tree := b.tree
+	for i := first; i <= last; i++ {
+		var w [wordSize]byte
+		copy(w[:], words[(i-first)*wordSize:])
+		tree, err = b.setWord(tree, b.depth, i, w)
+		if err != nil {
+			return Buffer{}, err
+		}
+	}
+	return newBuffer(b.size, b.depth, tree), nil
+}
+
+// checkRange returns the offset and length of n bytes at offset, if they are
+// in the buffer
+func (b Buffer) checkRange(offset *big.Int, n *big.Int) (int64, int64, error) {
+	if offset.Sign() < 0 || n.Sign() < 0 || offset.Cmp(big.NewInt(b.size)) > 0 || n.Cmp(big.NewInt(b.size-offset.Int64())) > 0 {
+		return 0, 0, RangeError{fmt.Sprintf("%v bytes at %v, in a buffer of size %v", n, offset, b.size)}
+	}
+	return offset.Int64(), n.Int64(), nil
+}
+
+// Bytes returns the bytes in the buffer
+func (b Buffer) Bytes() ([]byte, error) {
+	return b.readBytes(0, b.size)
+}
+
+// Read returns the 32 bytes at offset as a big-endian int. Bytes past the end
+// of the buffer read as zero.
+func (b Buffer) Read(offset *big.Int) (*big.Int, error) {
+	if offset.Sign() < 0 || !offset.IsInt64() || offset.Int64() >= b.size {
+		return new(big.Int), nil
+	}
+	data, err := b.readBytes(offset.Int64(), wordSize)
+	if err != nil {
+		return nil, err
+	}
+	for i := b.size - offset.Int64(); i < wordSize; i++ {
+		data[i] = 0
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Write returns the buffer with the 32 big-endian bytes of word written at
+// offset. They must all be in the buffer.
+func (b Buffer) Write(offset *big.Int, word *big.Int) (Buffer, error) {
+	off, _, err := b.checkRange(offset, big.NewInt(wordSize))
+	if err != nil {
+		return Buffer{}, err
+	}
+	w := wordBytes(word)
+	return b.writeBytes(off, w[:])
+}
+
+// Write8 returns the buffer with the low byte of x written at offset
+func (b Buffer) Write8(offset *big.Int, x *big.Int) (Buffer, error) {
+	off, _, err := b.checkRange(offset, big.NewInt(1))
+	if err != nil {
+		return Buffer{}, err
+	}
+	w := wordBytes(x)
+	return b.writeBytes(off, w[wordSize-1:])
+}
+
+// Slice returns a new buffer holding the n bytes at offset
+func (b Buffer) Slice(offset *big.Int, n *big.Int) (Buffer, error) {
+	off, length, err := b.checkRange(offset, n)
+	if err != nil {
+		return Buffer{}, err
+	}
+	data, err := b.readBytes(off, length)
+	if err != nil {
+		return Buffer{}, err
+	}
+	return FromBytes(data)
+}
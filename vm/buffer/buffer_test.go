@@ -0,0 +1,232 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buffer
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/offchainlabs/arb-util/value"
+)
+
+var testSizes = []int{0, 1, 31, 32, 33, 64, 255, 256, 257, 1000, 2048, 2049}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	r.Read(data)
+	return data
+}
+
+func mustFromBytes(t *testing.T, data []byte) Buffer {
+	b, err := FromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFromBytes(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range testSizes {
+		data := randomBytes(r, n)
+		b := mustFromBytes(t, data)
+		if b.Len() != int64(n) {
+			t.Errorf("size %v: buffer has size %v", n, b.Len())
+		}
+		got, err := b.Bytes()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %v: buffer holds different bytes: %v", n, err)
+		}
+		decoded, err := Decode(b.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := decoded.Bytes(); !bytes.Equal(got, data) {
+			t.Errorf("size %v: decoded buffer holds different bytes", n)
+		}
+	}
+
+	if _, err := FromBytes(make([]byte, MaxSize+1)); err == nil {
+		t.Error("made a buffer larger than MaxSize")
+	}
+	if _, err := New(MaxSize + 1); err == nil {
+		t.Error("made an empty buffer larger than MaxSize")
+	}
+}
+
+// TestCanonical checks that buffers holding the same bytes hash the same,
+// however they were made
+func TestCanonical(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for _, n := range testSizes {
+		data := randomBytes(r, n)
+		want := mustFromBytes(t, data)
+
+		b, err := New(int64(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := n - 1; i >= 0; i-- {
+			b, err = b.Write8(big.NewInt(int64(i)), big.NewInt(int64(data[i])))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.Value().Hash() != want.Value().Hash() {
+			t.Errorf("size %v: buffer written byte by byte hashes differently", n)
+		}
+
+		padded := mustFromBytes(t, append(randomBytes(r, 7), append(data, randomBytes(r, 40)...)...))
+		slice, err := padded.Slice(big.NewInt(7), big.NewInt(int64(n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slice.Value().Hash() != want.Value().Hash() {
+			t.Errorf("size %v: slice hashes differently", n)
+		}
+	}
+
+	empty, _ := New(100)
+	if empty.Value().Hash() != mustFromBytes(t, make([]byte, 100)).Value().Hash() {
+		t.Error("empty buffer hashes differently from a buffer of zeros")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for _, n := range testSizes {
+		data := randomBytes(r, n)
+		b := mustFromBytes(t, data)
+		for _, offset := range []int{0, 1, n / 2, n - 33, n - 32, n - 31, n - 1, n, n + 5} {
+			if offset < 0 {
+				continue
+			}
+			want := make([]byte, 32)
+			if offset < n {
+				copy(want, data[offset:])
+			}
+			got, err := b.Read(big.NewInt(int64(offset)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Cmp(new(big.Int).SetBytes(want)) != 0 {
+				t.Errorf("size %v: read at %v gave %x, expected %x", n, offset, got, want)
+			}
+
+			word := randomBytes(r, 32)
+			written, err := b.Write(big.NewInt(int64(offset)), new(big.Int).SetBytes(word))
+			if offset+32 > n {
+				if _, ok := err.(RangeError); !ok {
+					t.Errorf("size %v: write at %v gave %v", n, offset, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantData := append([]byte{}, data...)
+			copy(wantData[offset:], word)
+			if written.Value().Hash() != mustFromBytes(t, wantData).Value().Hash() {
+				t.Errorf("size %v: write at %v gave the wrong buffer", n, offset)
+			}
+			if b.Value().Hash() != mustFromBytes(t, data).Value().Hash() {
+				t.Fatalf("size %v: write changed the original buffer", n)
+			}
+		}
+	}
+
+	b := mustFromBytes(t, make([]byte, 10))
+	huge := new(big.Int).Lsh(big.NewInt(1), 200)
+	if got, err := b.Read(huge); err != nil || got.Sign() != 0 {
+		t.Errorf("read far past the end gave %v, %v", got, err)
+	}
+	rangeErrors := map[string]func() error{
+		"write8 at the end":      func() error { _, err := b.Write8(big.NewInt(10), big.NewInt(1)); return err },
+		"write far past the end": func() error { _, err := b.Write(huge, big.NewInt(1)); return err },
+		"slice past the end":     func() error { _, err := b.Slice(big.NewInt(5), big.NewInt(6)); return err },
+		"huge slice":             func() error { _, err := b.Slice(big.NewInt(5), huge); return err },
+	}
+	for name, f := range rangeErrors {
+		if _, ok := f().(RangeError); !ok {
+			t.Errorf("%v didn't give a range error", name)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	b := mustFromBytes(t, make([]byte, 100))
+	tup := value.NewTuple2(value.NewInt64Value(1), value.NewInt64Value(2))
+	triple, _ := value.NewTupleFromSlice([]value.Value{value.NewInt64Value(1), value.NewInt64Value(2), value.NewInt64Value(3)})
+	typeErrors := map[string]value.Value{
+		"int":            value.NewInt64Value(3),
+		"triple":         triple,
+		"tuple size":     value.NewTuple2(tup, value.NewInt64Value(0)),
+		"too big":        value.NewTuple2(value.NewInt64Value(MaxSize+1), value.NewInt64Value(0)),
+		"malformed tree": value.NewTuple2(value.NewInt64Value(100), tup),
+	}
+	for name, val := range typeErrors {
+		if _, err := Decode(val); err == nil {
+			t.Errorf("%v: decoded", name)
+		} else if _, ok := err.(TypeError); !ok {
+			t.Errorf("%v: got %v", name, err)
+		}
+	}
+
+	tree := value.NewHashOnlyValueFromValue(b.Value().(value.TupleValue).Contents()[1])
+	hidden := value.NewTuple2(value.NewInt64Value(100), tree)
+	if _, err := Decode(hidden); err != (MissingValueError{}) {
+		t.Errorf("decode of a hash only tree gave %v", err)
+	}
+	if size, err := DecodeSize(hidden); err != nil || size != 100 {
+		t.Errorf("buffer with a hash only tree has size %v, %v", size, err)
+	}
+}
+
+func TestDecodeNonCanonical(t *testing.T) {
+	word := func(x int64) value.Value {
+		return value.NewInt64Value(x)
+	}
+	node := func(items ...value.Value) value.Value {
+		for len(items) < 8 {
+			items = append(items, word(0))
+		}
+		tup, _ := value.NewTupleFromSlice(items)
+		return tup
+	}
+	buf := func(size int64, tree value.Value) value.Value {
+		return value.NewTuple2(value.NewInt64Value(size), tree)
+	}
+	one := mustFromBytes(t, []byte{1})
+	if _, err := Decode(one.Value()); err != nil {
+		t.Fatal(err)
+	}
+	nonCanonical := map[string]value.Value{
+		// the bytes {1} as they should be, but in a tree one level too deep
+		"too deep": buf(1, node(one.Value().(value.TupleValue).Contents()[1])),
+		// 40 bytes need two words, so a tree of depth 1
+		"too shallow":        buf(40, word(5)),
+		"byte past the size": buf(1, value.NewIntValue(new(big.Int).Lsh(big.NewInt(3), 8*30))),
+		"word past the size": buf(40, node(word(1), word(0), word(7))),
+	}
+	for name, val := range nonCanonical {
+		if _, err := Decode(val); err == nil {
+			t.Errorf("%v: decoded", name)
+		}
+	}
+}
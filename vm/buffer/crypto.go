@@ -0,0 +1,62 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buffer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SignatureSize is the size of a signature for Ecrecover
+const SignatureSize = 65
+
+// Keccak returns the keccak256 hash of the bytes in the buffer, as a
+// big-endian int
+func (b Buffer) Keccak() (*big.Int, error) {
+	data, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(crypto.Keccak256(data)), nil
+}
+
+// Ecrecover returns the address of the secp256k1 key that signed hash, as
+// Ethereum's ecrecover does. sig is the 65 bytes r, s, v, with v 27 or 28. An
+// invalid signature, or one no key made, gives address zero.
+func Ecrecover(hash *big.Int, sig Buffer) (*big.Int, error) {
+	if sig.Len() != SignatureSize {
+		return nil, RangeError{fmt.Sprintf("signature of size %v, rather than %v", sig.Len(), SignatureSize)}
+	}
+	data, err := sig.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	r := new(big.Int).SetBytes(data[:32])
+	s := new(big.Int).SetBytes(data[32:64])
+	v := data[64] - 27
+	if data[64] < 27 || !crypto.ValidateSignatureValues(v, r, s, false) {
+		return new(big.Int), nil
+	}
+	h := wordBytes(hash)
+	pub, err := crypto.Ecrecover(h[:], append(data[:64:64], v))
+	if err != nil {
+		return new(big.Int), nil
+	}
+	return new(big.Int).SetBytes(crypto.Keccak256(pub[1:])[12:]), nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buffer
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func hexBytes(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func hexInt(t *testing.T, s string) *big.Int {
+	return new(big.Int).SetBytes(hexBytes(t, s))
+}
+
+func TestKeccak(t *testing.T) {
+	vectors := []struct {
+		data string
+		hash string
+	}{
+		{"", "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"},
+		{"abc", "4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45"},
+		{"The quick brown fox jumps over the lazy dog", "4d741b6f1eb29cb2a9b9911c82f56fa8d73b04959d3d9d222895df6c0b28aa15"},
+	}
+	for _, v := range vectors {
+		got, err := mustFromBytes(t, []byte(v.data)).Keccak()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Cmp(hexInt(t, v.hash)) != 0 {
+			t.Errorf("keccak of %q is %x, expected %v", v.data, got, v.hash)
+		}
+	}
+
+	// the hash covers the buffer's size, not the padding after it
+	zeros, _ := New(40)
+	want, _ := mustFromBytes(t, make([]byte, 40)).Keccak()
+	if got, err := zeros.Keccak(); err != nil || got.Cmp(want) != 0 {
+		t.Errorf("keccak of an empty buffer is %x, expected %x", got, want)
+	}
+	if shorter, _ := mustFromBytes(t, make([]byte, 39)).Keccak(); shorter.Cmp(want) == 0 {
+		t.Error("buffers of different sizes have the same keccak")
+	}
+}
+
+func TestEcrecover(t *testing.T) {
+	vectors := []struct {
+		name string
+		hash string
+		sig  string // r, s, v
+		addr string // zero for an invalid signature
+	}{
+		{
+			"ecrecover precompile",
+			"38d18acb67d25c8bb9942764b62f18e17054f66a817bd4295423adf9ed98873e",
+			"38d18acb67d25c8bb9942764b62f18e17054f66a817bd4295423adf9ed98873e789d1dd423d25f0772d2748d60f7e4b81bb14d086eba8e8e8efb6dcff8a4ae021b",
+			"ceaccac640adf55b2028469bd36ba501f28b699d",
+		},
+		{
+			"v of 28",
+			"ce0677bb30baa8cf067c88db9811f4333d131bf8bcf12fe7065d211dce971008",
+			"90f27b8b488db00b00606796d2987f6a5f59ae62ea05effe84fef5b8b0e549984a691139ad57a3f0b906637673aa2f63d1f55cb1a69199d4009eea23ceaddc931c",
+			"a19d069d48d2e9392ec2bb41ecab0a72119d633b",
+		},
+		{
+			"v of 1",
+			"ce0677bb30baa8cf067c88db9811f4333d131bf8bcf12fe7065d211dce971008",
+			"90f27b8b488db00b00606796d2987f6a5f59ae62ea05effe84fef5b8b0e549984a691139ad57a3f0b906637673aa2f63d1f55cb1a69199d4009eea23ceaddc9301",
+			"00",
+		},
+		{
+			"v of 29",
+			"ce0677bb30baa8cf067c88db9811f4333d131bf8bcf12fe7065d211dce971008",
+			"90f27b8b488db00b00606796d2987f6a5f59ae62ea05effe84fef5b8b0e549984a691139ad57a3f0b906637673aa2f63d1f55cb1a69199d4009eea23ceaddc931d",
+			"00",
+		},
+		{
+			"zero r",
+			"ce0677bb30baa8cf067c88db9811f4333d131bf8bcf12fe7065d211dce971008",
+			"00000000000000000000000000000000000000000000000000000000000000004a691139ad57a3f0b906637673aa2f63d1f55cb1a69199d4009eea23ceaddc931c",
+			"00",
+		},
+		{
+			"s of the curve order",
+			"ce0677bb30baa8cf067c88db9811f4333d131bf8bcf12fe7065d211dce971008",
+			"90f27b8b488db00b00606796d2987f6a5f59ae62ea05effe84fef5b8b0e54998fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd03641411c",
+			"00",
+		},
+	}
+	for _, v := range vectors {
+		got, err := Ecrecover(hexInt(t, v.hash), mustFromBytes(t, hexBytes(t, v.sig)))
+		if err != nil {
+			t.Fatalf("%v: %v", v.name, err)
+		}
+		if got.Cmp(hexInt(t, v.addr)) != 0 {
+			t.Errorf("%v: recovered %x, expected %v", v.name, got, v.addr)
+		}
+	}
+
+	for _, size := range []int{0, 64, 66} {
+		sig := mustFromBytes(t, make([]byte, size))
+		if _, err := Ecrecover(big.NewInt(1), sig); err == nil {
+			t.Errorf("recovered from a signature of size %v", size)
+		} else if _, ok := err.(RangeError); !ok {
+			t.Errorf("signature of size %v gave %v", size, err)
+		}
+	}
+}
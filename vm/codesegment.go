@@ -0,0 +1,306 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// CodeSegment is a program along with the hashes of its code points. It is
+// never changed once built, so machines share it rather than copying it: a
+// clone runs the same code segment as its original. Like values, it can be
+// read from several goroutines at once.
+//
+// It keeps the hash of every frequency-th code point, and hashes the rest
+// from the next one it keeps, so finding a code point's hash takes up to
+// frequency-1 hashes. A frequency of 1 keeps them all.
+type CodeSegment struct {
+	insns     []value.Operation
+	frequency int64
+	// hashes of code points 0, frequency, 2*frequency, ...
+	savedHashes [][32]byte
+	// if not nil, the hashes of code points that have been looked up, as
+	// [32]byte, filled in as they are
+	lazyHashes []atomic.Value
+}
+
+// NewCodeSegment builds the code segment for insns, which it copies, keeping
+// every CodeSaveFrequency-th hash
+func NewCodeSegment(insns []value.Operation) *CodeSegment {
+	return NewCodeSegmentWithFrequency(insns, CodeSaveFrequency, false)
+}
+
+// NewCodeSegmentWithFrequency builds the code segment for insns, keeping the
+// hash of every frequency-th code point. A frequency below 1 is taken as 1.
+// If lazy is set, it also keeps the hash of each code point once it has been
+// looked up, so hashing the code points a machine keeps coming back to is
+// free after the first time, at the cost of 48 bytes per instruction.
+func NewCodeSegmentWithFrequency(insns []value.Operation, frequency int64, lazy bool) *CodeSegment {
+	if frequency < 1 {
+		frequency = 1
+	}
+	return newCodeSegment(insns, frequency, hashCodePoints(insns, frequency), lazy)
+}
+
+// newCodeSegment builds the code segment for insns from the hashes
+// hashCodePoints kept for it
+func newCodeSegment(insns []value.Operation, frequency int64, savedHashes [][32]byte, lazy bool) *CodeSegment {
+	flat := make([]value.Operation, len(insns))
+	copy(flat, insns)
+	c := &CodeSegment{flat, frequency, savedHashes, nil}
+	if lazy {
+		c.lazyHashes = make([]atomic.Value, len(insns))
+	}
+	return c
+}
+
+// hashCodePoints hashes the code points of insns, returning the hashes of
+// code points 0, frequency, 2*frequency, ...
+func hashCodePoints(insns []value.Operation, frequency int64) [][32]byte {
+	savedHashes := make([][32]byte, (int64(len(insns))+frequency-1)/frequency)
+	prevHash := HashOfLastInstruction
+	for i := int64(len(insns) - 1); i >= 0; i-- {
+		prevHash = value.CodePointValue{InsnNum: i, Op: insns[i], NextHash: prevHash}.Hash()
+		if i%frequency == 0 {
+			savedHashes[i/frequency] = prevHash
+		}
+	}
+	return savedHashes
+}
+
+// programHash returns the hash of a program given the hashes hashCodePoints
+// kept for it
+func programHash(savedHashes [][32]byte) [32]byte {
+	if len(savedHashes) == 0 {
+		return HashOfLastInstruction
+	}
+	return savedHashes[0]
+}
+
+// ProgramHash returns the hash of insns, the same as the Hash of its code
+// segment, without building one. Hashing a program once and loading it with
+// LoadCodeSegmentWithHash after that skips hashing it on every load.
+func ProgramHash(insns []value.Operation) [32]byte {
+	return programHash(hashCodePoints(insns, CodeSaveFrequency))
+}
+
+// Len returns the number of instructions in the program
+func (c *CodeSegment) Len() int64 {
+	return int64(len(c.insns))
+}
+
+// Frequency returns how often the code segment keeps a code point's hash
+func (c *CodeSegment) Frequency() int64 {
+	return c.frequency
+}
+
+// Op returns the instruction at index i
+func (c *CodeSegment) Op(i int64) value.Operation {
+	return c.insns[i]
+}
+
+// Operations returns a copy of the program
+func (c *CodeSegment) Operations() []value.Operation {
+	ret := make([]value.Operation, len(c.insns))
+	copy(ret, c.insns)
+	return ret
+}
+
+// CodePointHash returns the hash of the code point of the instruction at
+// index i. Index Len, just past the end, has HashOfLastInstruction.
+func (c *CodeSegment) CodePointHash(i int64) [32]byte {
+	if i%c.frequency == 0 && i < c.Len() {
+		return c.savedHashes[i/c.frequency]
+	}
+	if c.lazyHashes != nil && i < c.Len() {
+		if h, ok := c.lazyHashes[i].Load().([32]byte); ok {
+			return h
+		}
+	}
+
+	// hash down from the next code point whose hash is kept
+	next := (i/c.frequency + 1) * c.frequency
+	hash := HashOfLastInstruction
+	if next < c.Len() {
+		hash = c.savedHashes[next/c.frequency]
+	} else {
+		next = c.Len()
+	}
+	for j := next - 1; j >= i; j-- {
+		hash = value.CodePointValue{InsnNum: j, Op: c.insns[j], NextHash: hash}.Hash()
+	}
+	if c.lazyHashes != nil && i < c.Len() {
+		c.lazyHashes[i].Store(hash)
+	}
+	return hash
+}
+
+// CodePoint returns the code point of the instruction at index i
+func (c *CodeSegment) CodePoint(i int64) value.CodePointValue {
+	return value.CodePointValue{InsnNum: i, Op: c.insns[i], NextHash: c.CodePointHash(i + 1)}
+}
+
+// Hash returns the hash of the program, which is the hash of the code point
+// of its first instruction
+func (c *CodeSegment) Hash() [32]byte {
+	return c.CodePointHash(0)
+}
+
+// Equal reports whether two code segments hold the same program
+func (c *CodeSegment) Equal(y *CodeSegment) bool {
+	return c == y || (c.Len() == y.Len() && c.Hash() == y.Hash())
+}
+
+// DefaultCodeSegmentCacheSize is how many code segments the cache that
+// LoadCodeSegment uses keeps
+const DefaultCodeSegmentCacheSize = 64
+
+// CodeSegmentCache keeps the code segments of the programs most recently
+// loaded, by their hash, so that machines running the same program share
+// one. Once it holds its capacity it forgets the least recently used.
+type CodeSegmentCache struct {
+	sync.Mutex
+	capacity int
+	byHash   map[[32]byte]*list.Element
+	// the cached code segments, most recently used first
+	order *list.List
+}
+
+// NewCodeSegmentCache returns an empty cache that keeps up to capacity code
+// segments. A capacity below 1 is taken as 1.
+func NewCodeSegmentCache(capacity int) *CodeSegmentCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &CodeSegmentCache{capacity: capacity, byHash: make(map[[32]byte]*list.Element), order: list.New()}
+}
+
+// Len returns the number of code segments in the cache
+func (cc *CodeSegmentCache) Len() int {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.order.Len()
+}
+
+func (cc *CodeSegmentCache) get(hash [32]byte, length int) (*CodeSegment, bool) {
+	e, ok := cc.byHash[hash]
+	if !ok {
+		return nil, false
+	}
+	c := e.Value.(*CodeSegment)
+	if length >= 0 && c.Len() != int64(length) {
+		return nil, false
+	}
+	cc.order.MoveToFront(e)
+	return c, true
+}
+
+func (cc *CodeSegmentCache) add(hash [32]byte, c *CodeSegment) *CodeSegment {
+	if e, ok := cc.byHash[hash]; ok {
+		cc.order.Remove(e)
+	}
+	cc.byHash[hash] = cc.order.PushFront(c)
+	for cc.order.Len() > cc.capacity {
+		last := cc.order.Back()
+		cc.order.Remove(last)
+		delete(cc.byHash, last.Value.(*CodeSegment).Hash())
+	}
+	return c
+}
+
+// Load returns the cached code segment for insns. If there isn't one, it
+// builds one and caches it. It hashes insns once, and only copies them if it
+// builds a code segment.
+func (cc *CodeSegmentCache) Load(insns []value.Operation) *CodeSegment {
+	savedHashes := hashCodePoints(insns, CodeSaveFrequency)
+	hash := programHash(savedHashes)
+	cc.Lock()
+	defer cc.Unlock()
+	if c, ok := cc.get(hash, len(insns)); ok {
+		return c
+	}
+	return cc.add(hash, newCodeSegment(insns, CodeSaveFrequency, savedHashes, false))
+}
+
+// LoadWithHash returns the cached code segment with the given hash, which
+// must be the ProgramHash of insns. If there isn't one, it builds one from
+// insns and caches it, and returns an error if insns have a different hash.
+// Loading a cached program this way doesn't touch insns.
+func (cc *CodeSegmentCache) LoadWithHash(hash [32]byte, insns []value.Operation) (*CodeSegment, error) {
+	cc.Lock()
+	defer cc.Unlock()
+	if c, ok := cc.get(hash, len(insns)); ok {
+		return c, nil
+	}
+	savedHashes := hashCodePoints(insns, CodeSaveFrequency)
+	if got := programHash(savedHashes); got != hash {
+		return nil, fmt.Errorf("program hash is %x, not %x", got, hash)
+	}
+	return cc.add(hash, newCodeSegment(insns, CodeSaveFrequency, savedHashes, false)), nil
+}
+
+// Get returns the cached code segment with the given hash, if there is one.
+// Starting a machine from it doesn't touch the program.
+func (cc *CodeSegmentCache) Get(hash [32]byte) (*CodeSegment, bool) {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.get(hash, -1)
+}
+
+// Forget removes the code segment with the given hash from the cache.
+// Machines already running it keep it.
+func (cc *CodeSegmentCache) Forget(hash [32]byte) {
+	cc.Lock()
+	defer cc.Unlock()
+	if e, ok := cc.byHash[hash]; ok {
+		cc.order.Remove(e)
+		delete(cc.byHash, hash)
+	}
+}
+
+// codeSegments is the cache that the machine constructors load programs
+// through
+var codeSegments = NewCodeSegmentCache(DefaultCodeSegmentCacheSize)
+
+// LoadCodeSegment returns the code segment for insns from the cache the
+// machine constructors share, building and caching it if it isn't there
+func LoadCodeSegment(insns []value.Operation) *CodeSegment {
+	return codeSegments.Load(insns)
+}
+
+// LoadCodeSegmentWithHash is LoadCodeSegment for a program whose
+// ProgramHash is already known. It doesn't hash a cached program again.
+func LoadCodeSegmentWithHash(hash [32]byte, insns []value.Operation) (*CodeSegment, error) {
+	return codeSegments.LoadWithHash(hash, insns)
+}
+
+// CodeSegmentByHash returns the code segment with the given hash from the
+// cache the machine constructors share, if it is there
+func CodeSegmentByHash(hash [32]byte) (*CodeSegment, bool) {
+	return codeSegments.Get(hash)
+}
+
+// ForgetCodeSegment removes the code segment with the given hash from the
+// cache the machine constructors share. Machines already running it keep it.
+func ForgetCodeSegment(hash [32]byte) {
+	codeSegments.Forget(hash)
+}
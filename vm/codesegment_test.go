@@ -0,0 +1,214 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestCodeSegmentCache(t *testing.T) {
+	insns := append(inboxLoopMachine().GetAllOperations(), value.BasicOperation{Op: code.NOP})
+	m := NewMachine(insns, value.NewInt64Value(1), false, 1000)
+	other := NewMachineWithStackKind(insns, value.NewInt64Value(1), false, 1000, stack.KindPersistent)
+	if m.CodeSegment() != other.CodeSegment() {
+		t.Error("machines running the same program don't share its code segment")
+	}
+
+	c, ok := CodeSegmentByHash(m.CodeHash())
+	if !ok || c != m.CodeSegment() {
+		t.Fatal("code segment isn't cached by its hash")
+	}
+	fromCode := NewMachineFromCode(c, value.NewInt64Value(1), false, 1000, stack.KindFlat)
+	if fromCode.Hash() != m.Hash() {
+		t.Error("machine started from the cached code segment has a different hash")
+	}
+	tb := protocol.NewTimeBounds(0, 100)
+	if a, b := m.ExecuteAssertion(30, tb), fromCode.ExecuteAssertion(30, tb); a.AfterHash != b.AfterHash || a.NumSteps != b.NumSteps {
+		t.Error("machine started from the cached code segment ran differently")
+	}
+
+	ForgetCodeSegment(m.CodeHash())
+	if _, ok := CodeSegmentByHash(m.CodeHash()); ok {
+		t.Error("forgotten code segment is still cached")
+	}
+	reloaded := NewMachine(insns, value.NewInt64Value(1), false, 1000)
+	if reloaded.CodeSegment() == m.CodeSegment() || !reloaded.CodeSegment().Equal(m.CodeSegment()) {
+		t.Error("program wasn't rebuilt after its code segment was forgotten")
+	}
+	if _, ok := CodeSegmentByHash([32]byte{1}); ok {
+		t.Error("found a code segment for an unknown hash")
+	}
+}
+
+func TestCodeSegmentCacheEviction(t *testing.T) {
+	cc := NewCodeSegmentCache(2)
+	programs := [][]value.Operation{codeSegmentProgram(3), codeSegmentProgram(4), codeSegmentProgram(5)}
+	hashes := make([][32]byte, len(programs))
+	for i, insns := range programs {
+		hashes[i] = ProgramHash(insns)
+		if hashes[i] != NewCodeSegment(insns).Hash() {
+			t.Errorf("program %v: ProgramHash differs from its code segment's hash", i)
+		}
+	}
+
+	first := cc.Load(programs[0])
+	if c, err := cc.LoadWithHash(hashes[0], programs[0]); err != nil || c != first {
+		t.Error("loading a cached program by its hash didn't return its code segment")
+	}
+	if _, err := cc.LoadWithHash(hashes[2], programs[1]); err == nil {
+		t.Error("loaded a program under another program's hash")
+	}
+
+	cc.Load(programs[1])
+	// program 0 was used more recently than program 1, so program 1 goes
+	cc.Get(hashes[0])
+	cc.Load(programs[2])
+	if cc.Len() != 2 {
+		t.Errorf("cache holds %v code segments, beyond its capacity of 2", cc.Len())
+	}
+	if _, ok := cc.Get(hashes[1]); ok {
+		t.Error("least recently used code segment wasn't evicted")
+	}
+	if c, ok := cc.Get(hashes[0]); !ok || c != first {
+		t.Error("recently used code segment was evicted")
+	}
+	if _, ok := cc.Get(hashes[2]); !ok {
+		t.Error("newly loaded code segment isn't cached")
+	}
+	if c, err := cc.LoadWithHash(hashes[1], programs[1]); err != nil || c.Hash() != hashes[1] {
+		t.Error("evicted program wasn't rebuilt")
+	}
+}
+
+// codeSegmentProgram returns a program of n instructions, some of them with
+// immediate values
+func codeSegmentProgram(n int) []value.Operation {
+	insns := make([]value.Operation, n)
+	for i := range insns {
+		if i%2 == 0 {
+			insns[i] = value.ImmediateOperation{Op: code.NOP, Val: value.NewInt64Value(int64(i))}
+		} else {
+			insns[i] = value.BasicOperation{Op: code.POP}
+		}
+	}
+	return insns
+}
+
+func TestCodeSegmentFrequency(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 5, 17, 64} {
+		insns := codeSegmentProgram(n)
+		full := NewCodeSegmentWithFrequency(insns, 1, false)
+		for _, freq := range []int64{0, 1, 2, 3, 7, 16, 64, 100} {
+			for _, lazy := range []bool{false, true} {
+				c := NewCodeSegmentWithFrequency(insns, freq, lazy)
+				if c.Hash() != full.Hash() {
+					t.Errorf("%v instructions, frequency %v, lazy %v: code hash differs", n, freq, lazy)
+				}
+				// twice, for the lazily kept hashes
+				for pass := 0; pass < 2; pass++ {
+					for i := int64(0); i < int64(n); i++ {
+						if c.CodePoint(i) != full.CodePoint(i) || c.CodePointHash(i) != full.CodePointHash(i) {
+							t.Fatalf("%v instructions, frequency %v, lazy %v: code point %v differs", n, freq, lazy, i)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	insns := codeSegmentProgram(20)
+	m := NewMachineFromCode(NewCodeSegmentWithFrequency(insns, 7, true), value.NewInt64Value(1), false, 1000, stack.KindFlat)
+	want := NewMachine(insns, value.NewInt64Value(1), false, 1000)
+	tb := protocol.NewTimeBounds(0, 100)
+	for i := 0; i < 20; i++ {
+		if m.Hash() != want.Hash() {
+			t.Fatalf("machine hash differs after %v steps", i)
+		}
+		m.ExecuteAssertion(1, tb)
+		want.ExecuteAssertion(1, tb)
+	}
+}
+
+// TestCodeSegmentLazyConcurrent looks up code points of a lazily filled code
+// segment from several goroutines at once. Run it with -race.
+func TestCodeSegmentLazyConcurrent(t *testing.T) {
+	insns := codeSegmentProgram(50)
+	full := NewCodeSegmentWithFrequency(insns, 1, false)
+	c := NewCodeSegmentWithFrequency(insns, 10, true)
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := 0; k < 200; k++ {
+				i := int64((k*7 + g) % len(insns))
+				if c.CodePointHash(i) != full.CodePointHash(i) {
+					errs <- fmt.Sprintf("goroutine %v: code point %v differs", g, i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+var codeSegmentFrequencies = []int64{1, 2, 4, 16, 64}
+
+// BenchmarkNewCodeSegment shows the memory each frequency takes. B/op also
+// counts the garbage from hashing the program, which is the same for every
+// frequency, so it is the differences between them that are kept.
+func BenchmarkNewCodeSegment(b *testing.B) {
+	insns := codeSegmentProgram(10000)
+	for _, freq := range codeSegmentFrequencies {
+		for _, lazy := range []bool{false, true} {
+			b.Run(fmt.Sprintf("frequency=%v/lazy=%v", freq, lazy), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					NewCodeSegmentWithFrequency(insns, freq, lazy)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCodePointHash shows the cost of hashing at each frequency, for
+// a machine running a loop over 100 of the instructions
+func BenchmarkCodePointHash(b *testing.B) {
+	insns := codeSegmentProgram(10000)
+	for _, freq := range codeSegmentFrequencies {
+		for _, lazy := range []bool{false, true} {
+			c := NewCodeSegmentWithFrequency(insns, freq, lazy)
+			b.Run(fmt.Sprintf("frequency=%v/lazy=%v", freq, lazy), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					c.CodePointHash(int64(5000 + i%100))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// AccumulateHash adds a value to a hash chain: keccak(acc, val.Hash()). A
+// chain starts from the zero hash.
+func AccumulateHash(acc [32]byte, val value.Value) [32]byte {
+	var ret [32]byte
+	copy(ret[:], solsha3.SoliditySHA3(
+		solsha3.Bytes32(acc),
+		solsha3.Bytes32(val.Hash()),
+	))
+	return ret
+}
+
+// MessagesHash returns the accumulated hash of msgs
+func MessagesHash(msgs []protocol.Message) [32]byte {
+	var acc [32]byte
+	for _, msg := range msgs {
+		acc = AccumulateHash(acc, msg.AsValue())
+	}
+	return acc
+}
+
+// LogsHash returns the accumulated hash of logs
+func LogsHash(logs []value.Value) [32]byte {
+	var acc [32]byte
+	for _, log := range logs {
+		acc = AccumulateHash(acc, log)
+	}
+	return acc
+}
+
+// CutPoint is the state of an assertion after some of its steps
+type CutPoint struct {
+	Steps        uint32
+	MachineHash  [32]byte
+	MessagesHash [32]byte // accumulated hash of the messages sent so far
+	LogsHash     [32]byte // accumulated hash of the values logged so far
+}
+
+func (ac *MachineAssertionContext) cutPoint() CutPoint {
+	return CutPoint{ac.numSteps, ac.machine.Hash(), ac.messagesHash, ac.logsHash}
+}
+
+// CutPointStep returns the step count at which cut point i of cuts falls, in
+// an assertion of at most maxSteps steps. Cut point cuts is at maxSteps.
+func CutPointStep(maxSteps int32, cuts int32, i int32) uint32 {
+	return uint32(int64(maxSteps) * int64(i) / int64(cuts))
+}
+
+// runUntil runs until the assertion has taken the given number of steps, or
+// the next instruction would take it past them, or the machine stops. It
+// returns false once the machine has stopped.
+func (ac *MachineAssertionContext) runUntil(steps uint32) bool {
+	for ac.numSteps+uint32(ac.machine.NextStepCost()) <= steps {
+		if _, continueRun, _ := ac.machine.run(); !continueRun {
+			return false
+		}
+	}
+	return true
+}
+
+// ExecuteAssertionWithCutPoints runs like ExecuteAssertion, and also returns
+// the state at cuts evenly spaced cut points. Cut point i falls at
+// CutPointStep(maxSteps, cuts, i+1), or just before it if an instruction
+// that counts as several steps spans it, and the last one is the end of the
+// assertion. If the machine stops earlier, the cut points after it all have
+// its final state.
+func (m *Machine) ExecuteAssertionWithCutPoints(maxSteps int32, cuts int32, timeBounds protocol.TimeBounds) (*protocol.Assertion, []CutPoint) {
+	assCtx := NewMachineAssertionContext(
+		m,
+		timeBounds,
+	)
+	cutPoints := make([]CutPoint, 0, cuts)
+	running := true
+	for i := int32(1); i <= cuts; i++ {
+		if running {
+			running = assCtx.runUntil(CutPointStep(maxSteps, cuts, i))
+		}
+		cutPoints = append(cutPoints, assCtx.cutPoint())
+	}
+	if running && maxSteps > 0 {
+		assCtx.runUntil(uint32(maxSteps))
+	}
+	return assCtx.Finalize(m), cutPoints
+}
+
+// SegmentMismatchError means that re-executing a segment of an assertion
+// didn't reach the claimed cut point
+type SegmentMismatchError struct {
+	Msg string
+}
+
+func (e SegmentMismatchError) Error() string {
+	return "segment doesn't match its cut point: " + e.Msg
+}
+
+// VerifySegment re-executes the segment of an assertion between two of its
+// cut points. start is a saved machine in the state at from; it is cloned
+// rather than run, so it can be used again.
+func VerifySegment(start *Machine, from CutPoint, to CutPoint, timeBounds protocol.TimeBounds) error {
+	if h := start.Hash(); h != from.MachineHash {
+		return SegmentMismatchError{fmt.Sprintf("machine has hash %x, but the segment starts at %x", h, from.MachineHash)}
+	}
+	if to.Steps < from.Steps {
+		return SegmentMismatchError{fmt.Sprintf("segment ends at step %v, before it starts at %v", to.Steps, from.Steps)}
+	}
+
+	m := start.Clone().(*Machine)
+	assCtx := NewMachineAssertionContext(m, timeBounds)
+	assCtx.numSteps = from.Steps
+	assCtx.messagesHash = from.MessagesHash
+	assCtx.logsHash = from.LogsHash
+	running := assCtx.runUntil(to.Steps)
+	// a breakpoint ends an assertion without counting as a step, so the cut
+	// point at the end can be just after one
+	if running && m.Hash() != to.MachineHash && m.GetOperation().GetOp() == code.BREAKPOINT {
+		m.run()
+	}
+	end := assCtx.cutPoint()
+	assCtx.EndContext()
+
+	switch {
+	case end.Steps != to.Steps:
+		return SegmentMismatchError{fmt.Sprintf("machine stopped at step %v, before %v", end.Steps, to.Steps)}
+	case end.MachineHash != to.MachineHash:
+		return SegmentMismatchError{fmt.Sprintf("machine hash %x, claimed %x", end.MachineHash, to.MachineHash)}
+	case end.MessagesHash != to.MessagesHash:
+		return SegmentMismatchError{fmt.Sprintf("messages hash %x, claimed %x", end.MessagesHash, to.MessagesHash)}
+	case end.LogsHash != to.LogsHash:
+		return SegmentMismatchError{fmt.Sprintf("logs hash %x, claimed %x", end.LogsHash, to.LogsHash)}
+	}
+	return nil
+}
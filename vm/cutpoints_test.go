@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// countingMachine returns a machine that counts to 20, logging each count and
+// trying to send 1 of a token it has 5 of, taking 11 steps per count, then
+// halts
+func countingMachine() *Machine {
+	msg, _ := value.NewTupleFromSlice([]value.Value{
+		value.NewInt64Value(7),
+		value.NewInt64Value(1),
+		value.NewInt64Value(1),
+		value.NewInt64Value(0),
+	})
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.RSET},
+		value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(1)},
+		value.BasicOperation{Op: code.DUP0},
+		value.BasicOperation{Op: code.LOG},
+		value.ImmediateOperation{Op: code.NBSEND, Val: msg},
+		value.BasicOperation{Op: code.POP},
+		value.BasicOperation{Op: code.DUP0},
+		value.ImmediateOperation{Op: code.GT, Val: value.NewInt64Value(20)},
+		value.BasicOperation{Op: code.RPUSH},
+		value.BasicOperation{Op: code.CJUMP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	m := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	m.SendOnchainMessage(protocol.NewMessage(value.NewEmptyTuple(), [21]byte{}, big.NewInt(5), [32]byte{}))
+	m.DeliverOnchainMessage()
+	m.Stack().Push(value.NewInt64Value(0))
+	return m
+}
+
+func TestAssertionCutPoints(t *testing.T) {
+	tb := protocol.NewTimeBounds(0, 10000)
+	m := countingMachine()
+	start := m.Clone().(*Machine)
+	plain := m.Clone().(*Machine).ExecuteAssertion(300, tb)
+
+	a, cuts := m.ExecuteAssertionWithCutPoints(300, 4, tb)
+	if a.NumSteps != 221 || a.NumSteps != plain.NumSteps || a.AfterHash != plain.AfterHash {
+		t.Fatalf("assertion took %v steps to %x, rather than %v to %x", a.NumSteps, a.AfterHash, plain.NumSteps, plain.AfterHash)
+	}
+	if len(a.OutMsgs) != 5 || len(a.Logs) != 20 {
+		t.Fatalf("assertion sent %v messages and logged %v values", len(a.OutMsgs), len(a.Logs))
+	}
+	if len(cuts) != 4 {
+		t.Fatalf("got %v cut points", len(cuts))
+	}
+	for i, steps := range []uint32{75, 150, 221, 221} {
+		if cuts[i].Steps != steps {
+			t.Errorf("cut point %v is at step %v", i, cuts[i].Steps)
+		}
+	}
+	end := cuts[3]
+	if end.MachineHash != a.AfterHash || end.MessagesHash != MessagesHash(a.OutMsgs) || end.LogsHash != LogsHash(a.Logs) {
+		t.Error("last cut point doesn't match the assertion")
+	}
+	if cuts[0].LogsHash != LogsHash(a.Logs[:7]) {
+		t.Error("first cut point has the wrong logs hash")
+	}
+
+	// verify each segment from a saved machine at its start
+	from := CutPoint{Steps: 0, MachineHash: start.Hash()}
+	saved := start
+	for i, to := range cuts {
+		if err := VerifySegment(saved, from, to, tb); err != nil {
+			t.Errorf("segment %v: %v", i, err)
+		}
+		saved = saved.Clone().(*Machine)
+		saved.ExecuteAssertion(int32(to.Steps-from.Steps), tb)
+		from = to
+	}
+
+	wrongLogs := cuts[1]
+	wrongLogs.LogsHash[0] ^= 1
+	second := start.Clone().(*Machine)
+	second.ExecuteAssertion(int32(cuts[0].Steps), tb)
+	if err := VerifySegment(second, cuts[0], wrongLogs, tb); err == nil {
+		t.Error("verified a segment with the wrong logs hash")
+	}
+	wrongMachine := cuts[1]
+	wrongMachine.MachineHash[0] ^= 1
+	if err := VerifySegment(second, cuts[0], wrongMachine, tb); err == nil {
+		t.Error("verified a segment ending at the wrong machine")
+	}
+	tooLong := cuts[3]
+	tooLong.Steps = 250
+	if err := VerifySegment(second, cuts[0], tooLong, tb); err == nil {
+		t.Error("verified a segment that runs past the end of the machine")
+	}
+	if err := VerifySegment(start, cuts[0], cuts[1], tb); err == nil {
+		t.Error("verified a segment from the wrong machine")
+	}
+
+	// a breakpoint ends the assertion just after it, without taking a step
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.BREAKPOINT},
+		value.BasicOperation{Op: code.HALT},
+	}
+	bp := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	bpStart := bp.Clone().(*Machine)
+	_, cuts = bp.ExecuteAssertionWithCutPoints(4, 2, tb)
+	if cuts[0].Steps != 1 || cuts[0].MachineHash != bp.Hash() {
+		t.Fatalf("breakpoint cut point is at step %v", cuts[0].Steps)
+	}
+	if err := VerifySegment(bpStart, CutPoint{Steps: 0, MachineHash: bpStart.Hash()}, cuts[0], tb); err != nil {
+		t.Error(err)
+	}
+}
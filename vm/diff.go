@@ -0,0 +1,222 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// Component names a part of the machine state
+type Component string
+
+const (
+	ComponentStatus     Component = "status"
+	ComponentCode       Component = "code"
+	ComponentPC         Component = "pc"
+	ComponentStack      Component = "stack"
+	ComponentAuxStack   Component = "auxstack"
+	ComponentRegister   Component = "register"
+	ComponentStatic     Component = "static"
+	ComponentErrHandler Component = "errHandler"
+)
+
+// ValueDiff locates the first difference between two values. Path is the
+// sequence of tuple indices leading from the compared values to the
+// differing ones. Left or Right is nil if that side has no value there, such
+// as past the bottom of the shorter stack.
+type ValueDiff struct {
+	Path  []int64
+	Left  value.Value
+	Right value.Value
+}
+
+// MachineDiff is a difference in one component of two machines
+type MachineDiff struct {
+	Component Component
+	// Depth is the stack depth of the first differing item, counting the top
+	// as 0, or -1 for components other than stacks
+	Depth int64
+	ValueDiff
+	// Msg describes differences that aren't between two values
+	Msg string
+}
+
+func (d MachineDiff) String() string {
+	var sb strings.Builder
+	sb.WriteString(string(d.Component))
+	if d.Depth >= 0 {
+		fmt.Fprintf(&sb, " depth %d", d.Depth)
+	}
+	if len(d.Path) > 0 {
+		path := make([]string, len(d.Path))
+		for i, idx := range d.Path {
+			path[i] = fmt.Sprint(idx)
+		}
+		fmt.Fprintf(&sb, " path [%v]", strings.Join(path, "]["))
+	}
+	if d.Msg != "" {
+		sb.WriteString(": " + d.Msg)
+	} else {
+		fmt.Fprintf(&sb, ": %v != %v", describeDiffValue(d.Left), describeDiffValue(d.Right))
+	}
+	return sb.String()
+}
+
+func describeDiffValue(val value.Value) string {
+	if val == nil {
+		return "missing"
+	}
+	h := val.Hash()
+	return fmt.Sprintf("%v (%v)", val, hexutil.Encode(h[:]))
+}
+
+// DiffValues returns the first difference between x and y, descending into
+// tuples of the same length. It returns false if the values are equal.
+func DiffValues(x, y value.Value) (ValueDiff, bool) {
+	var path []int64
+	for {
+		if x.Hash() == y.Hash() {
+			return ValueDiff{}, false
+		}
+		xt, xok := x.(value.TupleValue)
+		yt, yok := y.(value.TupleValue)
+		if !xok || !yok || xt.Len() != yt.Len() {
+			return ValueDiff{path, x, y}, true
+		}
+		xs, ys := xt.Contents(), yt.Contents()
+		for i := range xs {
+			if xs[i].Hash() != ys[i].Hash() {
+				path = append(path, int64(i))
+				x, y = xs[i], ys[i]
+				break
+			}
+		}
+	}
+}
+
+// diffStackValues compares two stacks given as tuple chains, item by item
+// from the top
+func diffStackValues(component Component, x, y value.Value) (MachineDiff, bool) {
+	for depth := int64(0); ; depth++ {
+		if x.Hash() == y.Hash() {
+			return MachineDiff{}, false
+		}
+		xItem, xRest, xok := splitStackLink(x)
+		yItem, yRest, yok := splitStackLink(y)
+		if !xok || !yok {
+			// reached the bottom of one stack, or something that isn't a stack
+			// link, such as a hash-only value
+			return MachineDiff{
+				Component: component,
+				Depth:     depth,
+				ValueDiff: ValueDiff{nil, stackDiffValue(x, xItem, xok), stackDiffValue(y, yItem, yok)},
+			}, true
+		}
+		if vdiff, differ := DiffValues(xItem, yItem); differ {
+			return MachineDiff{Component: component, Depth: depth, ValueDiff: vdiff}, true
+		}
+		x, y = xRest, yRest
+	}
+}
+
+func splitStackLink(val value.Value) (value.Value, value.Value, bool) {
+	tup, ok := val.(value.TupleValue)
+	if !ok || tup.Len() != 2 {
+		return nil, nil, false
+	}
+	contents := tup.Contents()
+	return contents[0], contents[1], true
+}
+
+// stackDiffValue is the value reported for one side of a stack difference
+func stackDiffValue(link, item value.Value, isLink bool) value.Value {
+	if isLink {
+		return item
+	}
+	if tup, ok := link.(value.TupleValue); ok && tup.Len() == 0 {
+		return nil
+	}
+	return link
+}
+
+// currentCodePoint returns the code point the machine is at, or nil if it
+// isn't at one
+func currentCodePoint(pc *MachinePC) value.Value {
+	if pc.pc < 0 || pc.pc >= pc.code.Len() {
+		return nil
+	}
+	return pc.GetPC()
+}
+
+func diffComponentValues(component Component, x, y value.Value) (MachineDiff, bool) {
+	vdiff, differ := DiffValues(x, y)
+	return MachineDiff{Component: component, Depth: -1, ValueDiff: vdiff}, differ
+}
+
+// diffData compares the stacks, register, static and error handler
+func diffData(x, y *Machine) []MachineDiff {
+	var diffs []MachineDiff
+	if d, differ := diffStackValues(ComponentStack, x.stack.FullyExpandedValue(), y.stack.FullyExpandedValue()); differ {
+		diffs = append(diffs, d)
+	}
+	if d, differ := diffStackValues(ComponentAuxStack, x.auxstack.FullyExpandedValue(), y.auxstack.FullyExpandedValue()); differ {
+		diffs = append(diffs, d)
+	}
+	if d, differ := diffComponentValues(ComponentRegister, x.register.Get(), y.register.Get()); differ {
+		diffs = append(diffs, d)
+	}
+	if d, differ := diffComponentValues(ComponentStatic, x.static.Get(), y.static.Get()); differ {
+		diffs = append(diffs, d)
+	}
+	if d, differ := diffComponentValues(ComponentErrHandler, x.errHandler, y.errHandler); differ {
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// Diff returns every component in which the two machines differ, or nothing
+// if they have the same state. The components are the ones that go into
+// Machine.Hash, along with the code the machines run.
+func Diff(x, y *Machine) []MachineDiff {
+	var diffs []MachineDiff
+	if x.status != y.status || x.sizeException != y.sizeException {
+		diffs = append(diffs, MachineDiff{
+			Component: ComponentStatus,
+			Depth:     -1,
+			Msg:       fmt.Sprintf("%v (size exception %v) != %v (size exception %v)", x.status, x.sizeException, y.status, y.sizeException),
+		})
+	}
+	if xh, yh := x.CodeHash(), y.CodeHash(); xh != yh {
+		diffs = append(diffs, MachineDiff{
+			Component: ComponentCode,
+			Depth:     -1,
+			Msg:       fmt.Sprintf("code hash %v != %v", hexutil.Encode(xh[:]), hexutil.Encode(yh[:])),
+		})
+	}
+	if x.pc.GetCurrentCodePointHash() != y.pc.GetCurrentCodePointHash() {
+		diffs = append(diffs, MachineDiff{
+			Component: ComponentPC,
+			Depth:     -1,
+			ValueDiff: ValueDiff{nil, currentCodePoint(x.pc), currentCodePoint(y.pc)},
+		})
+	}
+	return append(diffs, diffData(x, y)...)
+}
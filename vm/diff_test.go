@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestMachineDiff(t *testing.T) {
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	x := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	y := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	for _, m := range []*Machine{x, y} {
+		m.Stack().Push(value.NewInt64Value(1))
+		m.Stack().Push(value.NewInt64Value(2))
+		m.Stack().Push(value.NewInt64Value(3))
+	}
+	if diffs := Diff(x, y); len(diffs) != 0 {
+		t.Fatalf("identical machines differ: %v", diffs)
+	}
+
+	inner := value.NewTuple2(value.NewInt64Value(5), value.NewInt64Value(6))
+	x.Register().Set(value.NewTuple2(value.NewInt64Value(4), inner))
+	inner, _ = inner.SetByInt64(1, value.NewInt64Value(7))
+	y.Register().Set(value.NewTuple2(value.NewInt64Value(4), inner))
+
+	x.Stack().Push(value.NewInt64Value(8))
+	x.Stack().Push(value.NewInt64Value(9))
+	y.Stack().Push(value.NewInt64Value(8))
+	y.Stack().Push(value.NewInt64Value(10))
+	x.AuxStack().Push(value.NewInt64Value(11))
+	_ = y.SetPC(value.CodePointValue{InsnNum: 1, Op: insns[1], NextHash: HashOfLastInstruction})
+
+	diffs := Diff(x, y)
+	if len(diffs) != 4 {
+		t.Fatalf("expected 4 diffs, got %v", diffs)
+	}
+	if d := diffs[0]; d.Component != ComponentPC {
+		t.Errorf("unexpected pc diff %v", d)
+	}
+	if d := diffs[1]; d.Component != ComponentStack || d.Depth != 0 || len(d.Path) != 0 ||
+		!d.Left.Equal(value.NewInt64Value(9)) || !d.Right.Equal(value.NewInt64Value(10)) {
+		t.Errorf("unexpected stack diff %v", d)
+	}
+	if d := diffs[2]; d.Component != ComponentAuxStack || d.Depth != 0 ||
+		!d.Left.Equal(value.NewInt64Value(11)) || d.Right != nil {
+		t.Errorf("unexpected aux stack diff %v", d)
+	}
+	if d := diffs[3]; d.Component != ComponentRegister || !reflect.DeepEqual(d.Path, []int64{1, 1}) ||
+		!d.Left.Equal(value.NewInt64Value(6)) || !d.Right.Equal(value.NewInt64Value(7)) {
+		t.Errorf("unexpected register diff %v", d)
+	}
+	if !strings.Contains(diffs[3].String(), "register path [1][1]") {
+		t.Errorf("unexpected description %v", diffs[3])
+	}
+
+	if ok, msg := Equal(x, y); ok || !strings.HasPrefix(msg, "stack depth 0") {
+		t.Errorf("Equal reported %v %q", ok, msg)
+	}
+}
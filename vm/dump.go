@@ -0,0 +1,250 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func (s MachineStatus) String() string {
+	switch s {
+	case MACHINE_EXTENSIVE:
+		return "extensive"
+	case MACHINE_ERRORSTOP:
+		return "errorstop"
+	case MACHINE_HALT:
+		return "halt"
+	}
+	return fmt.Sprintf("MachineStatus(%d)", int(s))
+}
+
+// CodePointDump describes a code point, decoded with its mnemonic
+type CodePointDump struct {
+	InsnNum   int64        `json:"insnNum"`
+	Opcode    value.Opcode `json:"opcode"`
+	Mnemonic  string       `json:"mnemonic"`
+	Immediate *ValueDump   `json:"immediate,omitempty"`
+	NextHash  string       `json:"nextHash"`
+}
+
+// ValueDump is a fully expanded description of a value. Only the field
+// matching Type is set.
+type ValueDump struct {
+	Type      string         `json:"type"`
+	Hash      string         `json:"hash"`
+	Size      int64          `json:"size"`
+	Int       string         `json:"int,omitempty"`
+	CodePoint *CodePointDump `json:"codePoint,omitempty"`
+	Items     []ValueDump    `json:"items,omitempty"`
+}
+
+// BalanceDump is the machine's balance of one token type
+type BalanceDump struct {
+	TokenType string `json:"tokenType"`
+	Amount    string `json:"amount"`
+}
+
+// MachineDump is a complete description of a machine's state, suitable for
+// printing as a tree or encoding as JSON
+type MachineDump struct {
+	Hash          string         `json:"hash"`
+	Status        string         `json:"status"`
+	SizeException bool           `json:"sizeException"`
+	PC            *CodePointDump `json:"pc,omitempty"`
+	PCHash        string         `json:"pcHash"`
+	ErrHandler    CodePointDump  `json:"errHandler"`
+	Stack         []ValueDump    `json:"stack"`
+	AuxStack      []ValueDump    `json:"auxStack"`
+	Register      ValueDump      `json:"register"`
+	Static        ValueDump      `json:"static"`
+	Inbox         ValueDump      `json:"inbox"`
+	Balances      []BalanceDump  `json:"balances"`
+}
+
+func hashString(h [32]byte) string {
+	return hexutil.Encode(h[:])
+}
+
+func dumpCodePoint(set *InstructionSet, cp value.CodePointValue) CodePointDump {
+	ret := CodePointDump{
+		InsnNum:  cp.InsnNum,
+		NextHash: hashString(cp.NextHash),
+	}
+	if cp.Op == nil {
+		ret.Mnemonic = "unknown"
+		return ret
+	}
+	ret.Opcode = cp.Op.GetOp()
+	ret.Mnemonic = set.Name(ret.Opcode)
+	if imm, ok := cp.Op.(value.ImmediateOperation); ok {
+		val := dumpValue(set, imm.Val)
+		ret.Immediate = &val
+	}
+	return ret
+}
+
+// DumpValue expands val into a ValueDump, naming opcodes from the standard
+// instruction set
+func DumpValue(val value.Value) ValueDump {
+	return dumpValue(standardInstructions, val)
+}
+
+func dumpValue(set *InstructionSet, val value.Value) ValueDump {
+	ret := ValueDump{
+		Type: value.TypeCodeName(val.TypeCode()),
+		Hash: hashString(val.Hash()),
+		Size: val.Size(),
+	}
+	switch val := val.(type) {
+	case value.IntValue:
+		ret.Int = val.BigInt().String()
+	case value.CodePointValue:
+		cp := dumpCodePoint(set, val)
+		ret.CodePoint = &cp
+	case value.TupleValue:
+		for _, item := range val.Contents() {
+			ret.Items = append(ret.Items, dumpValue(set, item))
+		}
+	}
+	return ret
+}
+
+// Dump returns a description of the complete state of the machine. Stacks
+// are listed top first.
+func (m *Machine) Dump() MachineDump {
+	ret := MachineDump{
+		Hash:          hashString(m.Hash()),
+		Status:        m.status.String(),
+		SizeException: m.sizeException,
+		PCHash:        hashString(m.pc.GetCurrentCodePointHash()),
+		ErrHandler:    dumpCodePoint(m.insnSet, m.errHandler),
+		Stack:         dumpStackItems(m.insnSet, m.stack.FullyExpandedValue()),
+		AuxStack:      dumpStackItems(m.insnSet, m.auxstack.FullyExpandedValue()),
+		Register:      dumpValue(m.insnSet, m.register.Get()),
+		Static:        dumpValue(m.insnSet, m.static.Get()),
+		Inbox:         dumpValue(m.insnSet, m.inbox.Receive()),
+		Balances:      []BalanceDump{},
+	}
+	if m.pc.pc >= 0 && m.pc.pc < m.pc.code.Len() {
+		pc := dumpCodePoint(m.insnSet, m.pc.GetPC())
+		ret.PC = &pc
+	}
+	for i, tok := range m.balance.TokenTypes {
+		ret.Balances = append(ret.Balances, BalanceDump{
+			hexutil.Encode(tok[:]),
+			m.balance.TokenAmounts[i].String(),
+		})
+	}
+	return ret
+}
+
+// dumpStackItems unrolls a tuple chain into its items, top first
+func dumpStackItems(set *InstructionSet, chain value.Value) []ValueDump {
+	ret := []ValueDump{}
+	for {
+		tup, ok := chain.(value.TupleValue)
+		if !ok || tup.Len() != 2 {
+			return ret
+		}
+		contents := tup.Contents()
+		ret = append(ret, dumpValue(set, contents[0]))
+		chain = contents[1]
+	}
+}
+
+// WriteJSON writes the dump to wr as indented JSON
+func (d MachineDump) WriteJSON(wr io.Writer) error {
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// WriteTree writes the dump to wr as an indented tree
+func (d MachineDump) WriteTree(wr io.Writer) error {
+	t := &treeWriter{wr: wr}
+	t.line(0, "machine %v", d.Hash)
+	t.line(1, "status: %v", d.Status)
+	if d.SizeException {
+		t.line(1, "size exception")
+	}
+	if d.PC != nil {
+		t.codePoint(1, "pc", *d.PC)
+	} else {
+		t.line(1, "pc: none")
+	}
+	t.line(2, "hash %v", d.PCHash)
+	t.codePoint(1, "errHandler", d.ErrHandler)
+	t.stack(1, "stack", d.Stack)
+	t.stack(1, "auxstack", d.AuxStack)
+	t.value(1, "register", d.Register)
+	t.value(1, "static", d.Static)
+	t.value(1, "inbox", d.Inbox)
+	t.line(1, "balances (%d)", len(d.Balances))
+	for _, bal := range d.Balances {
+		t.line(2, "%v: %v", bal.TokenType, bal.Amount)
+	}
+	return t.err
+}
+
+type treeWriter struct {
+	wr  io.Writer
+	err error
+}
+
+func (t *treeWriter) line(depth int, format string, args ...interface{}) {
+	if t.err != nil {
+		return
+	}
+	_, t.err = fmt.Fprintf(t.wr, strings.Repeat("  ", depth)+format+"\n", args...)
+}
+
+func (t *treeWriter) codePoint(depth int, label string, cp CodePointDump) {
+	t.line(depth, "%v: %v %v", label, cp.InsnNum, cp.Mnemonic)
+	if cp.Immediate != nil {
+		t.value(depth+1, "immediate", *cp.Immediate)
+	}
+	t.line(depth+1, "next %v", cp.NextHash)
+}
+
+func (t *treeWriter) stack(depth int, label string, items []ValueDump) {
+	t.line(depth, "%v (%d items)", label, len(items))
+	for i, item := range items {
+		t.value(depth+1, fmt.Sprintf("[%d]", i), item)
+	}
+}
+
+func (t *treeWriter) value(depth int, label string, val ValueDump) {
+	switch {
+	case val.Int != "":
+		t.line(depth, "%v: Int %v", label, val.Int)
+	case val.CodePoint != nil:
+		t.codePoint(depth, label+": CodePoint", *val.CodePoint)
+	case val.Type == value.TypeCodeName(value.TypeCodeTuple):
+		t.line(depth, "%v: Tuple(%d) %v", label, len(val.Items), val.Hash)
+		for i, item := range val.Items {
+			t.value(depth+1, fmt.Sprintf("[%d]", i), item)
+		}
+	default:
+		t.line(depth, "%v: %v %v size %d", label, val.Type, val.Hash, val.Size)
+	}
+}
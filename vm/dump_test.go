@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestMachineDump(t *testing.T) {
+	tup := value.NewTuple2(value.NewInt64Value(3), value.NewInt64Value(4))
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: code.NOP, Val: tup},
+		value.ImmediateOperation{Op: code.NOP, Val: value.NewInt64Value(7)},
+		value.BasicOperation{Op: code.HALT},
+	}
+	m := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	_ = m.ExecuteAssertion(2, protocol.NewTimeBounds(0, 100000))
+
+	d := m.Dump()
+	if d.Status != "extensive" || d.PC == nil || d.PC.InsnNum != 2 || d.PC.Mnemonic != "halt" {
+		t.Fatalf("unexpected machine in dump %+v", d)
+	}
+	if len(d.Stack) != 2 || d.Stack[0].Int != "7" || d.Stack[1].Type != "Tuple" || len(d.Stack[1].Items) != 2 {
+		t.Errorf("unexpected stack in dump %+v", d.Stack)
+	}
+	if len(d.AuxStack) != 0 || d.Static.Int != "1" || len(d.Balances) != 0 {
+		t.Errorf("unexpected dump %+v", d)
+	}
+	hash := m.Hash()
+	if d.Hash != hexutil.Encode(hash[:]) {
+		t.Errorf("dump hash %v doesn't match machine", d.Hash)
+	}
+
+	var buf bytes.Buffer
+	if err := d.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded MachineDump
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, decoded) {
+		t.Errorf("JSON dump didn't round trip")
+	}
+
+	buf.Reset()
+	if err := d.WriteTree(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"pc: 2 halt", "stack (2 items)", "[0]: Int 7", "[1]: Tuple(2)", "static: Int 1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("tree dump missing %q:\n%v", want, buf.String())
+		}
+	}
+}
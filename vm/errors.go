@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// InstructionError is implemented by every error an instruction can raise.
+// When an instruction fails, the machine drops the rest of the instruction's
+// inputs and jumps to its error handler; RunInstruction returns the error,
+// and the machine's warning handler gets a warning whose Err is the error.
+// Use errors.As with either InstructionError or one of the concrete types
+// below to inspect it.
+type InstructionError interface {
+	error
+	PC() int64
+	Opcode() value.Opcode
+	atLocation(l location) InstructionError
+}
+
+// location is the part shared by all instruction errors
+type location struct {
+	pc     int64
+	opcode value.Opcode
+	// the opcode's name in the machine's instruction set
+	name string
+}
+
+func (l location) PC() int64 {
+	return l.pc
+}
+
+func (l location) Opcode() value.Opcode {
+	return l.opcode
+}
+
+func (l location) String() string {
+	return fmt.Sprintf("%v at pc %v", l.name, l.pc)
+}
+
+// StackUnderflowError means an instruction needed more items than the stack had
+type StackUnderflowError struct {
+	location
+}
+
+func (e StackUnderflowError) Error() string {
+	return fmt.Sprintf("%v: tried to pop empty stack", e.location)
+}
+
+func (e StackUnderflowError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+// TypeMismatchError means an instruction's input had the wrong type
+type TypeMismatchError struct {
+	location
+	Expected string
+	Actual   value.Value
+}
+
+func (e TypeMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %v but received %v", e.location, e.Expected, e.Actual)
+}
+
+func (e TypeMismatchError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+type DivideByZeroError struct {
+	location
+}
+
+func (e DivideByZeroError) Error() string {
+	return fmt.Sprintf("%v: tried to divide or modulo by zero", e.location)
+}
+
+func (e DivideByZeroError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+type InvalidOpcodeError struct {
+	location
+}
+
+func (e InvalidOpcodeError) Error() string {
+	return fmt.Sprintf("invalid opcode %v at pc %v", e.opcode, e.pc)
+}
+
+func (e InvalidOpcodeError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+// InvalidJumpError means a jump target isn't a code point. In strict mode,
+// it also means a code point that isn't the program's: one whose index is out
+// of range, or which doesn't match the program's code point there.
+type InvalidJumpError struct {
+	location
+	Target value.Value
+}
+
+func (e InvalidJumpError) Error() string {
+	return fmt.Sprintf("%v: invalid jump target %v", e.location, e.Target)
+}
+
+func (e InvalidJumpError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+type TupleIndexError struct {
+	location
+	Index  value.IntValue
+	Length int64
+}
+
+func (e TupleIndexError) Error() string {
+	return fmt.Sprintf("%v: index %v out of range of tuple of length %v", e.location, e.Index, e.Length)
+}
+
+func (e TupleIndexError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+// BufferRangeError means a buffer instruction went past the end of a buffer,
+// or would have made one too big
+type BufferRangeError struct {
+	location
+	Msg string
+}
+
+func (e BufferRangeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.location, e.Msg)
+}
+
+func (e BufferRangeError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+// ErrorInstructionError is raised by the ERROR instruction
+type ErrorInstructionError struct {
+	location
+}
+
+func (e ErrorInstructionError) Error() string {
+	return fmt.Sprintf("%v: executed error instruction", e.location)
+}
+
+func (e ErrorInstructionError) atLocation(l location) InstructionError {
+	e.location = l
+	return e
+}
+
+// toInstructionError converts an error raised while running the instruction
+// at pc into an InstructionError, if it is one of the known kinds
+func toInstructionError(err error, l location) error {
+	switch e := err.(type) {
+	case InstructionError:
+		return e.atLocation(l)
+	case stack.EmptyError:
+		return StackUnderflowError{}.atLocation(l)
+	case stack.TypeError:
+		return TypeMismatchError{Expected: e.Expected, Actual: e.Value}.atLocation(l)
+	case buffer.TypeError:
+		return TypeMismatchError{Expected: "buffer", Actual: e.Value}.atLocation(l)
+	case buffer.RangeError:
+		return BufferRangeError{Msg: e.Error()}.atLocation(l)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestInstructionErrors(t *testing.T) {
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	tup := value.NewTuple2(value.NewInt64Value(1), value.NewInt64Value(2))
+	testCases := []struct {
+		name   string
+		op     value.Opcode
+		stack  []value.Value // pushed in order
+		target interface{}
+	}{
+		{"underflow", code.ADD, []value.Value{value.NewInt64Value(1)}, &StackUnderflowError{}},
+		{"type mismatch", code.ADD, []value.Value{tup, value.NewInt64Value(1)}, &TypeMismatchError{}},
+		{"divide by zero", code.DIV, []value.Value{value.NewInt64Value(0), value.NewInt64Value(1)}, &DivideByZeroError{}},
+		{"invalid opcode", value.Opcode(0xff), nil, &InvalidOpcodeError{}},
+		{"invalid jump", code.JUMP, []value.Value{value.NewInt64Value(1)}, &InvalidJumpError{}},
+		{"tuple index", code.TGET, []value.Value{tup, value.NewInt64Value(5)}, &TupleIndexError{}},
+		{"error instruction", code.ERROR, nil, &ErrorInstructionError{}},
+	}
+	for _, tc := range testCases {
+		m := NewMachine(insns, value.NewInt64Value(1), false, 100)
+		hand := NewBufferWarningHandler(10)
+		m.SetWarningHandler(hand)
+		m.IncrPC()
+		for _, val := range tc.stack {
+			m.Stack().Push(val)
+		}
+		_, err := RunInstruction(m, value.BasicOperation{Op: tc.op})
+		if err == nil {
+			t.Errorf("%v: expected an error", tc.name)
+			continue
+		}
+		if !errors.As(err, tc.target) {
+			t.Errorf("%v: unexpected error type %T", tc.name, err)
+		}
+		var ierr InstructionError
+		if !errors.As(err, &ierr) {
+			t.Errorf("%v: error isn't an InstructionError", tc.name)
+			continue
+		}
+		if ierr.PC() != 1 || ierr.Opcode() != tc.op {
+			t.Errorf("%v: error has pc %v and opcode %v", tc.name, ierr.PC(), ierr.Opcode())
+		}
+		warnings := hand.Warnings()
+		if len(warnings) != 1 || warnings[0].Err != ierr || warnings[0].PC != 1 || warnings[0].Opcode != tc.op {
+			t.Errorf("%v: warning handler wasn't told about the error", tc.name)
+		}
+		if !m.IsErrored() {
+			t.Errorf("%v: machine without an error handler should stop", tc.name)
+		}
+	}
+}
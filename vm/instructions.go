@@ -17,12 +17,14 @@
 package vm
 
 import (
-	"errors"
 	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-avm/vm/warning"
 
 	//"github.com/offchainlabs/arb-util/value"
 	"github.com/offchainlabs/arb-util/value"
@@ -96,6 +98,15 @@ var allInsns = []Instruction{ // code, not necessarily in order
 	{code.ERROR, insnError},
 	{code.HALT, insnHalt},
 	{code.DEBUG, insnDebug},
+
+	{code.BUFNEW, insnBufnew},
+	{code.BUFLEN, insnBuflen},
+	{code.BUFGET, insnBufget},
+	{code.BUFSET, insnBufset},
+	{code.BUFSET8, insnBufset8},
+	{code.BUFSLICE, insnBufslice},
+	{code.KECCAK, insnKeccak},
+	{code.ECRECOVER, insnEcrecover},
 }
 
 var (
@@ -105,15 +116,6 @@ var (
 	tt256m1 = new(big.Int).Sub(tt256, big.NewInt(1))
 )
 
-var Instructions = []Instruction(nil)
-
-func init() {
-	Instructions = make([]Instruction, code.MaxOpcode)
-	for _, ins := range allInsns {
-		Instructions[ins.code] = ins
-	}
-}
-
 type VMBlockedError struct{}
 
 func (w VMBlockedError) Error() string {
@@ -121,18 +123,20 @@ func (w VMBlockedError) Error() string {
 }
 
 func runInstructionImpl(m *Machine, op value.Operation) (StackMods, error) {
-	if _, ok := code.InstructionNames[op.GetOp()]; !ok {
-		return StackMods{}, errors.New("invalid opcode")
+	def := m.insnSet.defs[op.GetOp()]
+	if def == nil {
+		return StackMods{}, InvalidOpcodeError{}
 	}
 
 	if immediate, ok := op.(value.ImmediateOperation); ok {
 		m.stack.Push(immediate.Val)
 	}
 
-	return Instructions[op.GetOp()].impl(m)
+	return def.Impl(m)
 }
 
 func RunInstruction(m *Machine, op value.Operation) (StackMods, error) {
+	pc := m.pc.pc
 	mods, err := runInstructionImpl(m, op)
 
 	if err == nil {
@@ -145,7 +149,9 @@ func RunInstruction(m *Machine, op value.Operation) (StackMods, error) {
 		// in case of any errors from operation
 		// pop remaining stack values and set
 		// PC to errHandler
-		m.Warn(err.Error())
+		name := m.insnSet.Name(op.GetOp())
+		err = toInstructionError(err, location{pc, op.GetOp(), name})
+		m.warnHandler.Warn(warning.Warning{PC: pc, Opcode: op.GetOp(), Name: name, Msg: err.Error(), Err: err})
 		for mods.popsRemaining > 0 {
 			var poperr error
 			_, mods, poperr = PopStackBox(m, mods)
@@ -162,10 +168,6 @@ func RunInstruction(m *Machine, op value.Operation) (StackMods, error) {
 	}
 }
 
-func (insn Instruction) GetName() string {
-	return code.InstructionNames[insn.code]
-}
-
 func (insn Instruction) GetCode() value.Opcode {
 	return insn.code
 }
@@ -214,12 +216,19 @@ func (m StackMods) check() {
 	}
 }
 
-func (m *StackMods) poppedValue() {
+// popped records a pop of the given stack.Pop type
+func (m *StackMods) popped(popType byte) {
 	m.popsRemaining--
-	m.stackPopTypes[m.stackPopsPerformed] = 1
+	m.stackPopTypes[m.stackPopsPerformed] = popType
 	m.stackPopsPerformed++
 }
 
+// failedOn records that the instruction failed because of what popped value i
+// holds, so a proof of the failure includes more of it than the pop did
+func (m *StackMods) failedOn(i int, popType byte) {
+	m.stackPopTypes[i] = popType
+}
+
 func PushStackBox(m *Machine, mods StackMods, b value.Value) StackMods {
 	mods.pushesRemaining--
 	m.Stack().Push(b)
@@ -249,64 +258,67 @@ func PopAuxStack(m *Machine, mods StackMods) (value.Value, StackMods, error) {
 		return value.NewEmptyTuple(), mods, nil
 	}
 
-	mods.auxStackPopTypes[mods.auxStackPopsPerformed] = 0
+	mods.auxStackPopTypes[mods.auxStackPopsPerformed] = stack.PopHashOnly
 	mods.auxStackPopsPerformed++
 	b, err := m.AuxStack().Pop()
 	return b, mods, err
 }
 
-type PopTypeWarning struct {
-	msg  string
-	mods StackMods
-}
-
-func (w PopTypeWarning) Error() string {
-	return w.msg
-}
-
-type EmptyStackError struct {
-	mods StackMods
-}
-
-func (w EmptyStackError) Error() string {
-	return "Tried to pop empty stack"
-}
-
 func PopStackBox(m *Machine, mods StackMods) (value.Value, StackMods, error) {
 	if m.Stack().IsEmpty() {
-		return value.NewEmptyTuple(), mods, EmptyStackError{mods}
+		return value.NewEmptyTuple(), mods, StackUnderflowError{}
 	}
-	mods.popsRemaining--
-	mods.stackPopTypes[mods.stackPopsPerformed] = 0
-	mods.stackPopsPerformed++
+	mods.popped(stack.PopHashOnly)
 	b, err := m.Stack().Pop()
 	return b, mods, err
 }
 
 func PopStackValue(m *Machine, mods StackMods) (value.Value, StackMods, error) {
 	if m.Stack().IsEmpty() {
-		return value.NewEmptyTuple(), mods, EmptyStackError{mods}
+		return value.NewEmptyTuple(), mods, StackUnderflowError{}
 	}
 	v, err := m.Stack().Pop()
-	mods.poppedValue()
+	mods.popped(stack.PopValue)
 	return v, mods, err
 }
 
 func PopStackInt(m *Machine, mods StackMods) (value.IntValue, StackMods, error) {
 	v, err := m.Stack().PopInt()
-	mods.poppedValue()
+	mods.popped(stack.PopValue)
 	return v, mods, err
 }
 
 func PopStackTuple(m *Machine, mods StackMods) (value.TupleValue, StackMods, error) {
 	v, err := m.Stack().PopTuple()
-	mods.poppedValue()
+	mods.popped(stack.PopValue)
 	return v, mods, err
 }
 
+// PopStackTupleWithItems pops a tuple whose items the instruction needs to
+// look at, so a proof includes them
+func PopStackTupleWithItems(m *Machine, mods StackMods) (value.TupleValue, StackMods, error) {
+	v, err := m.Stack().PopTuple()
+	mods.popped(stack.PopValueItems)
+	return v, mods, err
+}
+
+// PopStackBuffer pops a buffer, which a proof includes all of
+func PopStackBuffer(m *Machine, mods StackMods) (buffer.Buffer, StackMods, error) {
+	if m.Stack().IsEmpty() {
+		return buffer.Buffer{}, mods, StackUnderflowError{}
+	}
+	v, err := m.Stack().Pop()
+	mods.popped(stack.PopValueFull)
+	if err != nil {
+		return buffer.Buffer{}, mods, err
+	}
+	b, err := buffer.Decode(v)
+	return b, mods, err
+}
+
 func PopStackCodePoint(m *Machine, mods StackMods) (value.CodePointValue, StackMods, error) {
 	v, err := m.Stack().PopCodePoint()
-	mods.poppedValue()
+	mods.popped(stack.PopValue)
 	return v, mods, err
 }
 
@@ -396,13 +408,6 @@ func insnSub(state *Machine) (StackMods, error) {
 		})
 }
 
-type DivideByZeroError struct {
-}
-
-func (w DivideByZeroError) Error() string {
-	return "Tried to divide or modulo by zero"
-}
-
 func insnDiv(state *Machine) (StackMods, error) {
 	return binaryIntOp(state,
 		func(x, y value.IntValue) (value.IntValue, error) {
@@ -689,18 +694,16 @@ func insnErrSet(state *Machine) (StackMods, error) {
 	if err != nil {
 		return mods, err
 	}
+	if state.strictJumps && !rawTarget.Equal(value.ErrorCodePoint) {
+		if err := state.checkJumpTarget(rawTarget); err != nil {
+			return mods, err
+		}
+	}
 	state.errHandler = rawTarget
 	state.IncrPC()
 	return mods, err
 }
 
-type ErrorInstructionError struct {
-}
-
-func (w ErrorInstructionError) Error() string {
-	return "Executed error instruction"
-}
-
 func insnError(state *Machine) (StackMods, error) {
 	mods := NewStackMods(0, 0)
 	return mods, ErrorInstructionError{}
@@ -713,8 +716,11 @@ func insnJump(state *Machine) (StackMods, error) {
 	if err != nil {
 		return mods, err
 	}
-	err = state.SetPC(rawTarget)
-	return mods, err
+	if err := state.SetPC(rawTarget); err != nil {
+		mods.failedOn(0, stack.PopValue)
+		return mods, err
+	}
+	return mods, nil
 }
 
 func insnCjump(state *Machine) (StackMods, error) {
@@ -731,8 +737,11 @@ func insnCjump(state *Machine) (StackMods, error) {
 	}
 
 	if cond.BigInt().Cmp(big.NewInt(0)) != 0 {
-		err := state.SetPC(rawTarget)
-		return mods, err
+		if err := state.SetPC(rawTarget); err != nil {
+			mods.failedOn(0, stack.PopValue)
+			return mods, err
+		}
+		return mods, nil
 	} else {
 		state.IncrPC()
 		return mods, nil
@@ -901,10 +910,7 @@ func insnTget(state *Machine) (StackMods, error) {
 
 	val, err := tuple.Get(index)
 	if err != nil {
-		// index out of range
-		fmt.Println(state.stack)
-		fmt.Println("pc = ", state.pc.GetPC())
-		return mods, fmt.Errorf("insn_tget: index %v out of range %v", index.BigInt(), tuple.Len())
+		return mods, TupleIndexError{Index: index, Length: tuple.Len()}
 	} else {
 		mods = PushStackBox(state, mods, val)
 	}
@@ -932,7 +938,7 @@ func insnTset(state *Machine) (StackMods, error) {
 
 	newTup, err := tuple.Set(index, newVal)
 	if err != nil {
-		return mods, fmt.Errorf("insn_tset: index %v out of range of tuple %v", index, tuple)
+		return mods, TupleIndexError{Index: index, Length: tuple.Len()}
 	} else {
 		mods = PushStackTuple(state, mods, newTup)
 	}
@@ -979,17 +985,17 @@ func insnLog(state *Machine) (StackMods, error) {
 	return mods, nil
 }
 
+const sendTupleType = "Tuple of (data, destination Int, amount Int, token type Int)"
+
 func sendImpl(state *Machine) (value.TupleValue, value.Value, value.IntValue, value.IntValue, value.IntValue, StackMods, error) {
 	mods := NewStackMods(1, 0)
 	sendData, mods, err := PopStackTuple(state, mods)
 	if err != nil {
-		// mods, err := handlePopError(state, mods, err)
 		return value.NewEmptyTuple(), nil, value.NewInt64Value(0), value.NewInt64Value(0), value.NewInt64Value(0), mods, err
 	}
 
 	if sendData.Len() != 4 {
-		// mods, err := handlePopError(state, mods, PopTypeWarning{"Inbox pop tuple wrong", mods})
-		return sendData, nil, value.NewInt64Value(0), value.NewInt64Value(0), value.NewInt64Value(0), mods, err
+		return sendData, nil, value.NewInt64Value(0), value.NewInt64Value(0), value.NewInt64Value(0), mods, TypeMismatchError{Expected: sendTupleType, Actual: sendData}
 	}
 
 	data, _ := sendData.GetByInt64(0)
@@ -1002,8 +1008,8 @@ func sendImpl(state *Machine) (value.TupleValue, value.Value, value.IntValue, va
 	tokenType, ok4 := val4.(value.IntValue)
 
 	if !ok2 || !ok3 || !ok4 {
-		// mods, err := handlePopError(state, mods, PopTypeWarning{"Inbox pop tuple wrong", mods})
-		return sendData, nil, value.NewInt64Value(0), value.NewInt64Value(0), value.NewInt64Value(0), mods, err
+		mods.failedOn(0, stack.PopValueItems)
+		return sendData, nil, value.NewInt64Value(0), value.NewInt64Value(0), value.NewInt64Value(0), mods, TypeMismatchError{Expected: sendTupleType, Actual: sendData}
 	}
 
 	return sendData, data, tokenType, amount, destination, mods, nil
@@ -1031,16 +1037,14 @@ func insnNBSend(state *Machine) (StackMods, error) {
 		return mods, err
 	}
 
-	if !state.CanSpend(tokenType, amount) {
+	err = state.Send(data, tokenType, amount, destination)
+	if err == errLowBalance {
+		mods = PushStackInt(state, mods, value.NewInt64Value(0))
+	} else if err != nil {
+		state.Warn(err.Error())
 		mods = PushStackInt(state, mods, value.NewInt64Value(0))
 	} else {
-		err := state.Send(data, tokenType, amount, destination)
-		if err != nil {
-			state.Warn(err.Error())
-			mods = PushStackInt(state, mods, value.NewInt64Value(0))
-		} else {
-			mods = PushStackInt(state, mods, value.NewInt64Value(1))
-		}
+		mods = PushStackInt(state, mods, value.NewInt64Value(1))
 	}
 	state.IncrPC()
 	return mods, nil
@@ -1058,3 +1062,128 @@ func insnDebug(state *Machine) (StackMods, error) {
 	state.IncrPC()
 	return mods, nil
 }
+
+func insnBufnew(state *Machine) (StackMods, error) {
+	mods := NewStackMods(1, 1)
+	size, mods, err := PopStackInt(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	if !size.BigInt().IsInt64() {
+		return mods, buffer.RangeError{Msg: fmt.Sprintf("size %v", size)}
+	}
+	b, err := buffer.New(size.BigInt().Int64())
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackBox(state, mods, b.Value())
+	state.IncrPC()
+	return mods, nil
+}
+
+func insnBuflen(state *Machine) (StackMods, error) {
+	mods := NewStackMods(1, 1)
+	// the size is the first item of the buffer, so a proof doesn't need the
+	// rest of it
+	tup, mods, err := PopStackTupleWithItems(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	size, err := buffer.DecodeSize(tup)
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackInt(state, mods, value.NewInt64Value(size))
+	state.IncrPC()
+	return mods, nil
+}
+
+func insnBufget(state *Machine) (StackMods, error) {
+	mods := NewStackMods(2, 1)
+	offset, mods, err := PopStackInt(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	b, mods, err := PopStackBuffer(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	word, err := b.Read(offset.BigInt())
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackInt(state, mods, value.NewIntValue(word))
+	state.IncrPC()
+	return mods, nil
+}
+
+// bufferWrite runs an instruction that pops an offset, a buffer and an int,
+// and pushes the buffer that write returns
+func bufferWrite(state *Machine, write func(b buffer.Buffer, offset *big.Int, x *big.Int) (buffer.Buffer, error)) (StackMods, error) {
+	mods := NewStackMods(3, 1)
+	offset, mods, err := PopStackInt(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	b, mods, err := PopStackBuffer(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	x, mods, err := PopStackInt(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	ret, err := write(b, offset.BigInt(), x.BigInt())
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackBox(state, mods, ret.Value())
+	state.IncrPC()
+	return mods, nil
+}
+
+func insnBufset(state *Machine) (StackMods, error) {
+	return bufferWrite(state, buffer.Buffer.Write)
+}
+
+func insnBufset8(state *Machine) (StackMods, error) {
+	return bufferWrite(state, buffer.Buffer.Write8)
+}
+
+func insnBufslice(state *Machine) (StackMods, error) {
+	return bufferWrite(state, buffer.Buffer.Slice)
+}
+
+func insnKeccak(state *Machine) (StackMods, error) {
+	mods := NewStackMods(1, 1)
+	b, mods, err := PopStackBuffer(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	hash, err := b.Keccak()
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackInt(state, mods, value.NewIntValue(hash))
+	state.IncrPC()
+	return mods, nil
+}
+
+func insnEcrecover(state *Machine) (StackMods, error) {
+	mods := NewStackMods(2, 1)
+	hash, mods, err := PopStackInt(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	sig, mods, err := PopStackBuffer(state, mods)
+	if err != nil {
+		return mods, err
+	}
+	addr, err := buffer.Ecrecover(hash.BigInt(), sig)
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackInt(state, mods, value.NewIntValue(addr))
+	state.IncrPC()
+	return mods, nil
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestBufferInstructions(t *testing.T) {
+	word := value.NewIntValue(new(big.Int).Lsh(big.NewInt(0xabcd), 200))
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: code.BUFNEW, Val: value.NewInt64Value(100)},
+		// write word at 40
+		value.ImmediateOperation{Op: code.NOP, Val: word},
+		value.BasicOperation{Op: code.SWAP1},
+		value.ImmediateOperation{Op: code.BUFSET, Val: value.NewInt64Value(40)},
+		// set byte 99 to 7
+		value.ImmediateOperation{Op: code.NOP, Val: value.NewInt64Value(0x107)},
+		value.BasicOperation{Op: code.SWAP1},
+		value.ImmediateOperation{Op: code.BUFSET8, Val: value.NewInt64Value(99)},
+		// read the word back, and the last byte from the slice of it
+		value.BasicOperation{Op: code.DUP0},
+		value.ImmediateOperation{Op: code.BUFGET, Val: value.NewInt64Value(40)},
+		value.BasicOperation{Op: code.SWAP1},
+		value.ImmediateOperation{Op: code.NOP, Val: value.NewInt64Value(20)},
+		value.BasicOperation{Op: code.SWAP1},
+		value.ImmediateOperation{Op: code.BUFSLICE, Val: value.NewInt64Value(80)},
+		value.BasicOperation{Op: code.DUP0},
+		value.BasicOperation{Op: code.BUFLEN},
+		value.BasicOperation{Op: code.SWAP1},
+		value.ImmediateOperation{Op: code.BUFGET, Val: value.NewInt64Value(19)},
+		value.BasicOperation{Op: code.HALT},
+	}
+	m := NewMachine(insns, value.NewInt64Value(1), false, 10000)
+	m.ExecuteAssertion(100, protocol.NewTimeBounds(0, 100))
+	if !m.IsHalted() {
+		t.Fatal("machine didn't halt")
+	}
+	want := []*big.Int{
+		new(big.Int).Lsh(big.NewInt(7), 248),
+		big.NewInt(20),
+		word.BigInt(),
+	}
+	for _, w := range want {
+		got, err := m.Stack().PopInt()
+		if err != nil || got.BigInt().Cmp(w) != 0 {
+			t.Errorf("got %v, expected %v", got, w)
+		}
+	}
+
+	buf, _ := buffer.New(10)
+	errorCases := []struct {
+		name   string
+		op     value.Opcode
+		stack  []value.Value // pushed in order
+		target interface{}
+	}{
+		{"bufnew too big", code.BUFNEW, []value.Value{value.NewInt64Value(buffer.MaxSize + 1)}, &BufferRangeError{}},
+		{"bufset past the end", code.BUFSET, []value.Value{value.NewInt64Value(1), buf.Value(), value.NewInt64Value(0)}, &BufferRangeError{}},
+		{"bufget of an int", code.BUFGET, []value.Value{value.NewInt64Value(1), value.NewInt64Value(0)}, &TypeMismatchError{}},
+	}
+	for _, tc := range errorCases {
+		m := NewMachine(insns, value.NewInt64Value(1), false, 10000)
+		m.SetWarningHandler(NewSilentWarningHandler())
+		for _, val := range tc.stack {
+			m.Stack().Push(val)
+		}
+		if _, err := RunInstruction(m, value.BasicOperation{Op: tc.op}); !errors.As(err, tc.target) {
+			t.Errorf("%v: got %v", tc.name, err)
+		}
+		if !m.IsErrored() || m.Stack().Count() != 0 {
+			t.Errorf("%v: machine didn't fail", tc.name)
+		}
+	}
+}
+
+func TestKeccakStepCost(t *testing.T) {
+	tb := protocol.NewTimeBounds(0, 100)
+	for _, size := range []int64{0, 3, 32, 33, 1000, buffer.MaxSize} {
+		b, _ := buffer.New(size)
+		cost := code.InstructionStepCosts[code.KECCAK] + int((size+31)/32)*code.KeccakWordStepCost
+		ops := map[string][]value.Operation{
+			"stack": {
+				value.ImmediateOperation{Op: code.NOP, Val: b.Value()},
+				value.BasicOperation{Op: code.KECCAK},
+				value.BasicOperation{Op: code.HALT},
+			},
+			"immediate": {
+				value.BasicOperation{Op: code.NOP},
+				value.ImmediateOperation{Op: code.KECCAK, Val: b.Value()},
+				value.BasicOperation{Op: code.HALT},
+			},
+		}
+		for name, insns := range ops {
+			m := NewMachine(insns, value.NewInt64Value(1), false, 1000000)
+			if a := m.ExecuteAssertion(int32(cost), tb); a.NumSteps != 1 || m.GetOperation().GetOp() != code.KECCAK {
+				t.Errorf("size %v, %v: assertion of %v steps took %v steps", size, name, cost, a.NumSteps)
+			}
+			if m.NextStepCost() != cost {
+				t.Errorf("size %v, %v: keccak costs %v steps, rather than %v", size, name, m.NextStepCost(), cost)
+			}
+			// the assertion stops at the budget, before the keccak
+			if a := m.ExecuteAssertion(int32(cost-1), tb); a.NumSteps != 0 || m.GetOperation().GetOp() != code.KECCAK {
+				t.Errorf("size %v, %v: keccak ran in an assertion of %v steps", size, name, cost-1)
+			}
+			if a := m.ExecuteAssertion(int32(cost+1), tb); a.NumSteps != uint32(cost+1) || !m.IsHalted() {
+				t.Errorf("size %v, %v: assertion took %v steps, rather than %v", size, name, a.NumSteps, cost+1)
+			}
+		}
+	}
+}
+
+func TestKeccakEcrecover(t *testing.T) {
+	sigBytes, _ := hexutil.Decode("0x38d18acb67d25c8bb9942764b62f18e17054f66a817bd4295423adf9ed98873e789d1dd423d25f0772d2748d60f7e4b81bb14d086eba8e8e8efb6dcff8a4ae021b")
+	sig, _ := buffer.FromBytes(sigBytes)
+	hash, _ := new(big.Int).SetString("38d18acb67d25c8bb9942764b62f18e17054f66a817bd4295423adf9ed98873e", 16)
+	data, _ := buffer.FromBytes([]byte("abc"))
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: code.NOP, Val: sig.Value()},
+		value.ImmediateOperation{Op: code.ECRECOVER, Val: value.NewIntValue(hash)},
+		value.ImmediateOperation{Op: code.KECCAK, Val: data.Value()},
+		value.BasicOperation{Op: code.HALT},
+	}
+	tb := protocol.NewTimeBounds(0, 100)
+	// the keccak hashes one word
+	steps := uint32(1 + code.InstructionStepCosts[code.ECRECOVER] + code.InstructionStepCosts[code.KECCAK] + code.KeccakWordStepCost + 1)
+
+	m := NewMachine(insns, value.NewInt64Value(1), false, 10000)
+	a := m.ExecuteAssertion(int32(steps), tb)
+	if !m.IsHalted() || a.NumSteps != steps {
+		t.Fatalf("assertion took %v steps, rather than %v", a.NumSteps, steps)
+	}
+	want := []string{
+		"4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45",
+		"ceaccac640adf55b2028469bd36ba501f28b699d",
+	}
+	for _, w := range want {
+		got, err := m.Stack().PopInt()
+		if err != nil || fmt.Sprintf("%x", got.BigInt()) != w {
+			t.Errorf("got %v, expected %v", got, w)
+		}
+	}
+
+	// the assertion stops before the ecrecover, which would take it past its
+	// limit of two
+	short := NewMachine(insns, value.NewInt64Value(1), false, 10000)
+	if a := short.ExecuteAssertion(2, tb); a.NumSteps != 1 || short.GetOperation().GetOp() != code.ECRECOVER {
+		t.Errorf("short assertion took %v steps", a.NumSteps)
+	}
+	if a := short.ExecuteAssertion(2, tb); a.NumSteps != 0 || short.GetOperation().GetOp() != code.ECRECOVER {
+		t.Errorf("ecrecover ran in an assertion of %v steps", a.NumSteps)
+	}
+
+	// a cut point falls before an instruction of several steps that spans
+	// its step
+	start := NewMachine(insns, value.NewInt64Value(1), false, 10000)
+	b, cuts := start.Clone().(*Machine).ExecuteAssertionWithCutPoints(int32(steps), 4, tb)
+	if b.NumSteps != a.NumSteps || b.AfterHash != a.AfterHash {
+		t.Errorf("assertion with cut points took %v steps to %x", b.NumSteps, b.AfterHash)
+	}
+	for i, want := range []uint32{1, 1, 1, steps} {
+		if cuts[i].Steps != want {
+			t.Errorf("cut point %v is at step %v", i, cuts[i].Steps)
+		}
+	}
+	from := CutPoint{Steps: 0, MachineHash: start.Hash()}
+	saved := start
+	for i, to := range cuts {
+		if err := VerifySegment(saved, from, to, tb); err != nil {
+			t.Errorf("segment %v: %v", i, err)
+		}
+		saved = saved.Clone().(*Machine)
+		saved.ExecuteAssertion(int32(to.Steps-from.Steps), tb)
+		from = to
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/buffer"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// InstructionDef defines an instruction of an instruction set
+type InstructionDef struct {
+	Code value.Opcode
+	Name string
+	// the values the instruction pops from each stack, top first, as in
+	// code.InstructionStackPops
+	StackPops    []byte
+	AuxStackPops []byte
+	// the number of values it pushes onto each stack when it succeeds
+	StackPushes    int
+	AuxStackPushes int
+	// the number of steps of an assertion the instruction counts as, as in
+	// code.InstructionStepCosts. Zero counts as one.
+	StepCost int
+	// ExtraStepCost, if set, gives the steps the instruction counts as on
+	// top of StepCost when m is about to run op, for an instruction whose
+	// work depends on its operands. It mustn't change m.
+	ExtraStepCost func(m *Machine, op value.Operation) int
+	// Impl runs the instruction, using NewStackMods and the Pop and Push
+	// functions to change the stack, and moves the PC on
+	Impl func(*Machine) (StackMods, error)
+}
+
+// InstructionSet is the set of instructions a machine runs. Machines run the
+// standard set unless given another with WithInstructionSet or
+// SetInstructionSet.
+type InstructionSet struct {
+	defs [256]*InstructionDef
+}
+
+// standardInstructions is the default set, which is never changed
+var standardInstructions *InstructionSet
+
+func init() {
+	standardInstructions = &InstructionSet{}
+	for _, ins := range allInsns {
+		pops := code.InstructionStackPops[ins.code]
+		auxPops := code.InstructionAuxStackPops[ins.code]
+		standardInstructions.defs[ins.code] = &InstructionDef{
+			ins.code,
+			code.InstructionNames[ins.code],
+			pops,
+			auxPops,
+			standardPushes[ins.code],
+			standardAuxPushes[ins.code],
+			atLeastOne(code.InstructionStepCosts[ins.code]),
+			standardExtraStepCosts[ins.code],
+			ins.impl,
+		}
+	}
+}
+
+// NewInstructionSet returns a set holding the standard instructions, to which
+// more can be added with Register
+func NewInstructionSet() *InstructionSet {
+	s := *standardInstructions
+	return &s
+}
+
+// Register adds an instruction to the set. Its opcode mustn't already be in
+// use. The set mustn't be changed while a machine is running it, so register
+// every instruction before running any machine with the set.
+func (s *InstructionSet) Register(def InstructionDef) error {
+	if def.Impl == nil {
+		return fmt.Errorf("Register: instruction %v has no implementation", def.Name)
+	}
+	if existing := s.defs[def.Code]; existing != nil {
+		return fmt.Errorf("Register: opcode 0x%02x is already %v", def.Code, existing.Name)
+	}
+	if len(def.StackPops) > MaxStackPops || len(def.AuxStackPops) > MaxAuxStackPops {
+		return fmt.Errorf("Register: instruction %v pops more values than a proof can hold", def.Name)
+	}
+	def.StepCost = atLeastOne(def.StepCost)
+	s.defs[def.Code] = &def
+	return nil
+}
+
+func atLeastOne(cost int) int {
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
+
+// StepCost returns the number of steps op counts as, leaving out the extra
+// steps of an instruction whose cost depends on its operands. An opcode the
+// set doesn't have is one step, in which it fails.
+func (s *InstructionSet) StepCost(op value.Opcode) int {
+	if def := s.defs[op]; def != nil {
+		return def.StepCost
+	}
+	return 1
+}
+
+// stepCostAt returns the number of steps op counts as when m is about to run
+// it
+func (s *InstructionSet) stepCostAt(m *Machine, op value.Operation) int {
+	def := s.defs[op.GetOp()]
+	if def == nil {
+		return 1
+	}
+	if def.ExtraStepCost == nil {
+		return def.StepCost
+	}
+	return def.StepCost + def.ExtraStepCost(m, op)
+}
+
+// Lookup returns the definition of an opcode, if the set has one
+func (s *InstructionSet) Lookup(op value.Opcode) (InstructionDef, bool) {
+	if def := s.defs[op]; def != nil {
+		return *def, true
+	}
+	return InstructionDef{}, false
+}
+
+// Name returns the name of an opcode, or its number if the set doesn't have
+// it
+func (s *InstructionSet) Name(op value.Opcode) string {
+	if def := s.defs[op]; def != nil {
+		return def.Name
+	}
+	return fmt.Sprintf("0x%02x", op)
+}
+
+// standardPushes and standardAuxPushes list the values each standard
+// instruction pushes, where it pushes any
+var standardPushes = map[value.Opcode]int{
+	code.ADD: 1, code.MUL: 1, code.SUB: 1, code.DIV: 1, code.SDIV: 1,
+	code.MOD: 1, code.SMOD: 1, code.ADDMOD: 1, code.MULMOD: 1, code.EXP: 1,
+
+	code.LT: 1, code.GT: 1, code.SLT: 1, code.SGT: 1, code.EQ: 1,
+	code.ISZERO: 1, code.AND: 1, code.OR: 1, code.XOR: 1, code.NOT: 1,
+	code.BYTE: 1, code.SIGNEXTEND: 1,
+
+	code.SHA3: 1, code.TYPE: 1,
+
+	code.SPUSH: 1, code.RPUSH: 1, code.STACKEMPTY: 1, code.PCPUSH: 1,
+	code.AUXPOP: 1, code.AUXSTACKEMPTY: 1, code.ERRPUSH: 1,
+
+	code.DUP0: 2, code.DUP1: 3, code.DUP2: 4, code.SWAP1: 2, code.SWAP2: 3,
+
+	code.TGET: 1, code.TSET: 1, code.TLEN: 1,
+
+	code.NBSEND: 1, code.GETTIME: 1, code.INBOX: 1,
+
+	code.BUFNEW: 1, code.BUFLEN: 1, code.BUFGET: 1, code.BUFSET: 1,
+	code.BUFSET8: 1, code.BUFSLICE: 1,
+
+	code.KECCAK: 1, code.ECRECOVER: 1,
+}
+
+var standardAuxPushes = map[value.Opcode]int{
+	code.AUXPUSH: 1,
+}
+
+var standardExtraStepCosts = map[value.Opcode]func(*Machine, value.Operation) int{
+	code.KECCAK: keccakExtraStepCost,
+}
+
+// keccakExtraStepCost charges KECCAK for each word of the buffer it hashes.
+// An operand that isn't a buffer costs nothing extra, since KECCAK fails on
+// it.
+func keccakExtraStepCost(m *Machine, op value.Operation) int {
+	var val value.Value
+	if imm, ok := op.(value.ImmediateOperation); ok {
+		val = imm.Val
+	} else {
+		top, err := m.stack.Peek()
+		if err != nil {
+			return 0
+		}
+		val = top
+	}
+	size, err := buffer.DecodeSize(val)
+	if err != nil {
+		return 0
+	}
+	return int((size+31)/32) * code.KeccakWordStepCost
+}
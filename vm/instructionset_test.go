@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// freeOpcodes returns the opcodes the standard set doesn't use, so that the
+// experimental instructions never collide with standard ones added later
+func freeOpcodes() []value.Opcode {
+	var ret []value.Opcode
+	for op := 0; op < len(standardInstructions.defs); op++ {
+		if standardInstructions.defs[op] == nil {
+			ret = append(ret, value.Opcode(op))
+		}
+	}
+	return ret
+}
+
+// insnTriple is an experimental instruction that triples an integer
+func insnTriple(m *Machine) (StackMods, error) {
+	mods := NewStackMods(1, 1)
+	x, mods, err := PopStackInt(m, mods)
+	if err != nil {
+		return mods, err
+	}
+	mods = PushStackInt(m, mods, value.NewIntValue(new(big.Int).Mul(x.BigInt(), big.NewInt(3))))
+	m.IncrPC()
+	return mods, nil
+}
+
+func TestInstructionSet(t *testing.T) {
+	free := freeOpcodes()
+	tripleOpcode, spareOpcode := free[0], free[1]
+	set := NewInstructionSet()
+	triple := InstructionDef{
+		Code:        tripleOpcode,
+		Name:        "triple",
+		StackPops:   []byte{1},
+		StackPushes: 1,
+		Impl:        insnTriple,
+	}
+	if err := set.Register(triple); err != nil {
+		t.Fatal(err)
+	}
+	if def, ok := set.Lookup(tripleOpcode); !ok || def.Name != "triple" || set.Name(tripleOpcode) != "triple" {
+		t.Error("registered instruction isn't in the set")
+	}
+	if set.StepCost(tripleOpcode) != 1 || set.StepCost(code.KECCAK) != code.InstructionStepCosts[code.KECCAK] {
+		t.Error("set has the wrong step costs")
+	}
+	if def, ok := set.Lookup(code.ADD); !ok || def.Name != "add" || len(def.StackPops) != 2 || def.StackPushes != 1 {
+		t.Error("set doesn't have the standard instructions")
+	}
+	if _, ok := NewInstructionSet().Lookup(tripleOpcode); ok {
+		t.Error("registering changed the standard set")
+	}
+
+	badDefs := map[string]InstructionDef{
+		"taken opcode":     {Code: code.ADD, Name: "add2", Impl: insnTriple},
+		"no impl":          {Code: spareOpcode, Name: "none"},
+		"too many pops":    {Code: spareOpcode, Name: "big", StackPops: []byte{1, 1, 1, 1}, Impl: insnTriple},
+		"registered twice": triple,
+	}
+	for name, def := range badDefs {
+		if err := set.Register(def); err == nil {
+			t.Errorf("%v: registered", name)
+		}
+	}
+
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: tripleOpcode, Val: value.NewInt64Value(7)},
+		value.BasicOperation{Op: code.HALT},
+	}
+	tb := protocol.NewTimeBounds(0, 100)
+	standard := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	standard.ExecuteAssertion(10, tb)
+	if !standard.IsErrored() {
+		t.Error("standard machine ran an experimental instruction")
+	}
+
+	m := NewMachine(insns, value.NewInt64Value(1), false, 100)
+	m.SetInstructionSet(set)
+	clone := m.Clone().(*Machine)
+	constructed := NewMachine(insns, value.NewInt64Value(1), false, 100, WithInstructionSet(set))
+	restored, err := RestoreMachine(insns, value.NewEmptyTuple(), value.NewEmptyTuple(), value.NewEmptyTuple(), value.NewInt64Value(1), m.GetPC(), value.ErrorCodePoint, 100, stack.KindFlat, WithInstructionSet(set))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewMachine(insns, value.NewInt64Value(1), false, 100, WithInstructionSet(nil)).InstructionSet() != standardInstructions {
+		t.Error("a nil instruction set isn't the standard one")
+	}
+	for _, mach := range []*Machine{m, clone, constructed, restored} {
+		mach.ExecuteAssertion(10, tb)
+		if !mach.IsHalted() {
+			t.Fatal("machine didn't run the experimental instruction")
+		}
+		top, err := mach.Stack().PopInt()
+		if err != nil || top.BigInt().Int64() != 21 {
+			t.Errorf("experimental instruction left %v, %v", top, err)
+		}
+	}
+
+	// errors, warnings and dumps name the registered instruction
+	failing := NewMachine([]value.Operation{
+		value.ImmediateOperation{Op: code.NOP, Val: value.NewTuple2(value.NewInt64Value(1), value.NewInt64Value(2))},
+		value.BasicOperation{Op: tripleOpcode},
+	}, value.NewInt64Value(1), false, 100)
+	failing.SetInstructionSet(set)
+	warnings := NewBufferWarningHandler(10)
+	failing.SetWarningHandler(warnings)
+	failing.ExecuteAssertion(1, tb)
+	if failing.Dump().PC.Mnemonic != "triple" {
+		t.Error("dump doesn't name the experimental instruction")
+	}
+	failing.ExecuteAssertion(1, tb)
+	if ws := warnings.Warnings(); len(ws) != 1 {
+		t.Fatalf("got %v warnings", len(ws))
+	} else if !strings.Contains(ws[0].String(), "(triple)") || !strings.Contains(ws[0].Err.Error(), "triple at pc 1") {
+		t.Errorf("error doesn't name the experimental instruction: %v", ws[0])
+	}
+}
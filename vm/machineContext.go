@@ -28,6 +28,9 @@ type MachineAssertionContext struct {
 	numSteps   uint32
 	outMsgs    []protocol.Message
 	logs       []value.Value
+	// accumulated hashes of outMsgs and logs, for cut points
+	messagesHash [32]byte
+	logsHash     [32]byte
 }
 
 func NewMachineAssertionContext(m *Machine, timeBounds protocol.TimeBounds) *MachineAssertionContext {
@@ -38,6 +41,8 @@ func NewMachineAssertionContext(m *Machine, timeBounds protocol.TimeBounds) *Mac
 		0,
 		outMsgs,
 		make([]value.Value, 0),
+		[32]byte{},
+		[32]byte{},
 	}
 	ret.machine.SetContext(ret)
 	return ret
@@ -45,6 +50,7 @@ func NewMachineAssertionContext(m *Machine, timeBounds protocol.TimeBounds) *Mac
 
 func (ac *MachineAssertionContext) LoggedValue(data value.Value) error {
 	ac.logs = append(ac.logs, data)
+	ac.logsHash = AccumulateHash(ac.logsHash, data)
 	return nil
 }
 
@@ -54,6 +60,7 @@ func (ac *MachineAssertionContext) Send(data value.Value, tokenType value.IntVal
 	copy(tokType[:], tokBytes[:])
 	newMsg := protocol.NewMessage(data, tokType, currency.BigInt(), dest.ToBytes())
 	ac.outMsgs = append(ac.outMsgs, newMsg)
+	ac.messagesHash = AccumulateHash(ac.messagesHash, newMsg.AsValue())
 	return nil
 }
 
@@ -20,52 +20,37 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/warning"
 	"github.com/offchainlabs/arb-util/value"
 )
 
+// CodeSaveFrequency is how often a code segment keeps the hash of a code
+// point, unless it is built with NewCodeSegmentWithFrequency
 const CodeSaveFrequency = 2
 
 var HashOfLastInstruction [32]byte
 
 type MachinePC struct {
 	// implements Machinestate
-	warn        WarningHandler
-	flat        []value.Operation
-	savedValues []value.CodePointValue
-	pc          int64 // -1 if machine has halted, otherwise index into code
+	warn WarningHandler
+	code *CodeSegment
+	pc   int64 // -1 if machine has halted, otherwise index into code
+	// the machine's instruction set, for the names of its instructions
+	insnSet *InstructionSet
 }
 
 func NewMachinePC(insns []value.Operation, handler WarningHandler) *MachinePC {
-	flat := make([]value.Operation, len(insns))
-	copy(flat, insns)
-	savedValues := make([]value.CodePointValue, len(insns)/CodeSaveFrequency+1)
-
-	prevHash := HashOfLastInstruction
-	var codePoint value.CodePointValue
-	for i := int64(len(insns) - 1); i >= 0; i-- {
-		codePoint = value.CodePointValue{InsnNum: i, Op: insns[i], NextHash: prevHash}
-		prevHash = codePoint.Hash()
-		if i%CodeSaveFrequency == 0 {
-			savedValues[i/CodeSaveFrequency] = codePoint
-		}
-	}
-	return &MachinePC{handler, flat, savedValues, 0}
+	return NewMachinePCFromCode(LoadCodeSegment(insns), handler)
+}
+
+// NewMachinePCFromCode returns a PC at the start of code
+func NewMachinePCFromCode(code *CodeSegment, handler WarningHandler) *MachinePC {
+	return &MachinePC{handler, code, 0, standardInstructions}
 }
 
 func (s *MachinePC) Equal(y *MachinePC) (bool, string) {
-	for i := range s.flat {
-		if s.flat[i].GetOp() != y.flat[i].GetOp() {
-			return false, "MachinePC flat Op different"
-		}
-		if s.flat[i].TypeCode() != y.flat[i].TypeCode() {
-			return false, "MachinePC flat TypeCode different"
-		}
-	}
-	for i := range s.savedValues {
-		if !(value.Eq(s.savedValues[i], y.savedValues[i])) {
-			return false, "Flat stack savedValues different"
-		}
+	if !s.code.Equal(y.code) {
+		return false, "MachinePC code different"
 	}
 	if s.pc != y.pc {
 		return false, "Flat stack PC different"
@@ -75,50 +60,55 @@ func (s *MachinePC) Equal(y *MachinePC) (bool, string) {
 }
 
 func (m MachinePC) GetCurrentInsn() value.Operation {
-	return m.flat[m.pc]
+	return m.code.Op(m.pc)
 }
 
 func (m MachinePC) GetCurrentInsnName() string {
 	if m.pc >= 0 {
-		return code.InstructionNames[m.flat[m.pc].GetOp()]
+		return m.insnSet.Name(m.code.Op(m.pc).GetOp())
 	} else {
 		panic("Bad pc")
 	}
 }
 
-func (m MachinePC) GetPC() value.CodePointValue {
-	if m.pc >= int64(len(m.flat)) || m.pc < 0 {
+func (m MachinePC) checkPC() {
+	if m.pc >= m.code.Len() || m.pc < 0 {
 		panic(fmt.Sprintf("Invalid pc: %v", m.pc))
 	}
-	if m.pc == int64(len(m.flat))-1 {
-		return value.CodePointValue{InsnNum: m.pc, Op: m.flat[m.pc], NextHash: HashOfLastInstruction}
-	}
+}
 
-	lookupPoint := (m.pc + CodeSaveFrequency - 1) / CodeSaveFrequency
-	codePoint := m.savedValues[lookupPoint]
-	curPC := lookupPoint * CodeSaveFrequency
+func (m MachinePC) GetPC() value.CodePointValue {
+	m.checkPC()
+	return m.code.CodePoint(m.pc)
+}
 
-	if curPC == m.pc {
-		return codePoint
-	} else {
-		for i := curPC - 1; i >= m.pc; i-- {
-			codePoint = value.CodePointValue{InsnNum: i, Op: m.flat[i], NextHash: codePoint.Hash()}
-		}
-		return codePoint
-	}
+func (m MachinePC) CodeHash() [32]byte {
+	return m.code.Hash()
 }
 
 func (m MachinePC) GetCurrentCodePointHash() [32]byte {
 	if m.pc == -1 {
 		return HashOfLastInstruction
 	} else {
-		return m.GetPC().Hash()
+		m.checkPC()
+		return m.code.CodePointHash(m.pc)
+	}
+}
+
+// newWarning returns a warning about the current instruction
+func (m *MachinePC) newWarning(msg string) warning.Warning {
+	w := warning.New(msg)
+	if m.pc >= 0 && m.pc < m.code.Len() {
+		w.PC = m.pc
+		w.Opcode = m.code.Op(m.pc).GetOp()
+		w.Name = m.insnSet.Name(w.Opcode)
 	}
+	return w
 }
 
 func (m *MachinePC) IncrPC() error {
 	m.pc = 1 + m.pc
-	if m.pc >= int64(len(m.flat)) {
+	if m.pc >= m.code.Len() {
 		return errors.New("IncrPC: PC reached end and halted")
 	}
 	return nil
@@ -130,8 +120,8 @@ func (m *MachinePC) SetPCForced(iv value.Value) error {
 		return errors.New("SetPC: tried to set PC to unknown value. Cannot set PC")
 	}
 	iv64 := codePointVal.InsnNum
-	if !(iv64 >= -2 && iv64 < int64(len(m.flat))) {
-		m.warn.Warn("SetPC: set PC to invalid value")
+	if !(iv64 >= -2 && iv64 < m.code.Len()) {
+		m.warn.Warn(m.newWarning("SetPC: set PC to invalid value"))
 	}
 	m.pc = iv64
 	return nil
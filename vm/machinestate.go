@@ -18,8 +18,10 @@ package vm
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 
 	solsha3 "github.com/miguelmota/go-solidity-sha3"
 	"github.com/offchainlabs/arb-avm/code"
@@ -27,8 +29,6 @@ import (
 	"github.com/offchainlabs/arb-util/machine"
 	"github.com/offchainlabs/arb-util/protocol"
 	"github.com/offchainlabs/arb-util/value"
-
-	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
 type MachineStatus int
@@ -43,6 +43,7 @@ type Machine struct {
 	// implements Machinestate
 	stack      stack.Stack
 	auxstack   stack.Stack
+	stackKind  stack.Kind
 	register   *MachineValue
 	static     *MachineValue
 	pc         *MachinePC
@@ -54,42 +55,52 @@ type Machine struct {
 
 	sizeLimit     int64
 	sizeException bool
+	// whether jump targets must match the program's code points exactly
+	strictJumps bool
+	insnSet     *InstructionSet
 
 	warnHandler WarningHandler
 }
 
+// Equal compares the stacks, register, static and error handler of two
+// machines, and describes the first difference. Use Diff for a full
+// comparison.
 func Equal(x, y *Machine) (bool, string) {
-	if ok, err := x.stack.Equal(y.stack); !ok {
-		tmp := "stack error: "
-		tmp += err
-		return false, tmp
-	}
-	if ok, err := x.auxstack.Equal(y.auxstack); !ok {
-		tmp := "auxstack error: "
-		tmp += err
-		return false, tmp
-	}
-	if ok, err := x.register.Equal(y.register); !ok {
-		tmp := "register error: "
-		tmp += err
-		return false, tmp
-	}
-	if ok, err := x.static.Equal(y.static); !ok {
-		tmp := "static error: "
-		tmp += err
-		return false, tmp
-	}
-	if ok := x.errHandler.Equal(y.errHandler); !ok {
-		return false, "err handlers not equal"
+	if diffs := diffData(x, y); len(diffs) > 0 {
+		return false, diffs[0].String()
 	}
 	return true, ""
 }
 
-func NewMachine(opCodes []value.Operation, staticVal value.Value, warn bool, sizeLimit int64) *Machine {
-	datastack := stack.NewEmptyFlat()
-	auxstack := stack.NewEmptyFlat()
-	// stack := NewTuple(value.NewEmptyTuple())
-	// auxstack := NewTuple(value.NewEmptyTuple())
+// MachineOption sets up a machine as it is constructed
+type MachineOption func(*Machine)
+
+// WithInstructionSet makes a machine run set rather than the standard
+// instructions. A nil set is the standard one.
+func WithInstructionSet(set *InstructionSet) MachineOption {
+	return func(m *Machine) {
+		if set == nil {
+			set = standardInstructions
+		}
+		m.SetInstructionSet(set)
+	}
+}
+
+func NewMachine(opCodes []value.Operation, staticVal value.Value, warn bool, sizeLimit int64, opts ...MachineOption) *Machine {
+	return NewMachineWithStackKind(opCodes, staticVal, warn, sizeLimit, stack.KindFlat, opts...)
+}
+
+// NewMachineWithStackKind is like NewMachine, but uses stackKind for the data
+// and aux stacks
+func NewMachineWithStackKind(opCodes []value.Operation, staticVal value.Value, warn bool, sizeLimit int64, stackKind stack.Kind, opts ...MachineOption) *Machine {
+	return NewMachineFromCode(LoadCodeSegment(opCodes), staticVal, warn, sizeLimit, stackKind, opts...)
+}
+
+// NewMachineFromCode is like NewMachineWithStackKind, but runs an already
+// built code segment, such as one from CodeSegmentByHash
+func NewMachineFromCode(code *CodeSegment, staticVal value.Value, warn bool, sizeLimit int64, stackKind stack.Kind, opts ...MachineOption) *Machine {
+	datastack := stack.NewEmpty(stackKind)
+	auxstack := stack.NewEmpty(stackKind)
 	register := NewMachineValue(value.NewEmptyTuple())
 	static := NewMachineValue(staticVal)
 	errHandler := value.ErrorCodePoint
@@ -97,15 +108,16 @@ func NewMachine(opCodes []value.Operation, staticVal value.Value, warn bool, siz
 	balance := protocol.NewBalanceTracker()
 	var wh WarningHandler
 	if warn {
-		wh = NewVerboseWarningHandler(nil)
+		wh = NewVerboseWarningHandler()
 	} else {
 		wh = NewSilentWarningHandler()
 	}
-	pc := NewMachinePC(opCodes, wh)
+	pc := NewMachinePCFromCode(code, wh)
 	wh.SwitchMachinePC(pc)
 	ret := &Machine{
 		datastack,
 		auxstack,
+		stackKind,
 		register,
 		static,
 		pc,
@@ -116,28 +128,69 @@ func NewMachine(opCodes []value.Operation, staticVal value.Value, warn bool, siz
 		balance,
 		sizeLimit,
 		false,
+		false,
+		standardInstructions,
 		wh,
 	}
+	for _, opt := range opts {
+		opt(ret)
+	}
 	ret.checkSize()
 	return ret
 }
 
-// func RestoreMachine(opCodes []value.Operation, stackVal, auxStackVal, registerVal, staticVal, pcVal value.Value, errHandlerVal value.CodePointValue, sizeLimit int64) *Machine {
-//	datastack := stack.FlatFromTupleChain(stackVal)
-//	auxStack := stack.FlatFromTupleChain(auxStackVal)
-//	register := NewMachineValue(registerVal)
-//	static := NewMachineValue(staticVal)
-//	wh := NewSilentWarningHandler()
-//	pc := NewMachinePC(opCodes, wh)
-//	wh.SwitchMachinePC(pc)
-//	pc.SetPCForced(pcVal)
-//	return &Machine{datastack, auxStack, register, static, pc, errHandlerVal, &machine.MachineNoContext{}, MACHINE_EXTENSIVE, sizeLimit, false, wh}
-//}
+// RestoreMachine rebuilds a machine from its code and the values of its
+// state, as saved by a checkpoint, with stacks of stackKind
+func RestoreMachine(opCodes []value.Operation, stackVal, auxStackVal, registerVal, staticVal, pcVal value.Value, errHandlerVal value.CodePointValue, sizeLimit int64, stackKind stack.Kind, opts ...MachineOption) (*Machine, error) {
+	return RestoreMachineFromCode(LoadCodeSegment(opCodes), stackVal, auxStackVal, registerVal, staticVal, pcVal, errHandlerVal, sizeLimit, stackKind, opts...)
+}
+
+// RestoreMachineFromCode is like RestoreMachine, but runs an already built
+// code segment
+func RestoreMachineFromCode(code *CodeSegment, stackVal, auxStackVal, registerVal, staticVal, pcVal value.Value, errHandlerVal value.CodePointValue, sizeLimit int64, stackKind stack.Kind, opts ...MachineOption) (*Machine, error) {
+	datastack := stack.FromTupleChain(stackKind, stackVal)
+	auxStack := stack.FromTupleChain(stackKind, auxStackVal)
+	register := NewMachineValue(registerVal)
+	static := NewMachineValue(staticVal)
+	wh := NewSilentWarningHandler()
+	pc := NewMachinePCFromCode(code, wh)
+	wh.SwitchMachinePC(pc)
+	if err := pc.SetPCForced(pcVal); err != nil {
+		return nil, err
+	}
+	ret := &Machine{
+		datastack,
+		auxStack,
+		stackKind,
+		register,
+		static,
+		pc,
+		errHandlerVal,
+		&machine.MachineNoContext{},
+		MACHINE_EXTENSIVE,
+		protocol.NewEmptyInbox(),
+		protocol.NewBalanceTracker(),
+		sizeLimit,
+		false,
+		false,
+		standardInstructions,
+		wh,
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret, nil
+}
 
 func (m *Machine) Stack() stack.Stack {
 	return m.stack
 }
 
+// StackKind returns the kind of the machine's data and aux stacks
+func (m *Machine) StackKind() stack.Kind {
+	return m.stackKind
+}
+
 func (m *Machine) AuxStack() stack.Stack {
 	return m.auxstack
 }
@@ -155,7 +208,11 @@ func (m *Machine) SetContext(mc machine.MachineContext) {
 }
 
 func (m *Machine) ReadInbox() value.Value {
-	return m.inbox.Receive()
+	inbox := m.inbox.Receive()
+	if ic, ok := m.context.(InputContext); ok {
+		return ic.ReadInbox(inbox)
+	}
+	return inbox
 }
 
 func (m *Machine) CanSpend(tokenType value.IntValue, currency value.IntValue) bool {
@@ -191,14 +248,70 @@ func (m *Machine) GetOperation() value.Operation {
 	return m.pc.GetCurrentInsn()
 }
 
+// CodeHash returns the hash of the machine's code, which is the hash of the
+// code point of its first instruction
+func (m *Machine) CodeHash() [32]byte {
+	return m.pc.CodeHash()
+}
+
+// CodeSegment returns the code segment the machine runs, which it shares
+// with every other machine running the same program
+func (m *Machine) CodeSegment() *CodeSegment {
+	return m.pc.code
+}
+
 func (m *Machine) GetAllOperations() []value.Operation {
-	ret := make([]value.Operation, len(m.pc.flat)) // be cautious; copy the slice
-	copy(ret, m.pc.flat)
-	return ret
+	return m.pc.code.Operations()
+}
+
+// SetStrictJumps sets whether the machine checks jump targets against its
+// program. By default a jump only needs a code point whose index is in the
+// program, and goes to the program's code point at that index, even if the
+// code point jumped to has a different instruction or next hash. In strict
+// mode that is an InvalidJumpError, as is setting such an error handler.
+func (m *Machine) SetStrictJumps(strict bool) {
+	m.strictJumps = strict
 }
 
+func (m *Machine) StrictJumps() bool {
+	return m.strictJumps
+}
+
+// SetInstructionSet sets the instructions the machine runs, like the
+// WithInstructionSet option does when it is constructed. Its clones run the
+// same set.
+func (m *Machine) SetInstructionSet(set *InstructionSet) {
+	m.insnSet = set
+	m.pc.insnSet = set
+}
+
+func (m *Machine) InstructionSet() *InstructionSet {
+	return m.insnSet
+}
+
+// checkJumpTarget returns an InvalidJumpError if iv isn't a code point, or in
+// strict mode, if it isn't a code point of the machine's program. Otherwise
+// a target out of range is only warned about, by SetPCForced.
+func (m *Machine) checkJumpTarget(iv value.Value) error {
+	target, ok := iv.(value.CodePointValue)
+	if !ok {
+		return InvalidJumpError{Target: iv}
+	}
+	if m.strictJumps {
+		if target.InsnNum < 0 || target.InsnNum >= m.pc.code.Len() || target.Hash() != m.pc.code.CodePointHash(target.InsnNum) {
+			return InvalidJumpError{Target: iv}
+		}
+	}
+	return nil
+}
+
+// SetPC jumps to iv, which must be a code point, and in strict mode a code
+// point of the machine's program
 func (m *Machine) SetPC(iv value.Value) error {
 	if !m.HaveSizeException() && !m.IsHalted() {
+		if err := m.checkJumpTarget(iv); err != nil {
+			return err
+		}
 		return m.pc.SetPCForced(iv)
 	}
 	return nil
@@ -236,50 +349,76 @@ func (m *Machine) GetSizeLimit() int64 {
 	return m.sizeLimit
 }
 
-func (m *Machine) run() (bool, bool, string) {
+// run runs one instruction, and returns the number of steps it counted as, or
+// 0 if it didn't run, and whether the machine can go on
+func (m *Machine) run() (int, bool, string) {
 	// fmt.Println("BEFORE", m.pc.GetPC().Op, m.stack.(*stack.Flat))
 	if m.IsHalted() || m.IsErrored() || m.HaveSizeException() {
-		return false, false, "Can't run"
+		return 0, false, "Can't run"
+	}
+	insn := m.pc.GetCurrentInsn()
+	cost := m.insnSet.stepCostAt(m, insn)
+	_, err := RunInstruction(m, insn)
+	if m.warnHandler.Failed() {
+		m.ErrorStop()
+		return 0, false, "TooManyWarnings"
 	}
-	insnName := m.pc.GetCurrentInsnName()
-	_, err := RunInstruction(m, m.pc.GetCurrentInsn())
 	if _, blocked := err.(VMBlockedError); blocked {
-		return false, false, "Blocked"
+		return 0, false, "Blocked"
+	}
+	for i := 0; i < cost; i++ {
+		m.context.NotifyStep()
 	}
-	m.context.NotifyStep()
 	if err != nil {
-		fmt.Printf("error running instruction %v: %v\n", insnName, err)
-		return false, false, "Error"
+		// the error has already been reported to the warning handler
+		return 0, false, "Error"
 	}
 	if m.IsHalted() {
-		return true, false, "Halted"
+		return cost, false, "Halted"
 	}
 	if m.IsErrored() {
-		return true, false, "ErrorStopped"
+		return cost, false, "ErrorStopped"
 	}
 	if m.HaveSizeException() {
-		return true, false, "SizeException"
+		return cost, false, "SizeException"
 	}
 	// fmt.Println("AFTER", m.pc.GetPC().Op, m.stack.(*stack.Flat))
-	return true, true, "Success"
+	return cost, true, "Success"
 }
 
-// run up to maxSteps steps, stop earlier if halted, errored or blocked
+// NextStepCost returns the number of steps the machine's next instruction
+// counts as. Breakpoints don't count as steps, so it looks past them to the
+// instruction after. It's 0 if the pc isn't in the code.
+func (m *Machine) NextStepCost() int {
+	for pc := m.pc.pc; pc >= 0 && pc < m.pc.code.Len(); pc++ {
+		if op := m.pc.code.Op(pc); op.GetOp() != code.BREAKPOINT {
+			return m.insnSet.stepCostAt(m, op)
+		}
+	}
+	return 0
+}
+
+// run up to maxSteps steps, stop earlier if halted, errored or blocked. Steps
+// are counted in step costs, and the assertion stops before an instruction
+// that would take it past maxSteps, so one that counts as more than maxSteps
+// never runs.
 func (m *Machine) ExecuteAssertion(maxSteps int32, timeBounds protocol.TimeBounds) *protocol.Assertion {
 	assCtx := NewMachineAssertionContext(
 		m,
 		timeBounds,
 	)
+	m.runAssertion(maxSteps)
+	return assCtx.Finalize(m)
+}
+
+func (m *Machine) runAssertion(maxSteps int32) {
 	i := int32(0)
 	continueRun := true
-	var ran bool
-	for continueRun && i < maxSteps {
-		ran, continueRun, _ = m.run()
-		if ran {
-			i++
-		}
+	var steps int
+	for continueRun && i+int32(m.NextStepCost()) <= maxSteps {
+		steps, continueRun, _ = m.run()
+		i += int32(steps)
 	}
-	return assCtx.Finalize(m)
 }
 
 func (m *Machine) SendOnchainMessage(msg protocol.Message) {
@@ -303,19 +442,43 @@ func (m *Machine) HasPendingMessages() bool {
 	return !m.inbox.PendingQueue.IsEmpty()
 }
 
+// errLowBalance is returned by Send when the machine can't pay for a message
+var errLowBalance = errors.New("Send: balance too low")
+
 func (m *Machine) Send(data value.Value, tokenType value.IntValue, currency value.IntValue, dest value.IntValue) error {
 	tokType := [21]byte{}
 	tokBytes := tokenType.ToBytes()
 	copy(tokType[:], tokBytes[:])
-	err := m.balance.Spend(tokType, currency.BigInt())
-	if err != nil {
+	amount := currency.BigInt()
+	balanceCovers := m.balance.CanSpend(tokType, amount)
+	canSpend := balanceCovers
+	if ic, ok := m.context.(InputContext); ok {
+		canSpend = ic.CanSpend(canSpend)
+	}
+	if !canSpend {
+		return errLowBalance
+	}
+	if !balanceCovers && replayFundsSend(m.context) {
+		// the replay's log says the send went ahead, so it was paid for with
+		// funds the replay doesn't have, and the balance is left as it is
+		return m.context.Send(data, tokenType, currency, dest)
+	}
+	if err := m.balance.Spend(tokType, amount); err != nil {
 		return err
 	}
 	return m.context.Send(data, tokenType, currency, dest)
 }
 
+// SetWarningHandler replaces the handler that is told about the machine's
+// warnings and instruction errors
+func (m *Machine) SetWarningHandler(wh WarningHandler) {
+	wh.SwitchMachinePC(m.pc)
+	m.pc.warn = wh
+	m.warnHandler = wh
+}
+
 func (m *Machine) Warn(str string) {
-	m.warnHandler.Warn(str)
+	m.warnHandler.Warn(m.pc.newWarning(str))
 }
 
 func (m *Machine) Log(val value.Value) {
@@ -343,19 +506,11 @@ func (m *Machine) Hash() [32]byte {
 	panic("Machine::Hash: invalid machine status")
 }
 
+// PrintState prints the machine's full state as a tree to stdout
 func (m *Machine) PrintState() {
-	codePointHash := m.pc.GetPC().Hash()
-	stackHash := m.stack.StateValue().Hash()
-	auxStackHash := m.auxstack.StateValue().Hash()
-	registerHash := m.register.StateValue().Hash()
-	staticHash := m.static.StateValue().Hash()
-	errHandlerHash := m.errHandler.Hash()
-	fmt.Println("codePointHash", hexutil.Encode(codePointHash[:]))
-	fmt.Println("stackHash", hexutil.Encode(stackHash[:]))
-	fmt.Println("auxStackHash", hexutil.Encode(auxStackHash[:]))
-	fmt.Println("registerHash", hexutil.Encode(registerHash[:]))
-	fmt.Println("staticHash", hexutil.Encode(staticHash[:]))
-	fmt.Println("errHandlerHash", hexutil.Encode(errHandlerHash[:]))
+	if err := m.Dump().WriteTree(os.Stdout); err != nil {
+		fmt.Println("PrintState:", err)
+	}
 }
 
 func (m *Machine) MarshalForProof() ([]byte, error) {
@@ -366,14 +521,35 @@ func (m *Machine) MarshalForProof() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (m *Machine) marshalForProof(wr io.Writer) error {
-	codePoint := m.pc.GetPC()
-
-	stackPops := code.InstructionStackPops[codePoint.Op.GetOp()]
-	if _, ok := codePoint.Op.(value.ImmediateOperation); ok && len(stackPops) > 0 {
+// proofPops runs the current instruction on a copy of the machine, and
+// returns the pop types of the stack and aux stack values it popped. This
+// covers instructions that fail, which drain their remaining pops, and ones
+// that block.
+func (m *Machine) proofPops() ([]byte, []byte) {
+	c := m.Clone().(*Machine)
+	c.SetWarningHandler(NewSilentWarningHandler())
+	op := c.pc.GetCurrentInsn()
+	available := c.stack.Count()
+	_, immediate := op.(value.ImmediateOperation)
+	if immediate {
+		available++
+	}
+	mods, _ := RunInstruction(c, op)
+	stackPops := mods.stackPopInfo()
+	if int64(len(stackPops)) > available {
+		// a typed pop of an empty stack is recorded even though it fails
+		stackPops = stackPops[:available]
+	}
+	if immediate && len(stackPops) > 0 {
+		// the immediate value is in the code point rather than the stack
 		stackPops = stackPops[1:]
 	}
-	auxStackPops := code.InstructionAuxStackPops[codePoint.Op.GetOp()]
+	return stackPops, mods.auxStackPopInfo()
+}
+
+func (m *Machine) marshalForProof(wr io.Writer) error {
+	codePoint := m.pc.GetPC()
+	stackPops, auxStackPops := m.proofPops()
 
 	baseStackVal, stackVals := m.stack.SolidityProofValue(stackPops)
 	baseStackValHash := baseStackVal.Hash()
@@ -383,8 +559,6 @@ func (m *Machine) marshalForProof(wr io.Writer) error {
 	staticHash := m.static.ProofValue().Hash()
 	errHandlerHash := m.errHandler.Hash()
 
-	fmt.Printf("Proof of %v has %d stack vals and %d aux stack vals s\n", codePoint, len(stackVals), len(auxStackVals))
-
 	if _, err := wr.Write(codePoint.NextHash[:]); err != nil {
 		return err
 	}
@@ -419,18 +593,21 @@ func (m *Machine) marshalForProof(wr io.Writer) error {
 	return nil
 }
 
+// Clone returns a copy of the machine that can be run independently of it,
+// including on another goroutine. The copy shares only what is never
+// changed: the code segment, and values, which are immutable. Clone reads m,
+// so it mustn't run while m is being changed on another goroutine.
 func (m *Machine) Clone() machine.Machine { // clone machine state--new machine wll NOT be in proving mode
 	newWarnHandler := m.warnHandler.Clone()
-	newPc := *m.pc
-	newPc.warn = newWarnHandler
-	newPcPointer := &newPc
-	newWarnHandler.SwitchMachinePC(newPcPointer)
-	ret := &Machine{
+	newPc := &MachinePC{newWarnHandler, m.pc.code, m.pc.pc, m.pc.insnSet}
+	newWarnHandler.SwitchMachinePC(newPc)
+	return &Machine{
 		m.stack.Clone(),
 		m.auxstack.Clone(),
+		m.stackKind,
 		m.register.Clone(),
 		m.static.Clone(),
-		newPcPointer,
+		newPc,
 		m.errHandler,
 		&machine.MachineNoContext{},
 		m.status,
@@ -438,8 +615,8 @@ func (m *Machine) Clone() machine.Machine { // clone machine state--new machine
 		m.balance.Clone(),
 		m.sizeLimit,
 		m.sizeException,
+		m.strictJumps,
+		m.insnSet,
 		newWarnHandler,
 	}
-	// WARNING: risk of bug here, because of shallow copy of stack, callstack
-	return ret
 }
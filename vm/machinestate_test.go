@@ -0,0 +1,245 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-avm/vm/stack"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+func TestStackKindMachines(t *testing.T) {
+	insns := []value.Operation{
+		value.ImmediateOperation{Op: code.NOP, Val: value.NewInt64Value(0)},
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.AUXPUSH},
+		value.ImmediateOperation{Op: code.ADD, Val: value.NewInt64Value(1)},
+		value.BasicOperation{Op: code.DUP0},
+		value.BasicOperation{Op: code.AUXPOP},
+		value.BasicOperation{Op: code.JUMP},
+	}
+	for _, kind := range []stack.Kind{stack.KindTuple, stack.KindPersistent, stack.KindLazyFlat} {
+		flat := NewMachine(insns, value.NewInt64Value(1), false, 1<<30)
+		other := NewMachineWithStackKind(insns, value.NewInt64Value(1), false, 1<<30, kind)
+		for i := 0; i < 10; i++ {
+			_ = flat.ExecuteAssertion(7, protocol.NewTimeBounds(0, 100000))
+			_ = other.ExecuteAssertion(7, protocol.NewTimeBounds(0, 100000))
+			if flat.Hash() != other.Hash() {
+				t.Fatalf("machines with stack kinds %v and %v diverged", stack.KindFlat, kind)
+			}
+			if ok, err := Equal(flat, other); !ok {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// cloneTestMachine returns a machine with something in each part of its
+// state, running the inbox loop program
+func cloneTestMachine(kind stack.Kind) *Machine {
+	tup := value.NewTuple2(value.NewInt64Value(1), value.NewTuple2(value.NewInt64Value(2), value.NewInt64Value(3)))
+	m := NewMachineWithStackKind(inboxLoopMachine().GetAllOperations(), tup, false, 1000, kind)
+	m.SetWarningHandler(NewBufferWarningHandler(10))
+	m.SendOnchainMessage(protocol.NewMessage(tup, [21]byte{}, big.NewInt(10), [32]byte{}))
+	m.DeliverOnchainMessage()
+	m.Stack().Push(tup)
+	m.Stack().Push(value.NewInt64Value(4))
+	m.AuxStack().Push(tup)
+	m.Register().Set(tup)
+	return m
+}
+
+// TestCloneIndependence changes a machine and a chain of its clones at the
+// same time, each differently, and checks that each ends up as if it had
+// been changed alone. Run it with -race to check that the clones share
+// nothing that they change.
+func TestCloneIndependence(t *testing.T) {
+	tb := protocol.NewTimeBounds(0, 100)
+	deliver := func(m *Machine, amount int64) {
+		m.SendOnchainMessage(protocol.NewMessage(value.NewInt64Value(amount), [21]byte{}, big.NewInt(amount), [32]byte{}))
+		m.DeliverOnchainMessage()
+	}
+	changes := []func(m *Machine){
+		func(m *Machine) {
+			for i := 0; i < 5; i++ {
+				m.ExecuteAssertion(20, tb)
+				deliver(m, 3)
+			}
+		},
+		func(m *Machine) {
+			for i := int64(0); i < 50; i++ {
+				m.Stack().Push(value.NewInt64Value(i))
+				m.AuxStack().Push(value.NewTuple2(value.NewInt64Value(i), value.NewEmptyTuple()))
+			}
+			m.Register().Set(value.NewInt64Value(5))
+		},
+		func(m *Machine) {
+			for i := 0; i < 3; i++ {
+				_, _ = m.Stack().Pop()
+				_, _ = m.AuxStack().Pop()
+			}
+			m.SendOffchainMessages([]protocol.Message{
+				protocol.NewMessage(value.NewInt64Value(6), [21]byte{}, big.NewInt(0), [32]byte{}),
+			})
+			m.ExecuteAssertion(100, tb)
+		},
+		func(m *Machine) {
+			// an invalid jump raises a warning and stops the machine
+			m.Stack().Push(value.NewInt64Value(7))
+			_ = m.SetPC(value.CodePointValue{InsnNum: 8, Op: value.BasicOperation{Op: code.JUMP}, NextHash: HashOfLastInstruction})
+			m.ExecuteAssertion(1, tb)
+		},
+	}
+
+	for _, kind := range []stack.Kind{stack.KindFlat, stack.KindTuple, stack.KindPersistent, stack.KindLazyFlat} {
+		machines := []*Machine{cloneTestMachine(kind)}
+		for len(machines) < len(changes) {
+			machines = append(machines, machines[len(machines)-1].Clone().(*Machine))
+		}
+		var wg sync.WaitGroup
+		wg.Add(len(changes))
+		for i := range changes {
+			go func(change func(*Machine), m *Machine) {
+				defer wg.Done()
+				change(m)
+			}(changes[i], machines[i])
+		}
+		wg.Wait()
+
+		for i, change := range changes {
+			ref := cloneTestMachine(kind)
+			change(ref)
+			if !reflect.DeepEqual(machines[i].Dump(), ref.Dump()) {
+				t.Errorf("stack kind %v: machine %v was changed by another machine", kind, i)
+			}
+		}
+	}
+}
+
+func TestStrictJumps(t *testing.T) {
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.HALT},
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.HALT},
+	}
+	program := NewCodeSegment(insns)
+	genuine := program.CodePoint(2)
+	handler := program.CodePoint(3)
+	forgedOp := value.CodePointValue{InsnNum: 2, Op: value.BasicOperation{Op: code.NOP}, NextHash: genuine.NextHash}
+	forgedNext := value.CodePointValue{InsnNum: 2, Op: genuine.Op, NextHash: [32]byte{1}}
+
+	newMachine := func(strict bool) *Machine {
+		m := NewMachine(insns, value.NewInt64Value(1), false, 100)
+		m.SetStrictJumps(strict)
+		m.Stack().Push(handler)
+		if _, err := RunInstruction(m, value.BasicOperation{Op: code.ERRSET}); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	testCases := []struct {
+		name   string
+		target value.CodePointValue
+		forged bool
+	}{
+		{"genuine", genuine, false},
+		{"forged op", forgedOp, true},
+		{"forged next hash", forgedNext, true},
+	}
+	for _, strict := range []bool{false, true} {
+		for _, tc := range testCases {
+			for _, op := range []value.Opcode{code.JUMP, code.CJUMP} {
+				m := newMachine(strict)
+				if op == code.CJUMP {
+					m.Stack().Push(value.NewInt64Value(1))
+				}
+				m.Stack().Push(tc.target)
+				_, err := RunInstruction(m, value.BasicOperation{Op: op})
+				if strict && tc.forged {
+					var jerr InvalidJumpError
+					if !errors.As(err, &jerr) {
+						t.Errorf("strict %v to %v: got error %v", code.InstructionNames[op], tc.name, err)
+					}
+					if m.GetPC() != handler || m.Stack().Count() != 0 {
+						t.Errorf("strict %v to %v: error wasn't routed to the handler", code.InstructionNames[op], tc.name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("strict %v, %v to %v: %v", strict, code.InstructionNames[op], tc.name, err)
+				}
+				// the machine is at the program's code point, whatever it
+				// jumped to
+				if m.GetPC() != genuine {
+					t.Errorf("strict %v, %v to %v: machine at %v", strict, code.InstructionNames[op], tc.name, m.GetPC())
+				}
+			}
+		}
+	}
+
+	// out of range targets are only warned about unless the machine is strict
+	for _, insnNum := range []int64{-1, 9} {
+		target := value.CodePointValue{InsnNum: insnNum, Op: genuine.Op, NextHash: genuine.NextHash}
+		for _, strict := range []bool{false, true} {
+			m := newMachine(strict)
+			m.SetWarningHandler(NewSilentWarningHandler())
+			m.Stack().Push(target)
+			_, err := RunInstruction(m, value.BasicOperation{Op: code.JUMP})
+			var jerr InvalidJumpError
+			if strict != errors.As(err, &jerr) {
+				t.Errorf("strict %v, jump to %v: got error %v", strict, insnNum, err)
+			}
+			if !strict && m.IsErrored() {
+				t.Errorf("jump to %v stopped a loose machine", insnNum)
+			}
+		}
+	}
+
+	m := newMachine(true)
+	m.Stack().Push(forgedOp)
+	_, err := RunInstruction(m, value.BasicOperation{Op: code.ERRSET})
+	var jerr InvalidJumpError
+	if !errors.As(err, &jerr) || m.GetErrHandler() != handler {
+		t.Errorf("strict machine set a forged error handler: %v", err)
+	}
+	m.Stack().Push(value.ErrorCodePoint)
+	if _, err := RunInstruction(m, value.BasicOperation{Op: code.ERRSET}); err != nil || m.GetErrHandler() != value.ErrorCodePoint {
+		t.Errorf("strict machine couldn't clear its error handler: %v", err)
+	}
+	if !m.Clone().(*Machine).StrictJumps() {
+		t.Error("clone of a strict machine isn't strict")
+	}
+
+	// a program's own code points are always valid targets
+	loose := errorLoopMachine()
+	strict := loose.Clone().(*Machine)
+	strict.SetStrictJumps(true)
+	tb := protocol.NewTimeBounds(0, 100)
+	if a, b := loose.ExecuteAssertion(30, tb), strict.ExecuteAssertion(30, tb); a.AfterHash != b.AfterHash || a.NumSteps != b.NumSteps {
+		t.Error("strict machine ran differently on its own code points")
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/offchainlabs/arb-util/machine"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// InputContext is a MachineContext that stands between a machine and the
+// inputs it takes from outside its hashed state: what INBOX reads and
+// whether its balance covers a send. What GETTIME returns already comes from
+// the context. The machine passes in what it would have used, and uses what
+// the context returns.
+type InputContext interface {
+	machine.MachineContext
+	ReadInbox(inbox value.Value) value.Value
+	CanSpend(canSpend bool) bool
+}
+
+type InputKind byte
+
+const (
+	InputInbox InputKind = iota
+	InputTime
+	InputSend
+)
+
+func (k InputKind) String() string {
+	switch k {
+	case InputInbox:
+		return "inbox"
+	case InputTime:
+		return "time"
+	case InputSend:
+		return "send"
+	}
+	return fmt.Sprintf("InputKind(%d)", byte(k))
+}
+
+// Input is one input a machine read during an assertion. Step is the number
+// of steps the assertion had taken when the instruction reading it ran.
+type Input struct {
+	Step uint32
+	Kind InputKind
+	// what INBOX read or GETTIME returned
+	Value value.Value
+	// whether the balance covered a send
+	CanSpend bool
+}
+
+// ReplayLog holds an assertion's inputs, so that the assertion can be
+// replayed from the machine it started with
+type ReplayLog struct {
+	StartHash [32]byte
+	MaxSteps  int32
+	Steps     uint32
+	EndHash   [32]byte
+	Inputs    []Input
+}
+
+func (l *ReplayLog) Marshal(wr io.Writer) error {
+	if _, err := wr.Write(l.StartHash[:]); err != nil {
+		return err
+	}
+	if _, err := wr.Write(l.EndHash[:]); err != nil {
+		return err
+	}
+	header := []interface{}{l.MaxSteps, l.Steps, uint32(len(l.Inputs))}
+	for _, field := range header {
+		if err := binary.Write(wr, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	for _, in := range l.Inputs {
+		if err := binary.Write(wr, binary.LittleEndian, in.Step); err != nil {
+			return err
+		}
+		if _, err := wr.Write([]byte{byte(in.Kind)}); err != nil {
+			return err
+		}
+		if in.Kind == InputSend {
+			if err := binary.Write(wr, binary.LittleEndian, in.CanSpend); err != nil {
+				return err
+			}
+		} else if err := value.MarshalValue(in.Value, wr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewReplayLogFromReader(rd io.Reader) (*ReplayLog, error) {
+	l := &ReplayLog{}
+	if _, err := io.ReadFull(rd, l.StartHash[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rd, l.EndHash[:]); err != nil {
+		return nil, err
+	}
+	var count uint32
+	for _, field := range []interface{}{&l.MaxSteps, &l.Steps, &count} {
+		if err := binary.Read(rd, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	l.Inputs = make([]Input, count)
+	for i := range l.Inputs {
+		in := &l.Inputs[i]
+		if err := binary.Read(rd, binary.LittleEndian, &in.Step); err != nil {
+			return nil, err
+		}
+		var kind [1]byte
+		if _, err := io.ReadFull(rd, kind[:]); err != nil {
+			return nil, err
+		}
+		in.Kind = InputKind(kind[0])
+		switch in.Kind {
+		case InputSend:
+			if err := binary.Read(rd, binary.LittleEndian, &in.CanSpend); err != nil {
+				return nil, err
+			}
+		case InputInbox, InputTime:
+			val, err := value.UnmarshalValue(rd)
+			if err != nil {
+				return nil, err
+			}
+			in.Value = val
+		default:
+			return nil, fmt.Errorf("NewReplayLogFromReader: unknown input kind %v", kind[0])
+		}
+	}
+	return l, nil
+}
+
+// inputRecorder passes the machine's inputs through, logging them
+type inputRecorder struct {
+	*MachineAssertionContext
+	inputs []Input
+}
+
+func (r *inputRecorder) ReadInbox(inbox value.Value) value.Value {
+	r.inputs = append(r.inputs, Input{r.numSteps, InputInbox, inbox, false})
+	return inbox
+}
+
+func (r *inputRecorder) GetTimeBounds() value.Value {
+	tb := r.MachineAssertionContext.GetTimeBounds()
+	r.inputs = append(r.inputs, Input{r.numSteps, InputTime, tb, false})
+	return tb
+}
+
+func (r *inputRecorder) CanSpend(canSpend bool) bool {
+	r.inputs = append(r.inputs, Input{r.numSteps, InputSend, nil, canSpend})
+	return canSpend
+}
+
+// ExecuteRecordedAssertion runs like ExecuteAssertion, and also returns a
+// log of the assertion's inputs
+func (m *Machine) ExecuteRecordedAssertion(maxSteps int32, timeBounds protocol.TimeBounds) (*protocol.Assertion, *ReplayLog) {
+	startHash := m.Hash()
+	assCtx := NewMachineAssertionContext(
+		m,
+		timeBounds,
+	)
+	rec := &inputRecorder{assCtx, nil}
+	m.SetContext(rec)
+	m.runAssertion(maxSteps)
+	a := assCtx.Finalize(m)
+	return a, &ReplayLog{startHash, maxSteps, a.NumSteps, a.AfterHash, rec.inputs}
+}
+
+// ReplayError means a replay didn't go the way its log says
+type ReplayError struct {
+	Msg string
+}
+
+func (e ReplayError) Error() string {
+	return "replay: " + e.Msg
+}
+
+// inputReplayer feeds the machine the inputs in a log. It notes the first
+// input that doesn't match the log, and from then on passes the machine's
+// own inputs through.
+type inputReplayer struct {
+	*MachineAssertionContext
+	inputs []Input
+	next   int
+	err    error
+}
+
+func (r *inputReplayer) nextInput(kind InputKind) (Input, bool) {
+	if r.err != nil {
+		return Input{}, false
+	}
+	if r.next >= len(r.inputs) {
+		r.err = ReplayError{fmt.Sprintf("machine read %v at step %v, past the end of the log", kind, r.numSteps)}
+		return Input{}, false
+	}
+	in := r.inputs[r.next]
+	if in.Kind != kind || in.Step != r.numSteps {
+		r.err = ReplayError{fmt.Sprintf("machine read %v at step %v, but the log has %v at step %v", kind, r.numSteps, in.Kind, in.Step)}
+		return Input{}, false
+	}
+	r.next++
+	return in, true
+}
+
+func (r *inputReplayer) ReadInbox(inbox value.Value) value.Value {
+	if in, ok := r.nextInput(InputInbox); ok {
+		return in.Value
+	}
+	return inbox
+}
+
+func (r *inputReplayer) GetTimeBounds() value.Value {
+	if in, ok := r.nextInput(InputTime); ok {
+		return in.Value
+	}
+	return r.MachineAssertionContext.GetTimeBounds()
+}
+
+func (r *inputReplayer) CanSpend(canSpend bool) bool {
+	if in, ok := r.nextInput(InputSend); ok {
+		return in.CanSpend
+	}
+	return canSpend
+}
+
+// replayFundsSend returns whether ctx is replaying a log that says a send
+// went ahead, in which case the machine's balance needn't cover it
+func replayFundsSend(ctx machine.MachineContext) bool {
+	r, ok := ctx.(*inputReplayer)
+	return ok && r.err == nil
+}
+
+// Replay re-runs a logged assertion on a clone of start, taking the
+// machine's inputs from the log rather than from start's inbox, balance and
+// time bounds, and checks that it ends in the logged state. It returns the
+// machine at the end of the replay, along with the assertion.
+func Replay(start *Machine, l *ReplayLog) (*Machine, *protocol.Assertion, error) {
+	if h := start.Hash(); h != l.StartHash {
+		return nil, nil, ReplayError{fmt.Sprintf("machine has hash %x, but the log starts at %x", h, l.StartHash)}
+	}
+	m := start.Clone().(*Machine)
+	assCtx := NewMachineAssertionContext(m, protocol.TimeBounds{})
+	rep := &inputReplayer{assCtx, l.Inputs, 0, nil}
+	m.SetContext(rep)
+	m.runAssertion(l.MaxSteps)
+	a := assCtx.Finalize(m)
+
+	switch {
+	case rep.err != nil:
+		return nil, nil, rep.err
+	case rep.next != len(l.Inputs):
+		return nil, nil, ReplayError{fmt.Sprintf("machine read %v of the %v logged inputs", rep.next, len(l.Inputs))}
+	case a.NumSteps != l.Steps:
+		return nil, nil, ReplayError{fmt.Sprintf("machine took %v steps, but the log has %v", a.NumSteps, l.Steps)}
+	case a.AfterHash != l.EndHash:
+		return nil, nil, ReplayError{fmt.Sprintf("machine ended with hash %x, but the log has %x", a.AfterHash, l.EndHash)}
+	}
+	return m, a, nil
+}
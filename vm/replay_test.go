@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// inboxLoopMachine returns a machine that loops reading its inbox into the
+// register, pushing the time onto the aux stack, and sending 3 of token 0
+func inboxLoopMachine() *Machine {
+	msg, _ := value.NewTupleFromSlice([]value.Value{
+		value.NewInt64Value(7),
+		value.NewInt64Value(1),
+		value.NewInt64Value(3),
+		value.NewInt64Value(0),
+	})
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.NOP},
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.RPUSH},
+		value.BasicOperation{Op: code.INBOX},
+		value.BasicOperation{Op: code.RSET},
+		value.BasicOperation{Op: code.GETTIME},
+		value.BasicOperation{Op: code.AUXPUSH},
+		value.ImmediateOperation{Op: code.SEND, Val: msg},
+		value.BasicOperation{Op: code.JUMP},
+	}
+	return NewMachine(insns, value.NewInt64Value(1), false, 1000)
+}
+
+func TestReplay(t *testing.T) {
+	m := inboxLoopMachine()
+	deliver := func(amount int64) {
+		m.SendOnchainMessage(protocol.NewMessage(value.NewInt64Value(amount), [21]byte{}, big.NewInt(amount), [32]byte{}))
+		m.DeliverOnchainMessage()
+	}
+
+	// each assertion reads a new inbox and then blocks on it; the last one
+	// can't pay for its send and blocks on that
+	var logs []*ReplayLog
+	var assertions []*protocol.Assertion
+	for i, amount := range []int64{5, 1, 0} {
+		deliver(amount)
+		a, l := m.ExecuteRecordedAssertion(100, protocol.NewTimeBounds(uint64(10*i), uint64(10*i+5)))
+		logs = append(logs, l)
+		assertions = append(assertions, a)
+	}
+	kinds := []InputKind{InputInbox, InputTime, InputSend, InputInbox}
+	for i, in := range logs[0].Inputs {
+		if i >= len(kinds) || in.Kind != kinds[i] {
+			t.Fatalf("first assertion read %v", logs[0].Inputs)
+		}
+	}
+	if len(logs[0].Inputs) != 4 || logs[0].Inputs[0].Step != 3 || !logs[0].Inputs[2].CanSpend || logs[0].Inputs[3].Step != 11 {
+		t.Fatalf("first assertion read %v", logs[0].Inputs)
+	}
+	if last := logs[2].Inputs; len(last) != 3 || last[2].CanSpend {
+		t.Fatalf("last assertion read %v", last)
+	}
+
+	// replay on a machine that never got the messages
+	replayed := inboxLoopMachine()
+	for i, l := range logs {
+		var buf bytes.Buffer
+		if err := l.Marshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		l2, err := NewReplayLogFromReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, a, err := Replay(replayed, l2)
+		if err != nil {
+			t.Fatalf("assertion %v: %v", i, err)
+		}
+		if a.AfterHash != assertions[i].AfterHash || len(a.OutMsgs) != len(assertions[i].OutMsgs) {
+			t.Errorf("assertion %v: replay differs", i)
+		}
+		replayed = next
+	}
+	if replayed.Hash() != m.Hash() {
+		t.Error("replayed machine differs from the original")
+	}
+
+	// a replay on a machine that can pay for its send spends the balance
+	funded := inboxLoopMachine()
+	funded.SendOnchainMessage(protocol.NewMessage(value.NewInt64Value(0), [21]byte{}, big.NewInt(4), [32]byte{}))
+	next, _, err := Replay(funded, logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.CanSpend(value.NewInt64Value(0), value.NewInt64Value(2)) || !next.CanSpend(value.NewInt64Value(0), value.NewInt64Value(1)) {
+		t.Error("replayed send didn't spend the balance")
+	}
+
+	start := inboxLoopMachine()
+	wrongTime := *logs[0]
+	wrongTime.Inputs = append([]Input{}, logs[0].Inputs...)
+	wrongTime.Inputs[1].Value = protocol.NewTimeBounds(1, 2).AsValue()
+	if _, _, err := Replay(start, &wrongTime); err == nil {
+		t.Error("replayed a log with the wrong time")
+	}
+	missing := *logs[0]
+	missing.Inputs = logs[0].Inputs[:3]
+	if _, _, err := Replay(start, &missing); err == nil {
+		t.Error("replayed a log with a missing input")
+	}
+	if _, _, err := Replay(start, logs[1]); err == nil {
+		t.Error("replayed a log from the wrong machine")
+	}
+}
@@ -32,6 +32,9 @@ type Flat struct {
 	itemTypes  []byte
 	hashes     [][32]byte
 	size       int64
+	// if lazyHashes is set, hashes are only brought up to date when a hash
+	// is needed; otherwise they are kept close behind the items
+	lazyHashes bool
 }
 
 func (m *Flat) String() string {
@@ -50,11 +53,21 @@ func (m *Flat) String() string {
 }
 
 func NewEmptyFlat() *Flat {
-	s := &Flat{nil, nil, nil, nil, nil, nil, 1}
+	s := &Flat{nil, nil, nil, nil, nil, nil, 1, false}
 	s.verifyHeight()
 	return s
 }
 
+// NewEmptyLazyFlat returns an empty Flat stack that only hashes its items
+// when a hash is needed. Hashes are memoized per depth, so popping only
+// discards the hashes of the popped items. It produces the same hashes as
+// NewEmptyFlat, and is faster when hashes are requested rarely.
+func NewEmptyLazyFlat() *Flat {
+	s := NewEmptyFlat()
+	s.lazyHashes = true
+	return s
+}
+
 func FlatFromTupleChain(val value.Value) *Flat {
 	contents := val.(value.TupleValue).Contents()
 	if len(contents) == 0 {
@@ -80,7 +93,7 @@ func (s *Flat) CloneImpl() *Flat {
 	copy(itemTypes, s.itemTypes)
 	hashes := make([][32]byte, len(s.hashes))
 	copy(hashes, s.hashes)
-	newS := &Flat{ints, tuples, codePoints, hashOnly, itemTypes, hashes, s.size}
+	newS := &Flat{ints, tuples, codePoints, hashOnly, itemTypes, hashes, s.size, s.lazyHashes}
 	newS.verifyHeight()
 	return newS
 }
@@ -90,7 +103,12 @@ func (s *Flat) Clone() Stack {
 }
 
 func (s *Flat) Equal(yin Stack) (bool, string) {
-	y := yin.(*Flat)
+	y, ok := yin.(*Flat)
+	if !ok {
+		return equalStacks(s, yin)
+	}
+	s.updateHashes()
+	y.updateHashes()
 	if len(s.itemTypes) != len(y.itemTypes) {
 		return false, fmt.Sprintf("Flat stack lengths are different (%v and %v)", len(s.itemTypes), len(y.itemTypes))
 	}
@@ -238,6 +256,24 @@ func (s *Flat) Pop() (lastItem value.Value, err error) {
 	return
 }
 
+func (s *Flat) Peek() (value.Value, error) {
+	if len(s.itemTypes) == 0 {
+		return nil, EmptyError{}
+	}
+	switch s.itemTypes[len(s.itemTypes)-1] {
+	case value.TypeCodeInt:
+		return s.ints[len(s.ints)-1], nil
+	case value.TypeCodeTuple:
+		return s.tuples[len(s.tuples)-1], nil
+	case value.TypeCodeCodePoint:
+		return s.codePoints[len(s.codePoints)-1], nil
+	case value.TypeCodeHashOnly:
+		return s.hashOnly[len(s.hashOnly)-1], nil
+	default:
+		panic("Peek: Unhandled type")
+	}
+}
+
 func (s *Flat) IsEmpty() bool {
 	return len(s.itemTypes) == 0
 }
@@ -269,11 +305,7 @@ func (s *Flat) ProofValue(stackInfo []byte) value.Value {
 	}
 	stack := NewTuple(c.StateValue())
 	for i := len(stackInfo) - 1; i >= 0; i-- {
-		if stackInfo[i] == 1 {
-			stack.Push(vals[i].CloneShallow())
-		} else {
-			stack.Push(value.NewHashOnlyValueFromValue(vals[i]))
-		}
+		stack.Push(ProofItem(vals[i], stackInfo[i]))
 	}
 	return stack.stack
 }
@@ -284,11 +316,7 @@ func (s *Flat) SolidityProofValue(stackInfo []byte) (value.HashOnlyValue, []valu
 	vals := make([]value.Value, 0, len(stackInfo))
 	for i := range stackInfo {
 		val, _ := c.Pop()
-		if stackInfo[i] == 1 {
-			vals = append(vals, val.CloneShallow())
-		} else {
-			vals = append(vals, value.NewHashOnlyValueFromValue(val))
-		}
+		vals = append(vals, ProofItem(val, stackInfo[i]))
 	}
 	return value.NewHashOnlyValueFromValue(c.StateValue()), vals
 }
@@ -307,6 +335,37 @@ func (s *Flat) FullyExpandedValueImpl() value.Value {
 	}
 }
 
+func (s *Flat) WalkTupleChain(fn func(item value.Value, linkHash [32]byte, restHash [32]byte) bool) {
+	s.updateHashes()
+	ints, tuples, codePoints, hashOnly := len(s.ints), len(s.tuples), len(s.codePoints), len(s.hashOnly)
+	for i := len(s.itemTypes) - 1; i >= 0; i-- {
+		var item value.Value
+		switch s.itemTypes[i] {
+		case value.TypeCodeInt:
+			ints--
+			item = s.ints[ints]
+		case value.TypeCodeTuple:
+			tuples--
+			item = s.tuples[tuples]
+		case value.TypeCodeCodePoint:
+			codePoints--
+			item = s.codePoints[codePoints]
+		case value.TypeCodeHashOnly:
+			hashOnly--
+			item = s.hashOnly[hashOnly]
+		default:
+			panic("WalkTupleChain: Unhandled type")
+		}
+		restHash := value.NewEmptyTuple().Hash()
+		if i > 0 {
+			restHash = s.hashes[i-1]
+		}
+		if !fn(item, s.hashes[i], restHash) {
+			return
+		}
+	}
+}
+
 func (s *Flat) addedValueAddHash(itemHash1 [32]byte) {
 	var prevItem [32]byte
 	if len(s.hashes) > 0 {
@@ -356,7 +415,7 @@ func (s *Flat) hashOfItem(tipe byte, offset int) [32]byte {
 func (s *Flat) addedValue(tipe byte, size int64) {
 	s.itemTypes = append(s.itemTypes, tipe)
 	s.size += size + 1
-	if len(s.itemTypes)-len(s.hashes) > 10 {
+	if !s.lazyHashes && len(s.itemTypes)-len(s.hashes) > 10 {
 		s.updateHashes()
 	}
 }
@@ -394,20 +453,21 @@ func (s *Flat) tryPop(tipe byte) error {
 	}
 	valType := s.itemTypes[len(s.itemTypes)-1]
 	if valType != tipe {
+		var popped value.Value
 		switch valType {
 		case value.TypeCodeInt:
-			s.popIntUnchecked()
+			popped = s.popIntUnchecked()
 		case value.TypeCodeTuple:
-			s.popTupleUnchecked()
+			popped = s.popTupleUnchecked()
 		case value.TypeCodeCodePoint:
-			s.popCodePointUnchecked()
+			popped = s.popCodePointUnchecked()
 		case value.TypeCodeHashOnly:
-			s.popHashOnlyUnchecked()
+			popped = s.popHashOnlyUnchecked()
 		default:
 			panic("PopValue: Unhandled type")
 		}
 		s.verifyHeight()
-		return TypeError{}
+		return TypeError{value.TypeCodeName(tipe), popped}
 	}
 	s.verifyHeight()
 	return nil
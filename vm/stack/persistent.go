@@ -0,0 +1,229 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stack
+
+import (
+	"bytes"
+	"fmt"
+
+	solsha3 "github.com/miguelmota/go-solidity-sha3"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// Persistent is a stack stored as an immutable linked list, so clones share
+// all of their items. Clone is O(1), and Push allocates a single node.
+// Nodes are never modified once created, which makes it safe to use clones
+// of a stack from different goroutines. The price is that Push hashes the new
+// link right away, where Flat defers hashing until a hash is needed; Flat is
+// faster for machines that are rarely cloned.
+type Persistent struct {
+	top *persistentNode // nil if the stack is empty
+}
+
+type persistentNode struct {
+	item  value.Value
+	rest  *persistentNode
+	hash  [32]byte // hash of the tuple chain starting at this node
+	size  int64    // size of the tuple chain starting at this node
+	count int64
+}
+
+func NewEmptyPersistent() *Persistent {
+	return &Persistent{nil}
+}
+
+func (s *Persistent) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for n := s.top; n != nil; n = n.rest {
+		buf.WriteString(fmt.Sprintf("%v", n.item))
+		if n.rest != nil {
+			buf.WriteString(", ")
+		}
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+func (s *Persistent) Clone() Stack {
+	return &Persistent{s.top}
+}
+
+func (s *Persistent) Equal(yin Stack) (bool, string) {
+	if y, ok := yin.(*Persistent); ok && y.top == s.top {
+		return true, ""
+	}
+	return equalStacks(s, yin)
+}
+
+func (s *Persistent) restHash() [32]byte {
+	if s.top == nil {
+		return value.NewEmptyTuple().Hash()
+	}
+	return s.top.hash
+}
+
+func (s *Persistent) Push(val value.Value) {
+	itemHash := val.Hash()
+	restHash := s.restHash()
+	var hash [32]byte
+	copy(hash[:], solsha3.SoliditySHA3(
+		solsha3.Uint8(value.TypeCodeTuple+2),
+		value.Bytes32ArrayEncoded([][32]byte{itemHash, restHash}),
+	))
+	s.top = &persistentNode{
+		item:  val,
+		rest:  s.top,
+		hash:  hash,
+		size:  s.Size() + val.Size() + 1,
+		count: s.Count() + 1,
+	}
+}
+
+func (s *Persistent) PushInt(v value.IntValue) {
+	s.Push(v)
+}
+
+func (s *Persistent) PushTuple(v value.TupleValue) {
+	s.Push(v)
+}
+
+func (s *Persistent) PushCodePoint(v value.CodePointValue) {
+	s.Push(v)
+}
+
+func (s *Persistent) Pop() (value.Value, error) {
+	if s.top == nil {
+		return nil, EmptyError{}
+	}
+	val := s.top.item
+	s.top = s.top.rest
+	return val, nil
+}
+
+func (s *Persistent) Peek() (value.Value, error) {
+	if s.top == nil {
+		return nil, EmptyError{}
+	}
+	return s.top.item, nil
+}
+
+func (s *Persistent) PopInt() (value.IntValue, error) {
+	val, err := s.Pop()
+	if err != nil {
+		return value.IntValue{}, err
+	}
+	v, ok := val.(value.IntValue)
+	if !ok {
+		return value.IntValue{}, TypeError{value.TypeCodeName(value.TypeCodeInt), val}
+	}
+	return v, nil
+}
+
+func (s *Persistent) PopTuple() (value.TupleValue, error) {
+	val, err := s.Pop()
+	if err != nil {
+		return value.TupleValue{}, err
+	}
+	v, ok := val.(value.TupleValue)
+	if !ok {
+		return value.TupleValue{}, TypeError{value.TypeCodeName(value.TypeCodeTuple), val}
+	}
+	return v, nil
+}
+
+func (s *Persistent) PopCodePoint() (value.CodePointValue, error) {
+	val, err := s.Pop()
+	if err != nil {
+		return value.CodePointValue{}, err
+	}
+	v, ok := val.(value.CodePointValue)
+	if !ok {
+		return value.CodePointValue{}, TypeError{value.TypeCodeName(value.TypeCodeCodePoint), val}
+	}
+	return v, nil
+}
+
+func (s *Persistent) IsEmpty() bool {
+	return s.top == nil
+}
+
+func (s *Persistent) Size() int64 {
+	if s.top == nil {
+		return 1
+	}
+	return s.top.size
+}
+
+func (s *Persistent) Count() int64 {
+	if s.top == nil {
+		return 0
+	}
+	return s.top.count
+}
+
+func (s *Persistent) StateValue() value.Value {
+	return value.NewHashOnlyValue(s.restHash(), s.Size())
+}
+
+func (s *Persistent) ProofValue(stackInfo []byte) value.Value {
+	c := s.Clone()
+	vals := make([]value.Value, 0, len(stackInfo))
+	for range stackInfo {
+		val, _ := c.Pop()
+		vals = append(vals, val)
+	}
+	stack := NewTuple(c.StateValue())
+	for i := len(stackInfo) - 1; i >= 0; i-- {
+		stack.Push(ProofItem(vals[i], stackInfo[i]))
+	}
+	return stack.stack
+}
+
+func (s *Persistent) SolidityProofValue(stackInfo []byte) (value.HashOnlyValue, []value.Value) {
+	c := s.Clone()
+	vals := make([]value.Value, 0, len(stackInfo))
+	for i := range stackInfo {
+		val, _ := c.Pop()
+		vals = append(vals, ProofItem(val, stackInfo[i]))
+	}
+	return value.NewHashOnlyValueFromValue(c.StateValue()), vals
+}
+
+func (s *Persistent) FullyExpandedValue() value.Value {
+	items := make([]value.Value, 0, s.Count())
+	for n := s.top; n != nil; n = n.rest {
+		items = append(items, n.item)
+	}
+	var ret value.Value = value.NewEmptyTuple()
+	for i := len(items) - 1; i >= 0; i-- {
+		ret = value.NewTuple2(items[i], ret)
+	}
+	return ret
+}
+
+func (s *Persistent) WalkTupleChain(fn func(item value.Value, linkHash [32]byte, restHash [32]byte) bool) {
+	for n := s.top; n != nil; n = n.rest {
+		restHash := value.NewEmptyTuple().Hash()
+		if n.rest != nil {
+			restHash = n.rest.hash
+		}
+		if !fn(n.item, n.hash, restHash) {
+			return
+		}
+	}
+}
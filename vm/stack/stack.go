@@ -28,13 +28,15 @@ func (e EmptyError) Error() string {
 	return "tried to pop empty stack"
 }
 
+// TypeError is returned by a typed pop when the top item has a different
+// type. The item is popped anyway.
 type TypeError struct {
-	expectedType string
-	value        value.Value
+	Expected string
+	Value    value.Value
 }
 
 func (e TypeError) Error() string {
-	return fmt.Sprintf("popped stack expecting %s but received %v", e.expectedType, e.value)
+	return fmt.Sprintf("popped stack expecting %s but received %v", e.Expected, e.Value)
 }
 
 type Stack interface {
@@ -46,6 +48,8 @@ type Stack interface {
 	PushCodePoint(value.CodePointValue)
 
 	Pop() (value.Value, error)
+	// Peek returns the value on top of the stack without popping it
+	Peek() (value.Value, error)
 	PopInt() (value.IntValue, error)
 	PopTuple() (value.TupleValue, error)
 	PopCodePoint() (value.CodePointValue, error)
@@ -60,3 +64,108 @@ type Stack interface {
 	SolidityProofValue([]byte) (value.HashOnlyValue, []value.Value)
 	FullyExpandedValue() value.Value
 }
+
+// Kind selects a Stack implementation
+type Kind int
+
+const (
+	KindFlat Kind = iota
+	KindTuple
+	KindPersistent
+	KindLazyFlat
+)
+
+// NewEmpty returns an empty stack of the given kind
+func NewEmpty(kind Kind) Stack {
+	switch kind {
+	case KindFlat:
+		return NewEmptyFlat()
+	case KindTuple:
+		return NewEmptyTuple()
+	case KindPersistent:
+		return NewEmptyPersistent()
+	case KindLazyFlat:
+		return NewEmptyLazyFlat()
+	default:
+		panic(fmt.Sprintf("NewEmpty: unknown stack kind %v", kind))
+	}
+}
+
+// FromTupleChain returns a stack of the given kind whose tuple chain
+// representation is val
+func FromTupleChain(kind Kind, val value.Value) Stack {
+	if kind == KindTuple {
+		return NewTuple(val)
+	}
+	var items []value.Value
+	for {
+		link, ok := val.(value.TupleValue)
+		if !ok || link.Len() != 2 {
+			break
+		}
+		item, _ := link.GetByInt64(0)
+		items = append(items, item)
+		val, _ = link.GetByInt64(1)
+	}
+	s := NewEmpty(kind)
+	for i := len(items) - 1; i >= 0; i-- {
+		s.Push(items[i])
+	}
+	return s
+}
+
+// equalStacks compares two stacks of any implementation item by item, from
+// the top down
+func equalStacks(x, y Stack) (bool, string) {
+	if x.Count() != y.Count() {
+		return false, fmt.Sprintf("stack lengths are different (%v and %v)", x.Count(), y.Count())
+	}
+	if x.StateValue().Hash() == y.StateValue().Hash() {
+		return true, ""
+	}
+	xc, yc := x.Clone(), y.Clone()
+	for depth := 0; !xc.IsEmpty(); depth++ {
+		xv, _ := xc.Pop()
+		yv, _ := yc.Pop()
+		if !value.Eq(xv, yv) {
+			return false, fmt.Sprintf("stacks differ at depth %v (%v and %v)", depth, xv, yv)
+		}
+	}
+	return false, "stacks have different hashes"
+}
+
+// TupleChainWalker is implemented by stacks that can list the links of their
+// tuple chain representation without building it. fn is called for each item
+// from the top of the stack down, with the hash of the chain starting at that
+// item and the hash of the chain below it; the walk stops when fn returns false.
+type TupleChainWalker interface {
+	WalkTupleChain(fn func(item value.Value, linkHash [32]byte, restHash [32]byte) bool)
+}
+
+// Pop types, which say how much of a popped value a proof includes
+const (
+	PopHashOnly   byte = 0 // just the hash
+	PopValue      byte = 1 // the value, with a tuple's items as hashes
+	PopValueItems byte = 2 // the value, with a tuple's items shallow
+	PopValueFull  byte = 3 // the whole value
+)
+
+// ProofItem returns the form of a popped value that a proof includes
+func ProofItem(val value.Value, popType byte) value.Value {
+	switch popType {
+	case PopHashOnly:
+		return value.NewHashOnlyValueFromValue(val)
+	case PopValueItems:
+		if tup, ok := val.(value.TupleValue); ok {
+			items := tup.Contents()
+			for i := range items {
+				items[i] = items[i].CloneShallow()
+			}
+			ret, _ := value.NewTupleFromSlice(items)
+			return ret
+		}
+	case PopValueFull:
+		return val
+	}
+	return val.CloneShallow()
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stack
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// kinds compared against Flat by the cross-implementation tests
+var testKinds = []Kind{KindTuple, KindPersistent, KindLazyFlat}
+
+func randomValue(rng *rand.Rand) value.Value {
+	switch rng.Intn(5) {
+	case 0:
+		return value.NewTuple2(value.NewInt64Value(rng.Int63()), value.NewEmptyTuple())
+	case 1:
+		return value.CodePointValue{
+			InsnNum:  rng.Int63n(100),
+			Op:       value.BasicOperation{Op: value.Opcode(rng.Intn(0x40))},
+			NextHash: value.NewInt64Value(rng.Int63()).Hash(),
+		}
+	case 2:
+		return value.NewHashOnlyValueFromValue(value.NewInt64Value(rng.Int63()))
+	default:
+		return value.NewInt64Value(rng.Int63())
+	}
+}
+
+// applyRandomOp performs the same randomly chosen operation on each stack
+func applyRandomOp(t *testing.T, rng *rand.Rand, stacks []Stack) {
+	if rng.Intn(3) > 0 || stacks[0].IsEmpty() {
+		val := randomValue(rng)
+		for _, s := range stacks {
+			s.Push(val)
+		}
+		return
+	}
+	op := rng.Intn(4)
+	var first value.Value
+	var firstErr error
+	for i, s := range stacks {
+		var val value.Value
+		var err error
+		switch op {
+		case 0:
+			val, err = s.PopInt()
+		case 1:
+			val, err = s.PopTuple()
+		case 2:
+			val, err = s.PopCodePoint()
+		default:
+			val, err = s.Pop()
+		}
+		if i == 0 {
+			first, firstErr = val, err
+			continue
+		}
+		if (err == nil) != (firstErr == nil) {
+			t.Fatalf("pop returned errors %v and %v", firstErr, err)
+		}
+		if err == nil && val.Hash() != first.Hash() {
+			t.Fatalf("popped different values %v and %v", first, val)
+		}
+	}
+}
+
+func compareStacks(t *testing.T, kind Kind, flat, other Stack) {
+	t.Helper()
+	if flat.StateValue().Hash() != other.StateValue().Hash() {
+		t.Fatalf("kind %v: StateValue differs from Flat", kind)
+	}
+	if flat.StateValue().Size() != other.StateValue().Size() || flat.Size() != other.Size() {
+		t.Fatalf("kind %v: Size differs from Flat", kind)
+	}
+	if flat.Count() != other.Count() || flat.IsEmpty() != other.IsEmpty() {
+		t.Fatalf("kind %v: Count differs from Flat (%v and %v)", kind, flat.Count(), other.Count())
+	}
+	flatTop, flatErr := flat.Peek()
+	otherTop, otherErr := other.Peek()
+	if (flatErr == nil) != (otherErr == nil) || (flatErr == nil && flatTop.Hash() != otherTop.Hash()) {
+		t.Fatalf("kind %v: Peek differs from Flat", kind)
+	}
+	if ok, msg := flat.Equal(other); !ok {
+		t.Fatalf("kind %v: not equal to Flat: %v", kind, msg)
+	}
+	if ok, msg := other.Equal(flat); !ok {
+		t.Fatalf("kind %v: not equal to Flat: %v", kind, msg)
+	}
+
+	for depth := int64(0); depth <= 3 && depth <= flat.Count(); depth++ {
+		for mask := 0; mask < 1<<uint(depth); mask++ {
+			stackInfo := make([]byte, depth)
+			for i := range stackInfo {
+				stackInfo[i] = byte((mask >> uint(i)) & 1)
+			}
+			if flat.ProofValue(stackInfo).Hash() != other.ProofValue(stackInfo).Hash() {
+				t.Fatalf("kind %v: ProofValue(%v) differs from Flat", kind, stackInfo)
+			}
+			flatRest, flatVals := flat.SolidityProofValue(stackInfo)
+			otherRest, otherVals := other.SolidityProofValue(stackInfo)
+			if flatRest.Hash() != otherRest.Hash() || len(flatVals) != len(otherVals) {
+				t.Fatalf("kind %v: SolidityProofValue(%v) differs from Flat", kind, stackInfo)
+			}
+			for i := range flatVals {
+				if flatVals[i].Hash() != otherVals[i].Hash() {
+					t.Fatalf("kind %v: SolidityProofValue(%v) differs from Flat", kind, stackInfo)
+				}
+			}
+		}
+	}
+}
+
+func TestStackKindsMatchFlat(t *testing.T) {
+	for _, kind := range testKinds {
+		rng := rand.New(rand.NewSource(42))
+		flat := NewEmpty(KindFlat)
+		other := NewEmpty(kind)
+		compareStacks(t, kind, flat, other)
+		for i := 0; i < 500; i++ {
+			applyRandomOp(t, rng, []Stack{flat, other})
+			compareStacks(t, kind, flat, other)
+			if i%50 == 0 {
+				flatClone, otherClone := flat.Clone(), other.Clone()
+				flatClone.Push(value.NewInt64Value(7))
+				otherClone.Push(value.NewInt64Value(7))
+				compareStacks(t, kind, flat, other)
+				compareStacks(t, kind, flatClone, otherClone)
+			}
+		}
+		if flat.FullyExpandedValue().Hash() != other.FullyExpandedValue().Hash() {
+			t.Errorf("kind %v: FullyExpandedValue differs from Flat", kind)
+		}
+	}
+}
+
+func TestTupleFromChain(t *testing.T) {
+	flat := NewEmptyFlat()
+	for i := int64(0); i < 10; i++ {
+		flat.Push(value.NewInt64Value(i))
+	}
+	tup := NewTuple(flat.FullyExpandedValue())
+	if tup.Count() != 10 {
+		t.Errorf("tuple stack built from chain has count %v, expected 10", tup.Count())
+	}
+	compareStacks(t, KindTuple, flat, tup)
+
+	other := NewTuple(flat.FullyExpandedValue())
+	_, _ = other.Pop()
+	other.Push(value.NewInt64Value(100))
+	if ok, _ := tup.Equal(other); ok {
+		t.Errorf("stacks with different top items are equal")
+	}
+	_, _ = other.Pop()
+	if ok, _ := tup.Equal(other); ok {
+		t.Errorf("stacks of different lengths are equal")
+	}
+}
+
+func TestFromTupleChain(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	flat := NewEmptyFlat()
+	for i := 0; i < 20; i++ {
+		flat.Push(randomValue(rng))
+	}
+	for _, kind := range append(testKinds, KindFlat) {
+		s := FromTupleChain(kind, flat.FullyExpandedValue())
+		compareStacks(t, kind, flat, s)
+		if empty := FromTupleChain(kind, value.NewEmptyTuple()); !empty.IsEmpty() {
+			t.Errorf("kind %v: stack from an empty chain isn't empty", kind)
+		}
+	}
+}
+
+var benchmarkKinds = []struct {
+	name string
+	kind Kind
+}{
+	{"Flat", KindFlat},
+	{"Persistent", KindPersistent},
+	{"LazyFlat", KindLazyFlat},
+}
+
+func newBenchmarkStack(kind Kind, depth int) Stack {
+	s := NewEmpty(kind)
+	for i := 0; i < depth; i++ {
+		s.Push(value.NewInt64Value(int64(i)))
+	}
+	return s
+}
+
+// BenchmarkCloneHeavy clones a deep stack and makes a few changes to the
+// clone, as when exploring an assertion from a machine
+func BenchmarkCloneHeavy(b *testing.B) {
+	for _, bk := range benchmarkKinds {
+		b.Run(bk.name, func(b *testing.B) {
+			s := newBenchmarkStack(bk.kind, 10000)
+			_ = s.StateValue()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := s.Clone()
+				_, _ = c.Pop()
+				_, _ = c.Pop()
+				c.Push(value.NewInt64Value(int64(i)))
+				_ = c.StateValue()
+			}
+		})
+	}
+}
+
+func BenchmarkPushPop(b *testing.B) {
+	for _, bk := range benchmarkKinds {
+		b.Run(bk.name, func(b *testing.B) {
+			s := newBenchmarkStack(bk.kind, 100)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Push(value.NewInt64Value(int64(i)))
+				s.Push(value.NewInt64Value(int64(i)))
+				_, _ = s.Pop()
+				_, _ = s.Pop()
+			}
+		})
+	}
+}
+
+// BenchmarkRareHashing runs long stretches of stack operations between
+// requests for the stack's hash, as between assertions
+func BenchmarkRareHashing(b *testing.B) {
+	for _, bk := range benchmarkKinds {
+		b.Run(bk.name, func(b *testing.B) {
+			s := newBenchmarkStack(bk.kind, 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 20; j++ {
+					s.Push(value.NewInt64Value(int64(j)))
+				}
+				for j := 0; j < 20; j++ {
+					_, _ = s.Pop()
+				}
+				if i%1000 == 0 {
+					_ = s.StateValue()
+				}
+			}
+		})
+	}
+}
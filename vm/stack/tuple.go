@@ -29,14 +29,31 @@ type Tuple struct {
 	count int64
 }
 
+// NewTuple returns a stack whose tuple chain representation is stack. The
+// chain may end in a hash-only value standing for the rest of a stack, as in
+// the stacks of proofs; only the links above it are counted by Count.
 func NewTuple(stack value.Value) *Tuple {
-	ret := &Tuple{stack, 0}
-	return ret
+	return &Tuple{stack, countTupleChain(stack)}
+}
+
+func NewEmptyTuple() *Tuple {
+	return &Tuple{value.NewEmptyTuple(), 0}
+}
+
+func countTupleChain(val value.Value) int64 {
+	count := int64(0)
+	for {
+		link, ok := val.(value.TupleValue)
+		if !ok || link.Len() != 2 {
+			return count
+		}
+		val, _ = link.GetByInt64(1)
+		count++
+	}
 }
 
 func (m *Tuple) Equal(yin Stack) (bool, string) {
-	// TODO add tuple equal functionality
-	return true, ""
+	return equalStacks(m, yin)
 }
 
 func (m *Tuple) Clone() Stack {
@@ -61,6 +78,9 @@ func (m *Tuple) PushCodePoint(v value.CodePointValue) {
 }
 
 func (m *Tuple) Pop() (value.Value, error) {
+	if m.IsEmpty() {
+		return nil, EmptyError{}
+	}
 	topTuple, ok := m.stack.(value.TupleValue)
 	if !ok {
 		return nil, warning.New(fmt.Sprintf("Stack.Pop: Value in Stack was %s instead of a tuple", value.TypeCodeName(m.stack.TypeCode())))
@@ -73,6 +93,17 @@ func (m *Tuple) Pop() (value.Value, error) {
 	return topTuple.GetByInt64(0)
 }
 
+func (m *Tuple) Peek() (value.Value, error) {
+	if m.IsEmpty() {
+		return nil, EmptyError{}
+	}
+	topTuple, ok := m.stack.(value.TupleValue)
+	if !ok || topTuple.Len() != 2 {
+		return nil, warning.New("Stack.Peek: Stack is not a tuple chain")
+	}
+	return topTuple.GetByInt64(0)
+}
+
 func (m *Tuple) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("[")
@@ -95,9 +126,9 @@ func (m *Tuple) PopInt() (value.IntValue, error) {
 	}
 	v, ok := val.(value.IntValue)
 	if !ok {
-		return v, nil
+		return value.IntValue{}, TypeError{value.TypeCodeName(value.TypeCodeInt), val}
 	}
-	return value.IntValue{}, TypeError{"Int", val}
+	return v, nil
 }
 
 func (m *Tuple) PopTuple() (value.TupleValue, error) {
@@ -107,7 +138,7 @@ func (m *Tuple) PopTuple() (value.TupleValue, error) {
 	}
 	v, ok := val.(value.TupleValue)
 	if !ok {
-		return value.TupleValue{}, TypeError{"Tuple", val}
+		return value.TupleValue{}, TypeError{value.TypeCodeName(value.TypeCodeTuple), val}
 	}
 	return v, nil
 }
@@ -119,14 +150,13 @@ func (m *Tuple) PopCodePoint() (value.CodePointValue, error) {
 	}
 	v, ok := val.(value.CodePointValue)
 	if !ok {
-		return value.CodePointValue{}, TypeError{"CodePointValue", val}
+		return value.CodePointValue{}, TypeError{value.TypeCodeName(value.TypeCodeCodePoint), val}
 	}
 	return v, nil
 }
 
 func (m *Tuple) IsEmpty() bool {
-	topTuple := m.stack.(value.TupleValue)
-	return topTuple.Len() == 0
+	return m.stack.Hash() == value.NewEmptyTuple().Hash()
 }
 
 func (m *Tuple) Size() int64 {
@@ -150,11 +180,7 @@ func (m *Tuple) ProofValue(stackInfo []byte) value.Value {
 	}
 	stack := NewTuple(c.StateValue())
 	for i := len(stackInfo) - 1; i >= 0; i-- {
-		if stackInfo[i] == 1 {
-			stack.Push(vals[i].CloneShallow())
-		} else {
-			stack.Push(value.NewHashOnlyValueFromValue(vals[i]))
-		}
+		stack.Push(ProofItem(vals[i], stackInfo[i]))
 	}
 	return stack.stack
 }
@@ -164,11 +190,7 @@ func (m *Tuple) SolidityProofValue(stackInfo []byte) (value.HashOnlyValue, []val
 	vals := make([]value.Value, 0, len(stackInfo))
 	for i := range stackInfo {
 		val, _ := c.Pop()
-		if stackInfo[i] == 1 {
-			vals = append(vals, val.CloneShallow())
-		} else {
-			vals = append(vals, value.NewHashOnlyValueFromValue(val))
-		}
+		vals = append(vals, ProofItem(val, stackInfo[i]))
 	}
 	return value.NewHashOnlyValueFromValue(c.StateValue()), vals
 }
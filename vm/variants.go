@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"sync"
+
+	"github.com/offchainlabs/arb-util/protocol"
+)
+
+// AssertionVariant is one candidate assertion from a start state
+type AssertionVariant struct {
+	MaxSteps   int32
+	TimeBounds protocol.TimeBounds
+	// Messages, if any, are added to the inbox as an off-chain message group
+	// before the assertion runs
+	Messages []protocol.Message
+}
+
+// VariantResult is the outcome of an assertion variant, along with the
+// machine it left
+type VariantResult struct {
+	Assertion *protocol.Assertion
+	Machine   *Machine
+}
+
+// ExecuteAssertionVariants runs each variant on its own clone of m, all in
+// parallel, and returns the results in the same order. m isn't changed.
+//
+// The clones are all made before any of them runs, so m mustn't be changed
+// by another goroutine during the call. After that each clone is only used
+// by its own goroutine, and Clone guarantees that clones share nothing that
+// running them modifies. The one exception is a warning handler that logs to
+// an outside logger: each clone's handler logs to the same one, so it must be
+// safe for concurrent use, as a log.Logger is.
+func (m *Machine) ExecuteAssertionVariants(variants []AssertionVariant) []VariantResult {
+	results := make([]VariantResult, len(variants))
+	for i := range variants {
+		results[i].Machine = m.Clone().(*Machine)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(variants))
+	for i := range variants {
+		go func(v AssertionVariant, res *VariantResult) {
+			defer wg.Done()
+			if len(v.Messages) > 0 {
+				res.Machine.SendOffchainMessages(v.Messages)
+			}
+			res.Assertion = res.Machine.ExecuteAssertion(v.MaxSteps, v.TimeBounds)
+		}(variants[i], &results[i])
+	}
+	wg.Wait()
+	return results
+}
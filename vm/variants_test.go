@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// TestAssertionVariants checks that variants run in parallel give the same
+// results as run one at a time. Run it with -race to check that the clones
+// don't race.
+func TestAssertionVariants(t *testing.T) {
+	msgs := func(amounts ...int64) []protocol.Message {
+		var ret []protocol.Message
+		for _, amount := range amounts {
+			ret = append(ret, protocol.NewMessage(value.NewInt64Value(amount), [21]byte{}, big.NewInt(amount), [32]byte{}))
+		}
+		return ret
+	}
+
+	for _, m := range []*Machine{countingMachine(), inboxLoopMachine()} {
+		before := m.Hash()
+		var variants []AssertionVariant
+		for i := 0; i < 16; i++ {
+			variants = append(variants, AssertionVariant{
+				MaxSteps:   int32(i * 15),
+				TimeBounds: protocol.NewTimeBounds(uint64(i), uint64(i+10)),
+				Messages:   msgs(int64(i % 3))[:i%2],
+			})
+		}
+		results := m.ExecuteAssertionVariants(variants)
+		if m.Hash() != before {
+			t.Fatal("running variants changed the machine")
+		}
+		for i, v := range variants {
+			c := m.Clone().(*Machine)
+			c.SendOffchainMessages(v.Messages)
+			want := c.ExecuteAssertion(v.MaxSteps, v.TimeBounds)
+			got := results[i].Assertion
+			if got.AfterHash != want.AfterHash || got.NumSteps != want.NumSteps ||
+				len(got.OutMsgs) != len(want.OutMsgs) || len(got.Logs) != len(want.Logs) {
+				t.Errorf("variant %v ran differently in parallel", i)
+			}
+			if results[i].Machine.Hash() != got.AfterHash {
+				t.Errorf("variant %v returned the wrong machine", i)
+			}
+		}
+	}
+}
@@ -16,68 +16,192 @@
 
 package vm
 
-import "fmt"
+import (
+	"log"
+	"os"
 
+	"github.com/offchainlabs/arb-avm/vm/warning"
+)
+
+// A WarningHandler is told about every warning a machine raises, including
+// instruction errors, and decides what to do with them. Use
+// Machine.SetWarningHandler to pick a handler for a machine.
 type WarningHandler interface {
 	AnyWarnings() bool
-	Warn(string)
+	Warn(warning.Warning)
+	// Failed reports whether the machine should stop running because of
+	// the warnings it has raised
+	Failed() bool
 	Clone() WarningHandler
 	SwitchMachinePC(stack *MachinePC)
 }
 
-type VerboseWarningHandler struct {
-	pc          *MachinePC
+// NewVerboseWarningHandler returns a handler that logs warnings to stderr,
+// and stops the machine after ten of them
+func NewVerboseWarningHandler() WarningHandler {
+	return NewLimitWarningHandler(NewLogWarningHandler(log.New(os.Stderr, "", log.LstdFlags)), 10)
+}
+
+type SilentWarningHandler struct {
 	anyWarnings bool
-	num         int
 }
 
-func NewVerboseWarningHandler(m *MachinePC) *VerboseWarningHandler {
-	return &VerboseWarningHandler{m, false, 0}
+func NewSilentWarningHandler() *SilentWarningHandler {
+	return &SilentWarningHandler{false}
 }
 
-func (hand *VerboseWarningHandler) AnyWarnings() bool {
+func (hand *SilentWarningHandler) AnyWarnings() bool {
 	return hand.anyWarnings
 }
 
-func (hand *VerboseWarningHandler) Warn(wstr string) {
-	hand.num = hand.num + 1
-	if hand.num >= 10 {
-		panic("Too many warnings")
+func (hand *SilentWarningHandler) Warn(w warning.Warning) {
+	hand.anyWarnings = true
+}
+
+func (hand *SilentWarningHandler) Failed() bool {
+	return false
+}
+
+func (hand *SilentWarningHandler) Clone() WarningHandler {
+	return &SilentWarningHandler{hand.anyWarnings}
+}
+
+func (hand *SilentWarningHandler) SwitchMachinePC(m *MachinePC) {
+	// do nothing
+}
+
+// BufferWarningHandler keeps the most recent warnings, up to a fixed number
+type BufferWarningHandler struct {
+	warnings []warning.Warning
+	capacity int
+	dropped  int
+}
+
+func NewBufferWarningHandler(capacity int) *BufferWarningHandler {
+	return &BufferWarningHandler{nil, capacity, 0}
+}
+
+// Warnings returns the buffered warnings, oldest first
+func (hand *BufferWarningHandler) Warnings() []warning.Warning {
+	return append([]warning.Warning{}, hand.warnings...)
+}
+
+// Dropped returns the number of warnings that were discarded to stay within
+// the buffer's capacity
+func (hand *BufferWarningHandler) Dropped() int {
+	return hand.dropped
+}
+
+func (hand *BufferWarningHandler) AnyWarnings() bool {
+	return len(hand.warnings) > 0 || hand.dropped > 0
+}
+
+func (hand *BufferWarningHandler) Warn(w warning.Warning) {
+	if hand.capacity <= 0 {
+		hand.dropped++
+		return
 	}
-	if hand.pc != nil {
-		fmt.Println(hand.pc, ":", wstr)
-		// fmt.Println(hand.locations[hand.pc.pc], ":", wstr)
+	if len(hand.warnings) == hand.capacity {
+		hand.warnings = append(hand.warnings[:0], hand.warnings[1:]...)
+		hand.dropped++
 	}
+	hand.warnings = append(hand.warnings, w)
 }
 
-func (hand *VerboseWarningHandler) Clone() WarningHandler {
-	return &VerboseWarningHandler{hand.pc, hand.anyWarnings, hand.num}
+func (hand *BufferWarningHandler) Failed() bool {
+	return false
 }
 
-func (hand *VerboseWarningHandler) SwitchMachinePC(m *MachinePC) {
-	hand.pc = m
+func (hand *BufferWarningHandler) Clone() WarningHandler {
+	return &BufferWarningHandler{hand.Warnings(), hand.capacity, hand.dropped}
 }
 
-type SilentWarningHandler struct {
+func (hand *BufferWarningHandler) SwitchMachinePC(m *MachinePC) {
+	// do nothing
+}
+
+// StructuredLogger is the logging interface used by
+// NewStructuredLogWarningHandler. It matches the sugared loggers of common
+// structured logging packages.
+type StructuredLogger interface {
+	Warnw(msg string, keysAndValues ...interface{})
+}
+
+// LogWarningHandler forwards each warning to a logger
+type LogWarningHandler struct {
+	logFunc     func(warning.Warning)
 	anyWarnings bool
 }
 
-func NewSilentWarningHandler() *SilentWarningHandler {
-	return &SilentWarningHandler{false}
+func NewLogWarningHandler(logger *log.Logger) *LogWarningHandler {
+	return &LogWarningHandler{
+		func(w warning.Warning) {
+			logger.Println(w.String())
+		},
+		false,
+	}
 }
 
-func (hand *SilentWarningHandler) AnyWarnings() bool {
+func NewStructuredLogWarningHandler(logger StructuredLogger) *LogWarningHandler {
+	return &LogWarningHandler{
+		func(w warning.Warning) {
+			logger.Warnw(w.Msg, "pc", w.PC, "opcode", w.OpcodeName(), "err", w.Err)
+		},
+		false,
+	}
+}
+
+func (hand *LogWarningHandler) AnyWarnings() bool {
 	return hand.anyWarnings
 }
 
-func (hand *SilentWarningHandler) Warn(wstr string) {
+func (hand *LogWarningHandler) Warn(w warning.Warning) {
 	hand.anyWarnings = true
+	hand.logFunc(w)
 }
 
-func (hand *SilentWarningHandler) Clone() WarningHandler {
-	return &SilentWarningHandler{hand.anyWarnings}
+func (hand *LogWarningHandler) Failed() bool {
+	return false
 }
 
-func (hand *SilentWarningHandler) SwitchMachinePC(m *MachinePC) {
+func (hand *LogWarningHandler) Clone() WarningHandler {
+	return &LogWarningHandler{hand.logFunc, hand.anyWarnings}
+}
+
+func (hand *LogWarningHandler) SwitchMachinePC(m *MachinePC) {
 	// do nothing
 }
+
+// LimitWarningHandler passes warnings on to another handler, and stops the
+// machine once it has raised a given number of them. The assertion being
+// executed then ends with the machine in the error-stopped state.
+type LimitWarningHandler struct {
+	next  WarningHandler
+	limit int
+	count int
+}
+
+func NewLimitWarningHandler(next WarningHandler, limit int) *LimitWarningHandler {
+	return &LimitWarningHandler{next, limit, 0}
+}
+
+func (hand *LimitWarningHandler) AnyWarnings() bool {
+	return hand.count > 0
+}
+
+func (hand *LimitWarningHandler) Warn(w warning.Warning) {
+	hand.count++
+	hand.next.Warn(w)
+}
+
+func (hand *LimitWarningHandler) Failed() bool {
+	return hand.count >= hand.limit || hand.next.Failed()
+}
+
+func (hand *LimitWarningHandler) Clone() WarningHandler {
+	return &LimitWarningHandler{hand.next.Clone(), hand.limit, hand.count}
+}
+
+func (hand *LimitWarningHandler) SwitchMachinePC(m *MachinePC) {
+	hand.next.SwitchMachinePC(m)
+}
@@ -16,14 +16,47 @@
 
 package warning
 
-type warning struct {
-	msg string
+import (
+	"fmt"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// Warning records something unexpected that happened while a machine was
+// running: where it happened, what it was and, if it was an instruction
+// failing, the error the instruction raised
+type Warning struct {
+	PC     int64 // -1 if not known
+	Opcode value.Opcode
+	Name   string // name in the machine's instruction set, if known
+	Msg    string
+	Err    error
+}
+
+func New(msg string) Warning {
+	return Warning{PC: -1, Msg: msg}
+}
+
+func (w Warning) Error() string {
+	return w.Msg
+}
+
+func (w Warning) Unwrap() error {
+	return w.Err
 }
 
-func New(msg string) warning {
-	return warning{msg}
+func (w Warning) String() string {
+	if w.PC < 0 {
+		return w.Msg
+	}
+	return fmt.Sprintf("pc %v (%v): %v", w.PC, w.OpcodeName(), w.Msg)
 }
 
-func (w warning) Error() string {
-	return w.msg
+// OpcodeName returns the name of the warning's instruction
+func (w Warning) OpcodeName() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	return code.InstructionNames[w.Opcode]
 }
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vm
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/code"
+	"github.com/offchainlabs/arb-util/protocol"
+	"github.com/offchainlabs/arb-util/value"
+)
+
+// errorLoopMachine returns a machine that raises an error every three steps,
+// with the ERROR instruction at pc 2
+func errorLoopMachine() *Machine {
+	insns := []value.Operation{
+		value.BasicOperation{Op: code.PCPUSH},
+		value.BasicOperation{Op: code.ERRSET},
+		value.BasicOperation{Op: code.ERROR},
+	}
+	return NewMachine(insns, value.NewInt64Value(1), false, 100)
+}
+
+func TestWarningPolicies(t *testing.T) {
+	m := errorLoopMachine()
+	buffer := NewBufferWarningHandler(3)
+	m.SetWarningHandler(buffer)
+	for i := 0; i < 5; i++ {
+		_ = m.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	}
+	if len(buffer.Warnings()) != 3 || buffer.Dropped() != 2 {
+		t.Errorf("buffer has %v warnings and dropped %v", len(buffer.Warnings()), buffer.Dropped())
+	}
+	for _, w := range buffer.Warnings() {
+		if w.PC != 2 || w.Opcode != code.ERROR {
+			t.Errorf("unexpected warning %v", w)
+		}
+	}
+
+	var logged bytes.Buffer
+	m = errorLoopMachine()
+	m.SetWarningHandler(NewLogWarningHandler(log.New(&logged, "", 0)))
+	_ = m.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	if !strings.Contains(logged.String(), "pc 2 (error)") {
+		t.Errorf("unexpected log output %q", logged.String())
+	}
+
+	m = errorLoopMachine()
+	m.SetWarningHandler(NewLimitWarningHandler(NewSilentWarningHandler(), 3))
+	for i := 0; i < 5; i++ {
+		_ = m.ExecuteAssertion(10, protocol.NewTimeBounds(0, 100000))
+	}
+	if !m.IsErrored() {
+		t.Errorf("machine should stop after too many warnings")
+	}
+}